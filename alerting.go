@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+const alertBuckets = 30
+
+type alertBucket struct {
+	start    time.Time
+	total    int
+	failures int
+	codes    map[string]int
+}
+
+// FailureMonitor tracks the FCM failure rate over a rolling window and posts
+// an alert to a webhook when it crosses the configured threshold, and a
+// resolution once it drops back below.
+type FailureMonitor struct {
+	cfg AlertingConfig
+
+	mu       sync.Mutex
+	buckets  [alertBuckets]alertBucket
+	firing   bool
+	lastFire time.Time
+}
+
+// NewFailureMonitor returns nil when no alert webhook is configured.
+func NewFailureMonitor(cfg AlertingConfig) *FailureMonitor {
+	if cfg.WebhookURL == "" {
+		return nil
+	}
+	m := &FailureMonitor{cfg: cfg}
+	go m.run()
+	return m
+}
+
+func (m *FailureMonitor) bucketWidth() time.Duration {
+	return m.cfg.Window / alertBuckets
+}
+
+func (m *FailureMonitor) ObserveFCM(_ string, err error) {
+	now := time.Now()
+	start := now.Truncate(m.bucketWidth())
+	i := int(start.UnixNano()/int64(m.bucketWidth())) % alertBuckets
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b := &m.buckets[i]
+	if !b.start.Equal(start) {
+		*b = alertBucket{start: start, codes: map[string]int{}}
+	}
+	b.total++
+	if err != nil {
+		b.failures++
+		b.codes[fcmErrorCode(err)]++
+	}
+}
+
+// stats sums the buckets that fall inside the window.
+func (m *FailureMonitor) stats() (total, failures int, codes map[string]int) {
+	cutoff := time.Now().Add(-m.cfg.Window)
+	codes = map[string]int{}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, b := range m.buckets {
+		if b.start.Before(cutoff) {
+			continue
+		}
+		total += b.total
+		failures += b.failures
+		for code, n := range b.codes {
+			codes[code] += n
+		}
+	}
+	return total, failures, codes
+}
+
+func (m *FailureMonitor) run() {
+	ticker := time.NewTicker(m.bucketWidth())
+	defer ticker.Stop()
+	for range ticker.C {
+		m.check()
+	}
+}
+
+func (m *FailureMonitor) check() {
+	total, failures, codes := m.stats()
+	if total < m.cfg.MinSamples {
+		return
+	}
+	rate := float64(failures) / float64(total)
+
+	switch {
+	case !m.firing && rate >= m.cfg.Threshold:
+		if time.Since(m.lastFire) < m.cfg.Cooldown {
+			return
+		}
+		m.firing, m.lastFire = true, time.Now()
+		m.send("firing", rate, total, codes)
+	case m.firing && rate < m.cfg.Threshold:
+		m.firing = false
+		m.send("resolved", rate, total, codes)
+	}
+}
+
+type alertPayload struct {
+	Service  string         `json:"service"`
+	Status   string         `json:"status"`
+	Window   string         `json:"window"`
+	Rate     float64        `json:"failure_rate"`
+	Samples  int            `json:"samples"`
+	TopCodes map[string]int `json:"top_error_codes"`
+}
+
+func (m *FailureMonitor) send(status string, rate float64, total int, codes map[string]int) {
+	p := alertPayload{
+		Service:  m.cfg.ServiceName,
+		Status:   status,
+		Window:   m.cfg.Window.String(),
+		Rate:     rate,
+		Samples:  total,
+		TopCodes: topCodes(codes, 5),
+	}
+	log.Warn("FCM failure rate alert", "status", status, "rate", rate, "samples", total)
+
+	var body []byte
+	var err error
+	if m.cfg.Slack {
+		body, err = json.Marshal(map[string]string{"text": p.slackText()})
+	} else {
+		body, err = json.Marshal(p)
+	}
+	if err == nil {
+		err = postJSON(m.cfg.WebhookURL, body, nil)
+	}
+	if err != nil {
+		log.Error("error posting alert", "error", err)
+	}
+}
+
+func (p alertPayload) slackText() string {
+	if p.Status == "resolved" {
+		return fmt.Sprintf(":white_check_mark: %s: FCM failure rate back to %.1f%% over the last %s", p.Service, p.Rate*100, p.Window)
+	}
+	var codes []string
+	for code, n := range p.TopCodes {
+		codes = append(codes, fmt.Sprintf("%s (%d)", code, n))
+	}
+	sort.Strings(codes)
+	return fmt.Sprintf(":rotating_light: %s: FCM failure rate %.1f%% over the last %s (%d calls). Top errors: %s",
+		p.Service, p.Rate*100, p.Window, p.Samples, strings.Join(codes, ", "))
+}
+
+func topCodes(codes map[string]int, n int) map[string]int {
+	keys := make([]string, 0, len(codes))
+	for k := range codes {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return codes[keys[i]] > codes[keys[j]] })
+	top := map[string]int{}
+	for _, k := range keys[:min(n, len(keys))] {
+		top[k] = codes[k]
+	}
+	return top
+}
@@ -0,0 +1,409 @@
+// Package api holds the request and response bodies of the relay's HTTP API,
+// shared by the server and the Go client.
+package api
+
+import "time"
+
+// PublishInput is the body of /publish.
+type PublishInput struct {
+	Token        string       `json:"to" binding:"required,fcmtoken"`
+	Notification Notification `json:"notification"`
+	// ClientRef is an opaque caller supplied correlation ID. It is never sent
+	// to FCM, only echoed back in logs and responses.
+	ClientRef string `json:"client_ref,omitempty"`
+	Project   string `json:"project,omitempty"`
+	// Sync fails the request on a quota error instead of queueing it.
+	Sync bool `json:"sync,omitempty"`
+	PlatformInput
+}
+
+// BroadCastInput is the body of /broadcast.
+type BroadCastInput struct {
+	Topic        string       `json:"topic" binding:"required,fcmtopic"`
+	Notification Notification `json:"notification"`
+	Project      string       `json:"project,omitempty"`
+	Sync         bool         `json:"sync,omitempty"`
+	PlatformInput
+}
+
+type Notification struct {
+	Title string `json:"title" binding:"max=256"`
+	Body  string `json:"body" binding:"max=4096"`
+}
+
+// SubscribeInput is the body of /subscribe and /unsubscribe.
+type SubscribeInput struct {
+	Tokens  []string `json:"tokens" binding:"required,dive,fcmtoken"`
+	Topic   string   `json:"topic" binding:"required,fcmtopic"`
+	Project string   `json:"project,omitempty"`
+}
+
+// PlatformInput holds the optional per-platform settings shared by the send
+// endpoints.
+type PlatformInput struct {
+	// TTL in seconds, applied to both Android and APNs. Falls back to the
+	// configured default TTL when omitted.
+	TTL        *int64           `json:"ttl,omitempty"`
+	Android    *AndroidInput    `json:"android,omitempty"`
+	APNS       *APNSInput       `json:"apns,omitempty"`
+	Webpush    *WebpushInput    `json:"webpush,omitempty"`
+	FCMOptions *FCMOptionsInput `json:"fcm_options,omitempty"`
+	// Sound is played on both platforms unless android.sound or apns.sound
+	// overrides it.
+	Sound string `json:"sound,omitempty"`
+	// BoostOnFailure re-sends a message FCM could not deliver once more at
+	// high priority. Single-target sends only.
+	BoostOnFailure bool `json:"boost_on_failure,omitempty"`
+	// ReplaceKey makes the message replace an earlier one with the same key
+	// on every platform: it is the default Android collapse_key and tag,
+	// apns-collapse-id and webpush tag. At most 64 bytes, the APNs limit.
+	ReplaceKey string `json:"replace_key,omitempty"`
+	// Debug echoes the message sent to FCM, token redacted, in the
+	// response. Needs a key with the debug scope; single-target sends only.
+	Debug bool `json:"debug,omitempty"`
+}
+
+// FCMOptionsInput holds options that apply to the message on every platform.
+type FCMOptionsInput struct {
+	AnalyticsLabel string `json:"analytics_label,omitempty"`
+	// Image is an https URL shown in the notification on every platform. The
+	// SDK's message-level FCMOptions has no image field, so it is sent as the
+	// notification image, which FCM applies at the same scope.
+	Image string `json:"image,omitempty" binding:"omitempty,httpsurl"`
+}
+
+type AndroidInput struct {
+	// DirectBootOK lets the message be delivered while the device is still
+	// locked in direct boot mode.
+	DirectBootOK bool `json:"direct_boot_ok,omitempty"`
+	// Priority is "high" or "normal". Broadcasts fall back to the topic's
+	// configured default.
+	Priority  string `json:"priority,omitempty"`
+	Sound     string `json:"sound,omitempty"`
+	ChannelID string `json:"channel_id,omitempty"`
+	// CollapseKey groups messages so the device only keeps the latest.
+	CollapseKey string `json:"collapse_key,omitempty"`
+	// Tag makes the notification replace a shown one with the same tag.
+	Tag  string `json:"tag,omitempty"`
+	Icon string `json:"icon,omitempty"`
+	// Color is the notification icon color as #rrggbb.
+	Color string `json:"color,omitempty"`
+	// Ticker is the text accessibility services announce when the
+	// notification arrives.
+	Ticker string `json:"ticker,omitempty"`
+	// Sticky keeps the notification in the drawer when it is tapped.
+	Sticky bool `json:"sticky,omitempty"`
+	// DefaultSound, DefaultVibrateTimings and DefaultLightSettings make the
+	// device use its own default sound, vibration and LED for the
+	// notification. A default sound wins over the configured default.
+	DefaultSound          bool `json:"default_sound,omitempty"`
+	DefaultVibrateTimings bool `json:"default_vibrate_timings,omitempty"`
+	DefaultLightSettings  bool `json:"default_light_settings,omitempty"`
+	// EventTime is when the event the notification is about happened, as
+	// RFC 3339. The tray shows it instead of the delivery time.
+	EventTime *time.Time `json:"event_time,omitempty"`
+	// NotificationCount is the number the launcher shows on the app icon,
+	// Android's counterpart of the APNs badge.
+	NotificationCount *int     `json:"notification_count,omitempty" binding:"omitempty,min=0"`
+	BodyLocKey        string   `json:"body_loc_key,omitempty"`
+	BodyLocArgs       []string `json:"body_loc_args,omitempty"`
+	TitleLocKey       string   `json:"title_loc_key,omitempty"`
+	TitleLocArgs      []string `json:"title_loc_args,omitempty"`
+}
+
+type APNSInput struct {
+	// PushType sets the apns-push-type header: alert, background or voip.
+	// Defaults to "background" for content-available pushes with no title,
+	// body or loc key, and "alert" otherwise.
+	PushType         string `json:"push_type,omitempty"`
+	ContentAvailable bool   `json:"content_available,omitempty"`
+	Sound            string `json:"sound,omitempty"`
+	// CollapseID sets apns-collapse-id, APNs' counterpart of collapse_key.
+	CollapseID string `json:"collapse_id,omitempty"`
+	// Priority sets apns-priority, 10 to deliver at once or 5 to let the
+	// device save power. Defaults to 5 for background pushes, else 10.
+	Priority int `json:"priority,omitempty" binding:"omitempty,oneof=5 10"`
+	// Expiration sets apns-expiration, as unix seconds or as a duration from
+	// now such as "1h". Overrides ttl for APNs.
+	Expiration   string   `json:"expiration,omitempty"`
+	LocKey       string   `json:"loc_key,omitempty"`
+	LocArgs      []string `json:"loc_args,omitempty"`
+	TitleLocKey  string   `json:"title_loc_key,omitempty"`
+	TitleLocArgs []string `json:"title_loc_args,omitempty"`
+	// Rich bundles the settings a notification service extension needs to
+	// download and attach an image.
+	Rich *RichInput `json:"rich,omitempty"`
+}
+
+// WebpushInput holds the browser notification options. Title and body come
+// from the message's notification.
+type WebpushInput struct {
+	Actions []WebpushAction `json:"actions,omitempty" binding:"max=10,dive"`
+	// Badge is the URL of the small monochrome image shown where there is no
+	// room for the icon.
+	Badge string `json:"badge,omitempty"`
+	// RequireInteraction keeps the notification on screen until it is
+	// clicked or dismissed.
+	RequireInteraction bool `json:"require_interaction,omitempty"`
+	Silent             bool `json:"silent,omitempty"`
+	// Renotify alerts again when the notification replaces one with the same
+	// tag, so it needs Tag.
+	Renotify bool   `json:"renotify,omitempty"`
+	Tag      string `json:"tag,omitempty" binding:"required_if=Renotify true"`
+	// Vibrate is the vibration pattern, alternating vibration and pause
+	// lengths in milliseconds.
+	Vibrate []int `json:"vibrate,omitempty" binding:"max=32,dive,min=0"`
+}
+
+// WebpushAction is a notification button. The service worker's
+// notificationclick handler sees Action as event.action.
+type WebpushAction struct {
+	Action string `json:"action" binding:"required"`
+	Title  string `json:"title" binding:"required"`
+	Icon   string `json:"icon,omitempty"`
+}
+
+// RichInput sets mutable-content, the category and the image URL custom data
+// key together, so the iOS service extension always fires.
+type RichInput struct {
+	ImageURL string `json:"image_url" binding:"required,httpsurl"`
+	Category string `json:"category" binding:"required"`
+}
+
+// SendInput is the body of /send. Exactly one of Token, Tokens, Topic or
+// Condition must be set.
+type SendInput struct {
+	Token        string            `json:"token" binding:"omitempty,fcmtoken"`
+	Tokens       []string          `json:"tokens" binding:"dive,fcmtoken"`
+	Topic        string            `json:"topic" binding:"omitempty,fcmtopic"`
+	Condition    string            `json:"condition"`
+	Notification Notification      `json:"notification"`
+	Data         map[string]string `json:"data" binding:"max=100"`
+	ClientRef    string            `json:"client_ref,omitempty"`
+	Project      string            `json:"project,omitempty"`
+	// DryRun validates the message with FCM without delivering it. Not
+	// supported with tokens.
+	DryRun bool `json:"dry_run,omitempty"`
+	// Sync fails the request on a quota error instead of queueing it.
+	// Token lists are never queued.
+	Sync bool `json:"sync,omitempty"`
+	// AllOrNothing has FCM validate the message for every token first and
+	// sends nothing when any of them is rejected. Tokens only.
+	AllOrNothing bool `json:"all_or_nothing,omitempty"`
+	PlatformInput
+}
+
+// TargetCount reports how many of the mutually exclusive targets are set.
+func (in *SendInput) TargetCount() int {
+	n := 0
+	for _, set := range []bool{in.Token != "", len(in.Tokens) > 0, in.Topic != "", in.Condition != ""} {
+		if set {
+			n++
+		}
+	}
+	return n
+}
+
+// Target describes the single-message target for logs and the audit trail.
+func (in *SendInput) Target() string {
+	switch {
+	case in.Token != "":
+		return "token:" + in.Token
+	case in.Topic != "":
+		return "topic:" + in.Topic
+	default:
+		return "condition:" + in.Condition
+	}
+}
+
+// Machine-readable codes for the FCM error categories we care about.
+const (
+	ErrCodeInvalidArgument = "invalid_argument"
+	ErrCodeUnregistered    = "unregistered"
+	ErrCodeSenderMismatch  = "sender_id_mismatch"
+	ErrCodeQuotaExceeded   = "quota_exceeded"
+	ErrCodeUnavailable     = "unavailable"
+	ErrCodeInternal        = "internal"
+	ErrCodeThirdPartyAuth  = "third_party_auth_error"
+	ErrCodeUnauthenticated = "unauthenticated"
+	ErrCodePermission      = "permission_denied"
+	ErrCodeUnknown         = "unknown"
+	// ErrCodeOverDeviceLimit is ours: the device got too many messages
+	// recently and the send was not attempted.
+	ErrCodeOverDeviceLimit = "over_device_limit"
+)
+
+// Error codes returned by the HMAC auth mode.
+const (
+	ErrCodeBadSignature = "bad_signature"
+	ErrCodeStaleRequest = "stale_request"
+	ErrCodeNonceReused  = "nonce_reused"
+	// ErrCodeNonceCacheFull comes with 503: every remembered nonce is still
+	// live and the request is refused rather than make one replayable.
+	ErrCodeNonceCacheFull = "nonce_cache_full"
+	// ErrCodeBodyTooLarge comes with 413: the body of a signed request is
+	// over auth.hmac.max_body_bytes and was not read in full.
+	ErrCodeBodyTooLarge = "body_too_large"
+)
+
+// PreviewInput is the body of /preview. It takes the fields of a /publish,
+// /broadcast or single-target /send body, or a /publish-named template
+// reference, with every target optional.
+type PreviewInput struct {
+	To           string            `json:"to" binding:"omitempty,fcmtoken"`
+	Token        string            `json:"token" binding:"omitempty,fcmtoken"`
+	Topic        string            `json:"topic" binding:"omitempty,fcmtopic"`
+	Condition    string            `json:"condition"`
+	Notification Notification      `json:"notification"`
+	Data         map[string]string `json:"data" binding:"max=100"`
+	Template     string            `json:"template"`
+	Variables    map[string]string `json:"variables"`
+	ClientRef    string            `json:"client_ref,omitempty"`
+	PlatformInput
+}
+
+// PreviewResponse is the body of a successful /preview.
+type PreviewResponse struct {
+	// Message is the FCM message as it would be sent.
+	Message   map[string]any `json:"message"`
+	Warnings  []string       `json:"warnings"`
+	ClientRef string         `json:"client_ref,omitempty"`
+}
+
+// FieldViolation is one field level complaint from FCM about a message.
+type FieldViolation struct {
+	Field       string `json:"field"`
+	Description string `json:"description"`
+}
+
+// FieldError is one failed validation rule on a request field.
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// SendResponse is the body of a successful single message send.
+type SendResponse struct {
+	MessageID string `json:"message_id,omitempty"`
+	ClientRef string `json:"client_ref,omitempty"`
+	// Queued is set when FCM refused the message for quota and it will be
+	// sent at SendAt instead.
+	Queued bool       `json:"queued,omitempty"`
+	Handle string     `json:"handle,omitempty"`
+	SendAt *time.Time `json:"send_at,omitempty"`
+	// Deduplicated is set when an identical message was sent recently and
+	// MessageID is that message's.
+	Deduplicated bool `json:"deduplicated,omitempty"`
+	DryRun       bool `json:"dry_run,omitempty"`
+	// Debug holds the constructed message of a debug request.
+	Debug map[string]any `json:"debug,omitempty"`
+	// Echo is the request body as the relay read it, when ?echo=1 asked for
+	// it.
+	Echo any `json:"echo,omitempty"`
+	// Warnings lists what is allowed but likely unintended about the sent
+	// message.
+	Warnings []string `json:"warnings,omitempty"`
+	// FCMLatencyMS is how long the FCM call took, when ?timing=1 asked for
+	// it.
+	FCMLatencyMS float64 `json:"fcm_latency_ms,omitempty"`
+	// AnalyticsLabel is the label the message was sent with, including a
+	// topic's prefix. FCM does not return it, this is the relay's own record.
+	AnalyticsLabel string `json:"analytics_label,omitempty"`
+}
+
+// MulticastFailure is one token of a multicast send that was not delivered.
+type MulticastFailure struct {
+	Index   int              `json:"index"`
+	Code    string           `json:"code"`
+	Error   string           `json:"error"`
+	Details []FieldViolation `json:"details,omitempty"`
+}
+
+// MulticastResponse is the body of a successful /send to a token list.
+type MulticastResponse struct {
+	SuccessCount int                `json:"success_count"`
+	FailureCount int                `json:"failure_count"`
+	Failures     []MulticastFailure `json:"failures"`
+	// SkippedCount is the number of tokens never sent to FCM because the
+	// request was cancelled first.
+	SkippedCount int    `json:"skipped_count"`
+	ClientRef    string `json:"client_ref"`
+	// DeduplicatedCount is the number of tokens, included in SuccessCount,
+	// that got the same message within the dedup window and were not sent
+	// it again.
+	DeduplicatedCount int `json:"deduplicated_count,omitempty"`
+	// Responses has one entry per requested token, in request order, when
+	// ?verbose=1 asked for them.
+	Responses []MulticastResult `json:"responses,omitempty"`
+	// AnalyticsLabel is the label the message was sent with. FCM does not
+	// return it, this is the relay's own record.
+	AnalyticsLabel string `json:"analytics_label,omitempty"`
+}
+
+// MulticastResult is the outcome for one token of a multicast send.
+type MulticastResult struct {
+	Index     int    `json:"index"`
+	Success   bool   `json:"success"`
+	MessageID string `json:"message_id,omitempty"`
+	// Deduplicated is set when the token got the same message recently and
+	// MessageID is that message's.
+	Deduplicated bool `json:"deduplicated,omitempty"`
+	// Skipped is set when the token was never sent because the request was
+	// cancelled first.
+	Skipped bool             `json:"skipped,omitempty"`
+	Code    string           `json:"code,omitempty"`
+	Error   string           `json:"error,omitempty"`
+	Details []FieldViolation `json:"details,omitempty"`
+}
+
+// SubscribeResponse is the body of a successful /subscribe or /unsubscribe,
+// and with status 207 of a partly successful one. Failure indexes refer to
+// the tokens after duplicates were removed.
+type SubscribeResponse struct {
+	Topic             string         `json:"topic"`
+	DuplicatesRemoved int            `json:"duplicates_removed"`
+	SuccessCount      int            `json:"success_count"`
+	FailureCount      int            `json:"failure_count"`
+	Failures          []TopicFailure `json:"failures,omitempty"`
+}
+
+// TopicFailure is one token a topic call could not (un)subscribe.
+type TopicFailure struct {
+	Index  int    `json:"index"`
+	Reason string `json:"reason"`
+}
+
+// ImportProgress is one record of the NDJSON stream /subscribe/import
+// answers with. Line is where a resumed import should continue after: every
+// pair up to it was handled. The last record of a complete import has Done
+// set and the totals.
+type ImportProgress struct {
+	Topic     string `json:"topic,omitempty"`
+	Processed int    `json:"processed"`
+	Failed    int    `json:"failed"`
+	Line      int    `json:"line"`
+	Error     string `json:"error,omitempty"`
+	Done      bool   `json:"done,omitempty"`
+}
+
+// ErrorResponse is the body of every failed request.
+type ErrorResponse struct {
+	Error     string       `json:"error"`
+	Code      string       `json:"code,omitempty"`
+	ClientRef string       `json:"client_ref,omitempty"`
+	Fields    []FieldError `json:"fields,omitempty"`
+	// Details are FCM's own complaints about an invalid message.
+	Details []FieldViolation `json:"details,omitempty"`
+	// Failures are the tokens that stopped an all_or_nothing multicast.
+	Failures []MulticastFailure `json:"failures,omitempty"`
+	// SkippedCount is the tokens of a failed multicast that were never sent
+	// because the request was cancelled first.
+	SkippedCount int `json:"skipped_count,omitempty"`
+	// Debug, Echo, Warnings and AnalyticsLabel are as in SendResponse, for
+	// a send FCM refused.
+	Debug          map[string]any `json:"debug,omitempty"`
+	Echo           any            `json:"echo,omitempty"`
+	Warnings       []string       `json:"warnings,omitempty"`
+	AnalyticsLabel string         `json:"analytics_label,omitempty"`
+}
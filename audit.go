@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+	"github.com/baakel/go_fcm/api"
+	"github.com/charmbracelet/log"
+	"github.com/gin-gonic/gin"
+)
+
+// AuditEntry records a single send or topic management operation.
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	KeyID     string    `json:"key_id"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Project   string    `json:"project,omitempty"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target"`
+	Title     string    `json:"title,omitempty"`
+	MessageID string    `json:"message_id,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	ClientRef string    `json:"client_ref,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	// Tokens, Succeeded and Failed count the tokens of a topic operation.
+	Tokens    int `json:"token_count,omitempty"`
+	Succeeded int `json:"success_count,omitempty"`
+	Failed    int `json:"failure_count,omitempty"`
+}
+
+// AuditLog writes one JSON line per AuditEntry.
+type AuditLog struct {
+	mu   sync.Mutex
+	enc  *json.Encoder
+	path string
+}
+
+// NewAuditLog appends to path, or writes to stdout when path is empty.
+func NewAuditLog(path string) (*AuditLog, error) {
+	var w io.Writer = os.Stdout
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("opening audit log: %w", err)
+		}
+		w = f
+	}
+	return &AuditLog{enc: json.NewEncoder(w), path: path}, nil
+}
+
+func (a *AuditLog) Record(e AuditEntry) {
+	if a == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.enc.Encode(e); err != nil {
+		log.Error("error writing audit entry", "error", err)
+	}
+}
+
+// recordSend audits the outcome of a send made while handling c.
+func (a *AuditLog) recordSend(c *gin.Context, action, target, title, messageID string, err error, clientRef string) {
+	e := AuditEntry{
+		KeyID:     c.GetString("api_key_id"),
+		Tenant:    requestTenant(c),
+		Project:   c.GetString("project"),
+		Action:    action,
+		Target:    target,
+		Title:     title,
+		MessageID: messageID,
+		ClientRef: clientRef,
+		RequestID: c.GetString("request_id"),
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	a.Record(e)
+}
+
+// recordTopic audits a subscribe or unsubscribe call. resp is nil when the
+// call failed as a whole.
+func (a *AuditLog) recordTopic(c *gin.Context, action, topic string, tokens int, resp *messaging.TopicManagementResponse, err error) {
+	e := AuditEntry{
+		KeyID:     c.GetString("api_key_id"),
+		Tenant:    requestTenant(c),
+		Project:   c.GetString("project"),
+		Action:    action,
+		Target:    "topic:" + topic,
+		Tokens:    tokens,
+		RequestID: c.GetString("request_id"),
+	}
+	if resp != nil {
+		e.Succeeded, e.Failed = resp.SuccessCount, resp.FailureCount
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	a.Record(e)
+}
+
+// TopicHistory serves the topic management entries of the audit log,
+// optionally filtered by topic, key_id and a since/until RFC 3339 time range.
+func (a *AuditLog) TopicHistory(c *gin.Context) {
+	if a.path == "" {
+		c.JSON(http.StatusNotImplemented, api.ErrorResponse{Error: "audit log is not written to a file"})
+		return
+	}
+	var since, until time.Time
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"since", &since}, {"until", &until}} {
+		if v := c.Query(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, api.ErrorResponse{Error: fmt.Sprintf("%s must be an RFC 3339 time", p.name)})
+				return
+			}
+			*p.dst = t
+		}
+	}
+	topic, key := c.Query("topic"), c.Query("key_id")
+
+	f, err := os.Open(a.path)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, api.ErrorResponse{Error: "cannot read audit log"})
+		return
+	}
+	defer f.Close()
+
+	entries := []AuditEntry{}
+	dec := json.NewDecoder(f)
+	for {
+		var e AuditEntry
+		// A truncated last line is an entry still being written.
+		if err := dec.Decode(&e); err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, api.ErrorResponse{Error: "audit log is corrupt"})
+			return
+		}
+		switch {
+		case e.Action != "subscribe" && e.Action != "unsubscribe",
+			topic != "" && e.Target != "topic:"+topic,
+			key != "" && e.KeyID != key,
+			!since.IsZero() && e.Time.Before(since),
+			!until.IsZero() && e.Time.After(until):
+			continue
+		}
+		entries = append(entries, e)
+	}
+	c.JSON(http.StatusOK, gin.H{"entries": entries})
+}
+
+// recordSend audits a send and notifies the webhooks subscribed to its outcome.
+func (s *AppState) recordSend(c *gin.Context, action, target, title, messageID string, err error, clientRef string) {
+	s.Audit.recordSend(c, action, target, title, messageID, err, clientRef)
+	s.Webhooks.emitSend(c, action, target, messageID, err, clientRef)
+}
+
+// keyID identifies an API key in logs without revealing it: the first 12 hex
+// characters of its SHA-256.
+func keyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])[:12]
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	// errUnknownCredential is returned by an Authenticator for a token it
+	// does not accept.
+	errUnknownCredential = errors.New("Unauthorized: Invalid API Key")
+	// errNoProjects is returned for a valid token that grants no Firebase
+	// project. An identity from an external provider may only target the
+	// projects it names.
+	errNoProjects = errors.New("Forbidden: credential grants no Firebase project")
+)
+
+// Authenticator resolves the bearer token of a request to the identity it
+// acts as. The identity carries the tenant, allowed projects and scopes the
+// handlers enforce, whichever backend produced it.
+type Authenticator interface {
+	Authenticate(ctx context.Context, token string) (*APIKey, error)
+}
+
+// newAuthenticator returns the backend selected by auth.backend.
+func newAuthenticator(c AuthConfig, state *AppState) (Authenticator, error) {
+	static := staticAuthenticator{state: state}
+	switch c.Backend {
+	case "introspection":
+		return &introspectionAuthenticator{
+			config: c.Introspection,
+			client: &http.Client{Timeout: c.Introspection.Timeout},
+			cache:  newMemoryStore(c.Introspection.CacheSize),
+		}, nil
+	case "jwt":
+		return newJWTAuthenticator(c.JWT, static)
+	}
+	return static, nil
+}
+
+// staticAuthenticator accepts the configured API keys, as of the last
+// reload.
+type staticAuthenticator struct {
+	state *AppState
+}
+
+func (s staticAuthenticator) Authenticate(_ context.Context, token string) (*APIKey, error) {
+	key, ok := s.state.Settings().APIKeys[token]
+	if !ok {
+		return nil, errUnknownCredential
+	}
+	return key, nil
+}
+
+// introspectionAuthenticator asks an OAuth2 authorization server whether a
+// token is active, per RFC 7662. The tenant is read from a configurable
+// claim of the answer, the allowed projects from another, and a "debug"
+// scope grants the debug scope. Answers are cached by a hash of the token,
+// until the token expires but at most for cache_ttl, so a revoked token is
+// accepted for up to that long.
+type introspectionAuthenticator struct {
+	config IntrospectionConfig
+	client *http.Client
+	cache  *memoryStore
+}
+
+// inactiveToken is cached for tokens the server called inactive.
+const inactiveToken = "-"
+
+func (a *introspectionAuthenticator) Authenticate(ctx context.Context, token string) (*APIKey, error) {
+	sum := sha256.Sum256([]byte(token))
+	cacheKey := hex.EncodeToString(sum[:])
+	if v, ok, _ := a.cache.Get(ctx, cacheKey); ok {
+		if v == inactiveToken {
+			return nil, errUnknownCredential
+		}
+		var key APIKey
+		if err := json.Unmarshal([]byte(v), &key); err == nil {
+			return withProjects(&key)
+		}
+	}
+	key, expires, err := a.introspect(ctx, token)
+	switch {
+	case errors.Is(err, errUnknownCredential):
+		a.cache.Set(ctx, cacheKey, inactiveToken, a.config.CacheTTL)
+	case err == nil:
+		ttl := a.config.CacheTTL
+		if !expires.IsZero() {
+			ttl = min(ttl, time.Until(expires))
+		}
+		if raw, mErr := json.Marshal(key); mErr == nil && ttl > 0 {
+			a.cache.Set(ctx, cacheKey, string(raw), ttl)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return withProjects(key)
+}
+
+// withProjects refuses an external identity that grants no project, which
+// for an APIKey would mean every project.
+func withProjects(key *APIKey) (*APIKey, error) {
+	if len(key.Projects) == 0 {
+		return nil, errNoProjects
+	}
+	return key, nil
+}
+
+// introspect asks the server about token and returns the identity and when
+// the token expires, zero when the answer doesn't say.
+func (a *introspectionAuthenticator) introspect(ctx context.Context, token string) (*APIKey, time.Time, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.config.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(a.config.ClientID, a.config.ClientSecret)
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("token introspection: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, time.Time{}, fmt.Errorf("token introspection: unexpected status %s", resp.Status)
+	}
+	var claims map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&claims); err != nil {
+		return nil, time.Time{}, fmt.Errorf("token introspection: %w", err)
+	}
+	if active, _ := claims["active"].(bool); !active {
+		return nil, time.Time{}, errUnknownCredential
+	}
+	var expires time.Time
+	if exp, ok := claims["exp"].(float64); ok {
+		expires = time.Unix(int64(exp), 0)
+		if !time.Now().Before(expires) {
+			return nil, time.Time{}, errUnknownCredential
+		}
+	}
+	tenant, _ := claims[a.config.TenantClaim].(string)
+	if tenant == "" {
+		return nil, time.Time{}, fmt.Errorf("token introspection: token has no %q claim to use as tenant", a.config.TenantClaim)
+	}
+	return &APIKey{
+		Tenant:   tenant,
+		Projects: claimList(claims[a.config.ProjectsClaim]),
+		Debug:    slices.Contains(claimList(claims["scope"]), "debug"),
+	}, expires, nil
+}
+
+// claimList reads a claim holding a list of strings, either as a JSON array
+// or space separated like OAuth2 scopes.
+func claimList(v any) []string {
+	switch v := v.(type) {
+	case string:
+		return strings.Fields(v)
+	case []any:
+		var list []string
+		for _, e := range v {
+			if s, ok := e.(string); ok && s != "" {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// breakerOpenError is returned instead of calling FCM while the circuit
+// breaker is open.
+type breakerOpenError struct {
+	retryAfter time.Duration
+}
+
+func (e *breakerOpenError) Error() string {
+	return fmt.Sprintf("FCM is failing, calls are paused for another %s", e.retryAfter.Round(time.Second))
+}
+
+// circuitBreaker stops calling FCM while the upstream health reports it
+// degraded, so requests fail at once instead of each waiting out the
+// outage. It keeps no counts of its own. After cooldown a single trial call
+// is let through: its success closes the breaker and clears the health
+// window, its failure opens it for another cooldown. A nil breaker always
+// allows calls.
+type circuitBreaker struct {
+	health   *UpstreamHealth
+	cooldown time.Duration
+
+	mu       sync.Mutex
+	openedAt time.Time // zero while closed
+	trial    bool      // a half-open trial call is in flight
+}
+
+func newCircuitBreaker(c CircuitBreakerConfig, health *UpstreamHealth) *circuitBreaker {
+	if !c.Enabled {
+		return nil
+	}
+	return &circuitBreaker{health: health, cooldown: c.Cooldown}
+}
+
+// allow returns a *breakerOpenError when the call must not be made, and
+// whether the call is the half-open trial. Every allowed call must be
+// followed by record with that flag.
+func (b *circuitBreaker) allow() (bool, error) {
+	if b == nil {
+		return false, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openedAt.IsZero() {
+		ratio, degraded := b.health.status()
+		if !degraded {
+			return false, nil
+		}
+		log.Warn("FCM circuit breaker open", "success_ratio", ratio, "cooldown", b.cooldown)
+		b.openedAt = time.Now()
+	}
+	if wait := b.cooldown - time.Since(b.openedAt); wait > 0 {
+		return false, &breakerOpenError{retryAfter: wait}
+	}
+	if b.trial {
+		// Until the trial call is back, everyone else waits a moment.
+		return false, &breakerOpenError{retryAfter: time.Second}
+	}
+	b.trial = true
+	return true, nil
+}
+
+// record takes the outcome of an allowed call. Only the trial's outcome
+// changes the breaker; the health window sees every call through the
+// FCMClient's observers.
+func (b *circuitBreaker) record(trial bool, err error) {
+	if b == nil || !trial {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+	switch {
+	case errors.Is(err, errFCMBusy) || errors.Is(err, context.Canceled):
+		// The call never got an answer from FCM; the next one is the trial.
+	case upstreamFailure(err):
+		log.Warn("FCM circuit breaker trial failed", "cooldown", b.cooldown, "error", err)
+		b.openedAt = time.Now()
+	default:
+		log.Info("FCM circuit breaker closed")
+		b.openedAt = time.Time{}
+		b.health.reset()
+	}
+}
+
+// state is "closed", "open" or "half_open", and "disabled" for a nil
+// breaker.
+func (b *circuitBreaker) state() string {
+	if b == nil {
+		return "disabled"
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.openedAt.IsZero():
+		return "closed"
+	case time.Since(b.openedAt) < b.cooldown:
+		return "open"
+	default:
+		return "half_open"
+	}
+}
+
+// guarded runs call through the breaker and the in-flight limiter.
+func guarded[T any](ctx context.Context, b *circuitBreaker, l *inFlightLimiter, call func() (T, error)) (T, error) {
+	trial, err := b.allow()
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	v, err := limited(ctx, l, call)
+	b.record(trial, err)
+	return v, err
+}
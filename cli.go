@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"firebase.google.com/go/v4/messaging"
+	"github.com/baakel/go_fcm/api"
+)
+
+// Process exit codes used by the one-shot commands.
+const (
+	exitOK          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitRejected    = 3
+	exitUnavailable = 4
+	exitAuth        = 5
+)
+
+const usageText = `Usage: fcmrelay <command> [flags]
+
+Commands:
+  serve        run the HTTP server (default when no command is given)
+  send         send a single message and exit
+  subscribe    subscribe tokens from a file to a topic
+  unsubscribe  unsubscribe tokens from a file from a topic
+  smoketest    check a running relay end to end
+
+Run "fcmrelay <command> -h" for the flags of a command.
+`
+
+func usage() {
+	fmt.Fprint(os.Stderr, usageText)
+}
+
+// kvFlag collects repeated key=value flags into a map.
+type kvFlag map[string]string
+
+func (f kvFlag) String() string {
+	pairs := make([]string, 0, len(f))
+	for k, v := range f {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f kvFlag) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("expected key=value, got %q", s)
+	}
+	f[k] = v
+	return nil
+}
+
+// exitCodeFor maps an FCM error onto the process exit code of a one-shot
+// command.
+func exitCodeFor(code string) int {
+	switch code {
+	case api.ErrCodeInvalidArgument, api.ErrCodeUnregistered, api.ErrCodeSenderMismatch:
+		return exitRejected
+	case api.ErrCodeQuotaExceeded, api.ErrCodeUnavailable, api.ErrCodeInternal:
+		return exitUnavailable
+	case api.ErrCodeThirdPartyAuth, api.ErrCodeUnauthenticated, api.ErrCodePermission:
+		return exitAuth
+	default:
+		return exitFailure
+	}
+}
+
+func runSend(args []string) int {
+	fs := flag.NewFlagSet("send", flag.ContinueOnError)
+	credentials := fs.String("credentials", os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"), "service account file (env GOOGLE_APPLICATION_CREDENTIALS)")
+	token := fs.String("token", "", "registration token to send to")
+	topic := fs.String("topic", "", "topic to send to")
+	title := fs.String("title", "", "notification title")
+	body := fs.String("body", "", "notification body")
+	dryRun := fs.Bool("dry-run", false, "validate the message without delivering it")
+	data := kvFlag{}
+	fs.Var(data, "data", "data payload entry as key=value, may be repeated")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+
+	if (*token == "") == (*topic == "") {
+		fmt.Fprintln(os.Stderr, "exactly one of --token or --topic is required")
+		return exitUsage
+	}
+
+	message := &messaging.Message{
+		Token: *token,
+		Topic: *topic,
+	}
+	if *title != "" || *body != "" {
+		message.Notification = &messaging.Notification{Title: *title, Body: *body}
+	}
+	if len(data) > 0 {
+		message.Data = data
+	}
+
+	ctx := context.Background()
+	client, err := newMessagingClient(ctx, FirebaseProject{CredentialsFile: *credentials}, envFirebaseConfig().endpoint())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitAuth
+	}
+
+	var id string
+	if *dryRun {
+		id, err = client.SendDryRun(ctx, message)
+	} else {
+		id, err = client.Send(ctx, message)
+	}
+	if err != nil {
+		code := fcmErrorCode(err)
+		fmt.Fprintf(os.Stderr, "%s: %s\n", code, err)
+		for _, v := range fcmFieldViolations(err) {
+			fmt.Fprintf(os.Stderr, "  %s: %s\n", v.Field, v.Description)
+		}
+		return exitCodeFor(code)
+	}
+	fmt.Println(id)
+	return exitOK
+}
+
+func runSubscribe(name string, args []string) int {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	credentials := fs.String("credentials", os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"), "service account file (env GOOGLE_APPLICATION_CREDENTIALS)")
+	topic := fs.String("topic", "", "topic to manage")
+	tokensFile := fs.String("tokens-file", "", `file with one registration token per line, "-" for stdin`)
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if *topic == "" || *tokensFile == "" {
+		fmt.Fprintln(os.Stderr, "--topic and --tokens-file are required")
+		return exitUsage
+	}
+
+	tokens, err := readTokens(*tokensFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	if len(tokens) == 0 {
+		fmt.Fprintln(os.Stderr, "no tokens found in", *tokensFile)
+		return exitUsage
+	}
+
+	ctx := context.Background()
+	client, err := newMessagingClient(ctx, FirebaseProject{CredentialsFile: *credentials}, envFirebaseConfig().endpoint())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitAuth
+	}
+
+	var response *messaging.TopicManagementResponse
+	if name == "unsubscribe" {
+		response, err = client.UnsubscribeFromTopic(ctx, tokens, *topic)
+	} else {
+		response, err = client.SubscribeToTopic(ctx, tokens, *topic)
+	}
+	if err != nil {
+		code := fcmErrorCode(err)
+		fmt.Fprintf(os.Stderr, "%s: %s\n", code, err)
+		return exitCodeFor(code)
+	}
+
+	fmt.Printf("success: %d, failure: %d\n", response.SuccessCount, response.FailureCount)
+	for _, e := range response.Errors {
+		fmt.Fprintf(os.Stderr, "token %d: %s\n", e.Index, e.Reason)
+	}
+	if response.FailureCount != 0 {
+		return exitRejected
+	}
+	return exitOK
+}
+
+func readTokens(path string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var tokens []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens = append(tokens, line)
+	}
+	return tokens, scanner.Err()
+}
@@ -0,0 +1,189 @@
+// Package client is a Go client for the relay's HTTP API.
+//
+//	c := client.New("https://push.example.com", apiKey)
+//	resp, err := c.PublishToken(ctx, api.PublishInput{Token: token, Notification: api.Notification{Title: "Hi"}})
+//	var apiErr *client.Error
+//	if errors.As(err, &apiErr) && apiErr.Code == api.ErrCodeUnregistered {
+//		// forget the token
+//	}
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/baakel/go_fcm/api"
+)
+
+// Client calls the relay. It is safe for concurrent use.
+type Client struct {
+	baseURL string
+	apiKey  string
+	http    *http.Client
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the http.Client used for requests. The default is
+// http.DefaultClient.
+func WithHTTPClient(h *http.Client) Option {
+	return func(c *Client) { c.http = h }
+}
+
+// New returns a client for the relay at baseURL, authenticating with apiKey
+// as a bearer token. An empty apiKey sends no Authorization header.
+func New(baseURL, apiKey string, opts ...Option) *Client {
+	c := &Client{baseURL: strings.TrimRight(baseURL, "/"), apiKey: apiKey, http: http.DefaultClient}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Error is a non-2xx response from the relay.
+type Error struct {
+	Status int
+	// Code is one of the api.ErrCode constants when the relay gave one.
+	Code    string
+	Message string
+	// Fields lists the invalid request fields of a 422 response.
+	Fields []api.FieldError
+	// Details are FCM's own complaints about an invalid message.
+	Details []api.FieldViolation
+	// RetryAfter is the Retry-After header of a 429 or 503 response.
+	RetryAfter string
+}
+
+func (e *Error) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("go_fcm: %d %s: %s", e.Status, e.Code, e.Message)
+	}
+	return fmt.Sprintf("go_fcm: %d: %s", e.Status, e.Message)
+}
+
+// PublishToken sends a notification to a single device.
+func (c *Client) PublishToken(ctx context.Context, in api.PublishInput) (*api.SendResponse, error) {
+	var out api.SendResponse
+	if err := c.post(ctx, "/publish", in, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PublishTopic sends a notification to every device subscribed to a topic.
+func (c *Client) PublishTopic(ctx context.Context, in api.BroadCastInput) (*api.SendResponse, error) {
+	var out api.SendResponse
+	if err := c.post(ctx, "/broadcast", in, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Send sends in to its single token, topic or condition. Set DryRun to have
+// FCM validate the message without delivering it.
+func (c *Client) Send(ctx context.Context, in api.SendInput) (*api.SendResponse, error) {
+	var out api.SendResponse
+	if err := c.post(ctx, "/send", in, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Multicast sends in to each of tokens. Per-token failures are reported in
+// the response, not as an error.
+func (c *Client) Multicast(ctx context.Context, tokens []string, in api.SendInput) (*api.MulticastResponse, error) {
+	in.Token, in.Tokens, in.Topic, in.Condition = "", tokens, "", ""
+	var out api.MulticastResponse
+	if err := c.post(ctx, "/send", in, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Subscribe adds tokens to a topic.
+func (c *Client) Subscribe(ctx context.Context, in api.SubscribeInput) (*api.SubscribeResponse, error) {
+	var out api.SubscribeResponse
+	if err := c.post(ctx, "/subscribe", in, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Unsubscribe removes tokens from a topic.
+func (c *Client) Unsubscribe(ctx context.Context, in api.SubscribeInput) (*api.SubscribeResponse, error) {
+	var out api.SubscribeResponse
+	if err := c.post(ctx, "/unsubscribe", in, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Ready checks /readyz and returns an *Error when the relay is not ready.
+func (c *Client) Ready(ctx context.Context) error {
+	var out map[string]any
+	return c.do(ctx, http.MethodGet, "/readyz", nil, &out)
+}
+
+func (c *Client) post(ctx context.Context, path string, in, out any) error {
+	return c.do(ctx, http.MethodPost, path, in, out)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		raw, err := json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("encoding request: %w", err)
+		}
+		body = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("reading response: %w", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var e api.ErrorResponse
+		if json.Unmarshal(raw, &e) != nil || e.Error == "" {
+			e.Error = strings.TrimSpace(string(raw))
+		}
+		return &Error{
+			Status:     resp.StatusCode,
+			Code:       e.Code,
+			Message:    e.Error,
+			Fields:     e.Fields,
+			Details:    e.Details,
+			RetryAfter: resp.Header.Get("Retry-After"),
+		}
+	}
+	// Some endpoints answer with no body at all.
+	if len(raw) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(raw, out); err != nil {
+		return fmt.Errorf("decoding response: %w", err)
+	}
+	return nil
+}
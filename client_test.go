@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/baakel/go_fcm/api"
+	"github.com/baakel/go_fcm/client"
+)
+
+// The client is tested against the real router so the two cannot drift.
+
+func TestClientPublishToken(t *testing.T) {
+	srv, _ := newTestServer(t, &fakeMessenger{})
+	c := client.New(srv.URL, testAPIKey)
+
+	resp, err := c.PublishToken(context.Background(), api.PublishInput{
+		Token:        testToken(1),
+		Notification: api.Notification{Title: "Hi"},
+		ClientRef:    "ref-1",
+		PlatformInput: api.PlatformInput{
+			FCMOptions: &api.FCMOptionsInput{AnalyticsLabel: "welcome"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.MessageID == "" || resp.ClientRef != "ref-1" || resp.AnalyticsLabel != "welcome" {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	if resp.Queued || resp.SendAt != nil {
+		t.Fatalf("response of a sent message claims it was queued: %+v", resp)
+	}
+}
+
+func TestClientPublishTopic(t *testing.T) {
+	fake := &fakeMessenger{}
+	srv, _ := newTestServer(t, fake)
+	c := client.New(srv.URL, testAPIKey)
+
+	resp, err := c.PublishTopic(context.Background(), api.BroadCastInput{Topic: "news", Notification: api.Notification{Title: "Hi"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.MessageID == "" {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	if sent := fake.messages(); len(sent) != 1 || sent[0].Topic != "news" {
+		t.Fatalf("FCM got %+v, want one message to topic news", sent)
+	}
+}
+
+func TestClientSendDryRun(t *testing.T) {
+	srv, _ := newTestServer(t, &fakeMessenger{})
+	c := client.New(srv.URL, testAPIKey)
+
+	resp, err := c.Send(context.Background(), api.SendInput{Topic: "news", DryRun: true, ClientRef: "ref-2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.DryRun || resp.MessageID == "" || resp.ClientRef != "ref-2" {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+}
+
+func TestClientMulticast(t *testing.T) {
+	fake := &fakeMessenger{failTokens: map[string]error{testToken(2): errors.New("boom")}}
+	srv, _ := newTestServer(t, fake)
+	c := client.New(srv.URL, testAPIKey)
+
+	resp, err := c.Multicast(context.Background(), []string{testToken(1), testToken(2), testToken(3)}, api.SendInput{
+		Notification: api.Notification{Title: "Hi"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.SuccessCount != 2 || resp.FailureCount != 1 || len(resp.Failures) != 1 || resp.Failures[0].Index != 1 {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+}
+
+func TestClientSubscribe(t *testing.T) {
+	fake := &fakeMessenger{topicFailures: map[string]string{testToken(2): "INVALID_ARGUMENT"}}
+	srv, _ := newTestServer(t, fake)
+	c := client.New(srv.URL, testAPIKey)
+
+	resp, err := c.Subscribe(context.Background(), api.SubscribeInput{Tokens: []string{testToken(1), testToken(1), testToken(2)}, Topic: "news"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Topic != "news" || resp.DuplicatesRemoved != 1 || resp.SuccessCount != 1 || resp.FailureCount != 1 {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+}
+
+func TestClientValidationError(t *testing.T) {
+	srv, _ := newTestServer(t, &fakeMessenger{})
+	c := client.New(srv.URL, testAPIKey)
+
+	_, err := c.PublishToken(context.Background(), api.PublishInput{Token: "short"})
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("got %v, want a *client.Error", err)
+	}
+	if apiErr.Status != http.StatusUnprocessableEntity || len(apiErr.Fields) != 1 || apiErr.Fields[0].Field != "to" || apiErr.Fields[0].Rule != "fcmtoken" {
+		t.Fatalf("unexpected error %+v", apiErr)
+	}
+}
+
+func TestClientUnauthenticated(t *testing.T) {
+	srv, _ := newTestServer(t, &fakeMessenger{})
+	c := client.New(srv.URL, "wrong-key")
+
+	_, err := c.PublishToken(context.Background(), api.PublishInput{Token: testToken(1)})
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusUnauthorized {
+		t.Fatalf("got %v, want a 401 *client.Error", err)
+	}
+}
@@ -0,0 +1,1126 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const redacted = "[redacted]"
+
+type Config struct {
+	ListenAddr      string          `yaml:"listen_addr"`
+	AdminListenAddr string          `yaml:"admin_listen_addr"`
+	SocketMode      string          `yaml:"socket_mode"`
+	Timeouts        TimeoutConfig   `yaml:"timeouts"`
+	Log             LogConfig       `yaml:"log"`
+	Auth            AuthConfig      `yaml:"auth"`
+	Firebase        FirebaseConfig  `yaml:"firebase"`
+	RateLimit       RateLimitConfig `yaml:"rate_limit"`
+	CORS            CORSConfig      `yaml:"cors"`
+	AllowCIDRs      []string        `yaml:"allow_cidrs"`
+	// TrustedProxies are the addresses or CIDRs of the reverse proxies whose
+	// X-Forwarded-For is believed. Empty trusts none, and the client address
+	// is the peer's.
+	TrustedProxies []string             `yaml:"trusted_proxies"`
+	Reporting      ReportingConfig      `yaml:"reporting"`
+	Audit          AuditConfig          `yaml:"audit"`
+	Alerting       AlertingConfig       `yaml:"alerting"`
+	Defaults       DefaultsConfig       `yaml:"defaults"`
+	Webhooks       WebhooksConfig       `yaml:"webhooks"`
+	DeadLetter     DeadLetterConfig     `yaml:"dead_letter"`
+	Topics         TopicsConfig         `yaml:"topics"`
+	Debug          DebugConfig          `yaml:"debug"`
+	Compression    CompressionConfig    `yaml:"compression"`
+	HTTP2          HTTP2Config          `yaml:"http2"`
+	TLS            TLSConfig            `yaml:"tls"`
+	Concurrency    ConcurrencyConfig    `yaml:"concurrency"`
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit_breaker"`
+	Tokens         TokensConfig         `yaml:"tokens"`
+	DeviceLimit    DeviceLimitConfig    `yaml:"device_limit"`
+	Dedup          DedupConfig          `yaml:"dedup"`
+	Fanout         FanoutConfig         `yaml:"fanout"`
+	QuietHours     QuietHoursConfig     `yaml:"quiet_hours"`
+	Retry          RetryConfig          `yaml:"retry"`
+	QuotaQueue     QuotaQueueConfig     `yaml:"quota_queue"`
+	Templates      TemplatesConfig      `yaml:"templates"`
+	Store          StoreConfig          `yaml:"store"`
+	Features       map[string]bool      `yaml:"features"`
+}
+
+type TimeoutConfig struct {
+	Read     time.Duration `yaml:"read"`
+	Write    time.Duration `yaml:"write"`
+	Idle     time.Duration `yaml:"idle"`
+	Shutdown time.Duration `yaml:"shutdown"`
+	FCM      time.Duration `yaml:"fcm"`
+}
+
+type LogConfig struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
+	// File, when set, sends the log there instead of stdout (or in addition
+	// to it when Tee is set), rotating per the Max* settings.
+	File       string `yaml:"file"`
+	MaxSizeMB  int    `yaml:"max_size_mb"`
+	MaxBackups int    `yaml:"max_backups"`
+	MaxAgeDays int    `yaml:"max_age_days"`
+	Tee        bool   `yaml:"tee"`
+	// Payloads logs notification titles and bodies. Off by default as they
+	// may carry personal data.
+	Payloads bool `yaml:"payloads"`
+}
+
+type AuthConfig struct {
+	APIKey string `yaml:"api_key"`
+	// APIKeyFile holds the API key instead of api_key, for secrets mounted
+	// as files. It is re-read on every reload.
+	APIKeyFile string     `yaml:"api_key_file"`
+	KeysFile   string     `yaml:"keys_file"`
+	Keys       []APIKey   `yaml:"keys"`
+	HMAC       HMACConfig `yaml:"hmac"`
+	// Backend checks bearer tokens: "static" for the keys above,
+	// "introspection" to ask an OAuth2 server, "jwt" to verify them as signed
+	// JWTs. HMAC signatures always use the static keys.
+	Backend       string              `yaml:"backend"`
+	Introspection IntrospectionConfig `yaml:"introspection"`
+	JWT           JWTConfig           `yaml:"jwt"`
+}
+
+// JWTConfig verifies bearer tokens as JWTs, against either a PEM public key
+// or the keys published at a JWKS URL.
+type JWTConfig struct {
+	PublicKeyFile string `yaml:"public_key_file"`
+	JWKSURL       string `yaml:"jwks_url"`
+	// JWKSRefresh is how often the JWKS is fetched again; keys with an
+	// unknown kid trigger a fetch too.
+	JWKSRefresh time.Duration `yaml:"jwks_refresh"`
+	Issuer      string        `yaml:"issuer"`
+	Audience    string        `yaml:"audience"`
+	TenantClaim string        `yaml:"tenant_claim"`
+	// ProjectsClaim names the claim listing the Firebase projects the token
+	// may target. Tokens without any are refused.
+	ProjectsClaim string `yaml:"projects_claim"`
+	// FallbackStatic checks bearer tokens that are not JWTs against the
+	// static keys, for clients not yet moved to the identity provider.
+	FallbackStatic bool `yaml:"fallback_static"`
+}
+
+// IntrospectionConfig points at an RFC 7662 token introspection endpoint.
+type IntrospectionConfig struct {
+	URL          string `yaml:"url"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	// TenantClaim names the claim of the introspection answer used as the
+	// tenant.
+	TenantClaim string `yaml:"tenant_claim"`
+	// ProjectsClaim names the claim listing the Firebase projects the token
+	// may target. Tokens without any are refused.
+	ProjectsClaim string        `yaml:"projects_claim"`
+	Timeout       time.Duration `yaml:"timeout"`
+	// CacheTTL bounds how long an answer is reused, and so how long a
+	// revoked token keeps working.
+	CacheTTL  time.Duration `yaml:"cache_ttl"`
+	CacheSize int           `yaml:"cache_size"`
+}
+
+// HMACConfig enables signed requests as an alternative to bearer keys.
+type HMACConfig struct {
+	Enabled        bool          `yaml:"enabled"`
+	MaxSkew        time.Duration `yaml:"max_skew"`
+	NonceCacheSize int           `yaml:"nonce_cache_size"`
+	// MaxBodyBytes caps the body read to check a signature.
+	MaxBodyBytes int `yaml:"max_body_bytes"`
+}
+
+type FirebaseConfig struct {
+	Projects []FirebaseProject `yaml:"projects"`
+	// EmulatorHost points every messaging client at a local emulator
+	// (host:port) instead of production FCM.
+	EmulatorHost string `yaml:"emulator_host"`
+	// EndpointOverride is the full FCM base URL to use instead of production,
+	// e.g. a stub server in CI. Like EmulatorHost it disables authentication,
+	// and it wins when both are set.
+	EndpointOverride string `yaml:"endpoint_override"`
+	// ReinitCooldown is the least time between two rebuilds of a project's
+	// messaging client after FCM rejected its credentials.
+	ReinitCooldown time.Duration `yaml:"reinit_cooldown"`
+}
+
+type FirebaseProject struct {
+	ID              string `yaml:"id"`
+	CredentialsFile string `yaml:"credentials_file"`
+}
+
+type RateLimitConfig struct {
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	Burst             int     `yaml:"burst"`
+}
+
+type CORSConfig struct {
+	AllowedOrigins []string `yaml:"allowed_origins"`
+}
+
+// ReportingConfig selects where handler errors and panics are reported. The
+// Sentry DSN wins when both are set.
+type ReportingConfig struct {
+	SentryDSN  string `yaml:"sentry_dsn"`
+	WebhookURL string `yaml:"webhook_url"`
+}
+
+type AuditConfig struct {
+	// File receives the send audit log, stdout when empty.
+	File string `yaml:"file"`
+}
+
+// AlertingConfig controls the FCM failure rate alert webhook, disabled while
+// WebhookURL is empty.
+type AlertingConfig struct {
+	WebhookURL  string        `yaml:"webhook_url"`
+	Slack       bool          `yaml:"slack"`
+	ServiceName string        `yaml:"service_name"`
+	Threshold   float64       `yaml:"threshold"`
+	Window      time.Duration `yaml:"window"`
+	MinSamples  int           `yaml:"min_samples"`
+	Cooldown    time.Duration `yaml:"cooldown"`
+}
+
+// DefaultsConfig holds values applied to messages that don't set their own.
+type DefaultsConfig struct {
+	TTL time.Duration `yaml:"ttl"`
+	// TopicPriority maps a topic to the Android priority its broadcasts get
+	// when the request doesn't set one. Other topics use "normal".
+	TopicPriority map[string]string `yaml:"topic_priority"`
+	// AndroidChannel, Icon, Color and Sound go into every message whose
+	// request doesn't set them. Sound applies to both platforms.
+	AndroidChannel string `yaml:"android_channel"`
+	Icon           string `yaml:"icon"`
+	Color          string `yaml:"color"`
+	Sound          string `yaml:"sound"`
+}
+
+func (d DefaultsConfig) topicPriority(topic string) string {
+	if p, ok := d.TopicPriority[topic]; ok {
+		return p
+	}
+	return "normal"
+}
+
+// FanoutConfig shapes multicast sends: up to MaxTokens per request, sent in
+// chunks of ChunkSize with Workers chunks in flight at once.
+type FanoutConfig struct {
+	Workers   int `yaml:"workers"`
+	ChunkSize int `yaml:"chunk_size"`
+	MaxTokens int `yaml:"max_tokens"`
+}
+
+// DedupConfig drops sends identical to one made within Window, answering
+// with the original message ID. Zero Window disables it.
+type DedupConfig struct {
+	Window    time.Duration `yaml:"window"`
+	CacheSize int           `yaml:"cache_size"`
+}
+
+// DeviceLimitConfig caps the messages a single device token gets per Window.
+// Sends over the cap are rejected with 429, or in "collapse" mode sent with a
+// shared collapse key so they replace each other on the device. Topic sends
+// are exempt. Zero Messages disables the limit.
+type DeviceLimitConfig struct {
+	Messages  int           `yaml:"messages"`
+	Window    time.Duration `yaml:"window"`
+	Mode      string        `yaml:"mode"`
+	CacheSize int           `yaml:"cache_size"`
+}
+
+// QuietHoursConfig sets daily windows, as "22:00-07:00" in Timezone, during
+// which notifications are stripped and only silent data pushes go out.
+// Topics override the global Window per topic; "off" exempts a topic.
+type QuietHoursConfig struct {
+	Window   string            `yaml:"window"`
+	Timezone string            `yaml:"timezone"`
+	Topics   map[string]string `yaml:"topics"`
+}
+
+type TokensConfig struct {
+	// StripPattern is a regular expression removed from every device token
+	// before sending, e.g. "^(android|ios):" for prefixed upstream tokens.
+	StripPattern string `yaml:"strip_pattern"`
+}
+
+// ConcurrencyConfig bounds the FCM calls in flight at once. A request that
+// can't get a slot within MaxWait fails with 503. Zero MaxInFlight disables
+// the limit.
+type ConcurrencyConfig struct {
+	MaxInFlight int           `yaml:"max_in_flight"`
+	MaxWait     time.Duration `yaml:"max_wait"`
+}
+
+// CircuitBreakerConfig stops FCM calls for Cooldown whenever the upstream
+// health /readyz reports turns degraded.
+type CircuitBreakerConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Cooldown time.Duration `yaml:"cooldown"`
+}
+
+// RetryPolicy is an exponential backoff: InitialInterval after the first
+// failure, doubling up to MaxInterval, each delay moved by up to Jitter (a
+// fraction) either way. MaxAttempts counts the first try; MaxElapsed, when
+// set, bounds the time from the first try to the start of the last.
+type RetryPolicy struct {
+	MaxAttempts     int           `yaml:"max_attempts"`
+	InitialInterval time.Duration `yaml:"initial_interval"`
+	MaxInterval     time.Duration `yaml:"max_interval"`
+	MaxElapsed      time.Duration `yaml:"max_elapsed"`
+	Jitter          float64       `yaml:"jitter"`
+}
+
+// RetryConfig is the retry policy of FCM calls that failed with a transient
+// error and of webhook deliveries. Each kind of call may override any field;
+// zero fields inherit the shared policy.
+type RetryConfig struct {
+	RetryPolicy `yaml:",inline"`
+	Send        RetryPolicy `yaml:"send"`
+	Multicast   RetryPolicy `yaml:"multicast"`
+	Topics      RetryPolicy `yaml:"topics"`
+	Webhooks    RetryPolicy `yaml:"webhooks"`
+}
+
+// policy fills the zero fields of override from the shared policy.
+func (c RetryConfig) policy(override RetryPolicy) RetryPolicy {
+	p := override
+	p.MaxAttempts = cmp.Or(p.MaxAttempts, c.MaxAttempts)
+	p.InitialInterval = cmp.Or(p.InitialInterval, c.InitialInterval)
+	p.MaxInterval = cmp.Or(p.MaxInterval, c.MaxInterval)
+	p.MaxElapsed = cmp.Or(p.MaxElapsed, c.MaxElapsed)
+	p.Jitter = cmp.Or(p.Jitter, c.Jitter)
+	return p
+}
+
+// QuotaQueueConfig parks sends FCM refused for quota until the Retry-After
+// delay it gave, DefaultDelay when it gave none, and answers them with 202.
+// At most Size messages wait; the oldest spill to the dead letter sink.
+type QuotaQueueConfig struct {
+	Enabled      bool          `yaml:"enabled"`
+	Size         int           `yaml:"size"`
+	DefaultDelay time.Duration `yaml:"default_delay"`
+}
+
+// StoreConfig moves the dedup window, device limit and rate limit state to
+// Redis so replicas share it. OnError picks what a feature does while Redis
+// is unreachable: "memory" falls back to the replica's own state, "open"
+// lets every request through.
+type StoreConfig struct {
+	RedisURL string        `yaml:"redis_url"`
+	OnError  string        `yaml:"on_error"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+// HTTP2Config enables cleartext HTTP/2 (h2c) on the listeners, for clients
+// that speak it with prior knowledge or upgrade to it. The stream limits
+// also apply to HTTP/2 over TLS.
+type HTTP2Config struct {
+	H2C                  bool          `yaml:"h2c"`
+	MaxConcurrentStreams int           `yaml:"max_concurrent_streams"`
+	IdleTimeout          time.Duration `yaml:"idle_timeout"`
+}
+
+// TLSConfig serves HTTPS on every listener when both files are set. HTTP/2
+// is negotiated over TLS with ALPN, next to HTTP/1.1.
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+func (t TLSConfig) enabled() bool {
+	return t.CertFile != ""
+}
+
+// CompressionConfig enables gzip for responses of at least MinSize bytes.
+type CompressionConfig struct {
+	Gzip    bool `yaml:"gzip"`
+	MinSize int  `yaml:"min_size"`
+}
+
+type DebugConfig struct {
+	// Token is the device POST /test sends its canned notification to.
+	Token string `yaml:"token"`
+}
+
+type TopicsConfig struct {
+	// MaxTokens caps the tokens in one subscribe or unsubscribe request. They
+	// are sent to FCM in chunks of maxTopicBatch.
+	MaxTokens int `yaml:"max_tokens"`
+	// ImportRate paces POST /subscribe/import, in FCM calls per second
+	// shared by all imports. Zero leaves them unpaced.
+	ImportRate float64 `yaml:"import_rate"`
+	// DefaultsFile persists the per-topic defaults set with PUT
+	// /topics/{topic}/defaults, in memory only when empty.
+	DefaultsFile string `yaml:"defaults_file"`
+}
+
+type DeadLetterConfig struct {
+	// File receives every failed message as a JSON line, disabled when empty.
+	File string `yaml:"file"`
+}
+
+type TemplatesConfig struct {
+	// File persists the named templates, in memory only when empty.
+	File string `yaml:"file"`
+}
+
+// WebhooksConfig controls the registered result webhooks.
+type WebhooksConfig struct {
+	// File persists registrations across restarts, in memory only when empty.
+	File string `yaml:"file"`
+	// DisableAfter disables a webhook whose deliveries have failed for this
+	// long without a single success. Zero never disables.
+	DisableAfter time.Duration `yaml:"disable_after"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		ListenAddr: "0.0.0.0:42069",
+		SocketMode: "0660",
+		QuietHours: QuietHoursConfig{Timezone: "UTC"},
+		Timeouts: TimeoutConfig{
+			Read:     15 * time.Second,
+			Write:    30 * time.Second,
+			Idle:     60 * time.Second,
+			Shutdown: 10 * time.Second,
+			FCM:      10 * time.Second,
+		},
+		Firebase: FirebaseConfig{
+			ReinitCooldown: 5 * time.Minute,
+		},
+		Auth: AuthConfig{
+			HMAC: HMACConfig{
+				MaxSkew:        5 * time.Minute,
+				NonceCacheSize: 100000,
+				MaxBodyBytes:   1 << 20,
+			},
+			Backend: "static",
+			Introspection: IntrospectionConfig{
+				TenantClaim:   "client_id",
+				ProjectsClaim: "fcm_projects",
+				Timeout:       5 * time.Second,
+				CacheTTL:      time.Minute,
+				CacheSize:     10000,
+			},
+			JWT: JWTConfig{
+				JWKSRefresh:   time.Hour,
+				TenantClaim:   "sub",
+				ProjectsClaim: "fcm_projects",
+			},
+		},
+		Log: LogConfig{
+			Level:      "info",
+			Format:     "text",
+			MaxSizeMB:  100,
+			MaxBackups: 5,
+			MaxAgeDays: 28,
+		},
+		Alerting: AlertingConfig{
+			ServiceName: "fcmrelay",
+			Threshold:   0.5,
+			Window:      5 * time.Minute,
+			MinSamples:  20,
+			Cooldown:    15 * time.Minute,
+		},
+		Fanout: FanoutConfig{
+			Workers:   4,
+			ChunkSize: maxMulticastTokens,
+			MaxTokens: 10000,
+		},
+		Dedup: DedupConfig{
+			CacheSize: 100000,
+		},
+		DeviceLimit: DeviceLimitConfig{
+			Window:    time.Minute,
+			Mode:      "reject",
+			CacheSize: 100000,
+		},
+		Concurrency: ConcurrencyConfig{
+			MaxInFlight: 200,
+			MaxWait:     500 * time.Millisecond,
+		},
+		CircuitBreaker: CircuitBreakerConfig{
+			Enabled:  true,
+			Cooldown: 30 * time.Second,
+		},
+		QuotaQueue: QuotaQueueConfig{
+			Size:         10000,
+			DefaultDelay: time.Minute,
+		},
+		Store: StoreConfig{
+			OnError: "memory",
+			Timeout: 500 * time.Millisecond,
+		},
+		// The SDK already retries FCM calls itself, so ours are off unless
+		// configured. Webhook deliveries keep their six attempts.
+		Retry: RetryConfig{
+			RetryPolicy: RetryPolicy{
+				MaxAttempts:     1,
+				InitialInterval: 500 * time.Millisecond,
+				MaxInterval:     30 * time.Second,
+				Jitter:          0.2,
+			},
+			Webhooks: RetryPolicy{MaxAttempts: 6, InitialInterval: time.Second},
+		},
+		HTTP2: HTTP2Config{
+			MaxConcurrentStreams: 250,
+		},
+		Compression: CompressionConfig{
+			MinSize: 1024,
+		},
+		Topics: TopicsConfig{
+			MaxTokens:  100000,
+			ImportRate: 10,
+		},
+		Webhooks: WebhooksConfig{
+			DisableAfter: 24 * time.Hour,
+		},
+		Features: map[string]bool{},
+	}
+}
+
+// LoadConfig builds the effective configuration: defaults, overridden by the
+// YAML file at path (if any), overridden by environment variables.
+func LoadConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+
+	if path != "" {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading config file: %w", err)
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(raw))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("parsing config file %s: %w", path, err)
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) applyEnv() error {
+	setString(&c.ListenAddr, "LISTEN_ADDR")
+	setString(&c.AdminListenAddr, "ADMIN_LISTEN_ADDR")
+	setString(&c.SocketMode, "LISTEN_SOCKET_MODE")
+	setString(&c.Log.Level, "LOG_LEVEL")
+	setString(&c.Log.Format, "LOG_FORMAT")
+	setString(&c.Log.File, "LOG_FILE")
+	setString(&c.Auth.APIKey, "API_KEY")
+	setString(&c.Auth.APIKeyFile, "API_KEY_FILE")
+	setString(&c.Auth.KeysFile, "API_KEYS_FILE")
+	setString(&c.Auth.Backend, "AUTH_BACKEND")
+	setString(&c.Auth.Introspection.URL, "INTROSPECTION_URL")
+	setString(&c.Auth.Introspection.ClientID, "INTROSPECTION_CLIENT_ID")
+	setString(&c.Auth.Introspection.ClientSecret, "INTROSPECTION_CLIENT_SECRET")
+	setString(&c.Auth.JWT.PublicKeyFile, "JWT_PUBLIC_KEY_FILE")
+	setString(&c.Auth.JWT.JWKSURL, "JWT_JWKS_URL")
+	setString(&c.Auth.JWT.Issuer, "JWT_ISSUER")
+	setString(&c.Auth.JWT.Audience, "JWT_AUDIENCE")
+	setString(&c.Firebase.EmulatorHost, "FIREBASE_MESSAGING_EMULATOR_HOST")
+	setString(&c.Firebase.EndpointOverride, "FCM_ENDPOINT_OVERRIDE")
+	setString(&c.Reporting.SentryDSN, "SENTRY_DSN")
+	setString(&c.Reporting.WebhookURL, "ERROR_WEBHOOK_URL")
+	setString(&c.Audit.File, "AUDIT_LOG_FILE")
+	setString(&c.Alerting.WebhookURL, "ALERT_WEBHOOK_URL")
+	setString(&c.Alerting.ServiceName, "SERVICE_NAME")
+	setString(&c.Webhooks.File, "WEBHOOKS_FILE")
+	setString(&c.Templates.File, "TEMPLATES_FILE")
+	setString(&c.Topics.DefaultsFile, "TOPIC_DEFAULTS_FILE")
+	setString(&c.DeadLetter.File, "DEAD_LETTER_FILE")
+	setString(&c.Debug.Token, "DEBUG_TOKEN")
+	setString(&c.Tokens.StripPattern, "TOKEN_STRIP_PATTERN")
+	setString(&c.DeviceLimit.Mode, "DEVICE_LIMIT_MODE")
+	setString(&c.Defaults.AndroidChannel, "DEFAULT_ANDROID_CHANNEL")
+	setString(&c.Defaults.Icon, "DEFAULT_ICON")
+	setString(&c.Defaults.Color, "DEFAULT_COLOR")
+	setString(&c.Defaults.Sound, "DEFAULT_SOUND")
+	setString(&c.QuietHours.Window, "QUIET_HOURS")
+	setString(&c.QuietHours.Timezone, "QUIET_HOURS_TIMEZONE")
+	setString(&c.Store.RedisURL, "REDIS_URL")
+	setString(&c.Store.OnError, "STORE_ON_ERROR")
+	setString(&c.TLS.CertFile, "TLS_CERT_FILE")
+	setString(&c.TLS.KeyFile, "TLS_KEY_FILE")
+
+	durations := map[string]*time.Duration{
+		"READ_TIMEOUT":              &c.Timeouts.Read,
+		"WRITE_TIMEOUT":             &c.Timeouts.Write,
+		"IDLE_TIMEOUT":              &c.Timeouts.Idle,
+		"SHUTDOWN_TIMEOUT":          &c.Timeouts.Shutdown,
+		"FCM_TIMEOUT":               &c.Timeouts.FCM,
+		"ALERT_WINDOW":              &c.Alerting.Window,
+		"ALERT_COOLDOWN":            &c.Alerting.Cooldown,
+		"HMAC_MAX_SKEW":             &c.Auth.HMAC.MaxSkew,
+		"INTROSPECTION_TIMEOUT":     &c.Auth.Introspection.Timeout,
+		"INTROSPECTION_CACHE_TTL":   &c.Auth.Introspection.CacheTTL,
+		"JWT_JWKS_REFRESH":          &c.Auth.JWT.JWKSRefresh,
+		"HTTP2_IDLE_TIMEOUT":        &c.HTTP2.IdleTimeout,
+		"FCM_MAX_WAIT":              &c.Concurrency.MaxWait,
+		"FCM_BREAKER_COOLDOWN":      &c.CircuitBreaker.Cooldown,
+		"DEVICE_LIMIT_WINDOW":       &c.DeviceLimit.Window,
+		"DEDUP_WINDOW":              &c.Dedup.Window,
+		"WEBHOOK_DISABLE_AFTER":     &c.Webhooks.DisableAfter,
+		"FIREBASE_REINIT_COOLDOWN":  &c.Firebase.ReinitCooldown,
+		"DEFAULT_TTL":               &c.Defaults.TTL,
+		"RETRY_INITIAL_INTERVAL":    &c.Retry.InitialInterval,
+		"RETRY_MAX_INTERVAL":        &c.Retry.MaxInterval,
+		"RETRY_MAX_ELAPSED":         &c.Retry.MaxElapsed,
+		"QUOTA_QUEUE_DEFAULT_DELAY": &c.QuotaQueue.DefaultDelay,
+		"STORE_TIMEOUT":             &c.Store.Timeout,
+	}
+	for key, dst := range durations {
+		if err := setDuration(dst, key); err != nil {
+			return err
+		}
+	}
+
+	ints := map[string]*int{
+		"LOG_MAX_SIZE_MB":              &c.Log.MaxSizeMB,
+		"LOG_MAX_BACKUPS":              &c.Log.MaxBackups,
+		"LOG_MAX_AGE_DAYS":             &c.Log.MaxAgeDays,
+		"RATE_LIMIT_BURST":             &c.RateLimit.Burst,
+		"ALERT_MIN_SAMPLES":            &c.Alerting.MinSamples,
+		"HMAC_NONCE_CACHE_SIZE":        &c.Auth.HMAC.NonceCacheSize,
+		"HMAC_MAX_BODY_BYTES":          &c.Auth.HMAC.MaxBodyBytes,
+		"TOPIC_MAX_TOKENS":             &c.Topics.MaxTokens,
+		"GZIP_MIN_SIZE":                &c.Compression.MinSize,
+		"HTTP2_MAX_CONCURRENT_STREAMS": &c.HTTP2.MaxConcurrentStreams,
+		"FCM_MAX_IN_FLIGHT":            &c.Concurrency.MaxInFlight,
+		"DEVICE_LIMIT_MESSAGES":        &c.DeviceLimit.Messages,
+		"DEVICE_LIMIT_CACHE_SIZE":      &c.DeviceLimit.CacheSize,
+		"DEDUP_CACHE_SIZE":             &c.Dedup.CacheSize,
+		"FANOUT_WORKERS":               &c.Fanout.Workers,
+		"FANOUT_CHUNK_SIZE":            &c.Fanout.ChunkSize,
+		"FANOUT_MAX_TOKENS":            &c.Fanout.MaxTokens,
+		"RETRY_MAX_ATTEMPTS":           &c.Retry.MaxAttempts,
+		"QUOTA_QUEUE_SIZE":             &c.QuotaQueue.Size,
+	}
+	for key, dst := range ints {
+		if err := setInt(dst, key); err != nil {
+			return err
+		}
+	}
+	if v, ok := os.LookupEnv("DEFAULT_TTL_SECONDS"); ok {
+		secs, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid DEFAULT_TTL_SECONDS %q: %w", v, err)
+		}
+		c.Defaults.TTL = time.Duration(secs) * time.Second
+	}
+	// TOPIC_PRIORITIES is a comma separated list of topic=priority pairs.
+	if v, ok := os.LookupEnv("TOPIC_PRIORITIES"); ok {
+		c.Defaults.TopicPriority = map[string]string{}
+		for _, pair := range strings.Split(v, ",") {
+			if pair = strings.TrimSpace(pair); pair == "" {
+				continue
+			}
+			topic, priority, found := strings.Cut(pair, "=")
+			if !found {
+				return fmt.Errorf("invalid TOPIC_PRIORITIES entry %q, expected topic=priority", pair)
+			}
+			c.Defaults.TopicPriority[strings.TrimSpace(topic)] = strings.TrimSpace(priority)
+		}
+	}
+
+	bools := map[string]*bool{
+		"LOG_TEE":             &c.Log.Tee,
+		"LOG_PAYLOADS":        &c.Log.Payloads,
+		"ALERT_SLACK":         &c.Alerting.Slack,
+		"HMAC_AUTH":           &c.Auth.HMAC.Enabled,
+		"FCM_BREAKER":         &c.CircuitBreaker.Enabled,
+		"JWT_FALLBACK_STATIC": &c.Auth.JWT.FallbackStatic,
+		"GZIP":                &c.Compression.Gzip,
+		"ENABLE_H2C":          &c.HTTP2.H2C,
+		"QUOTA_QUEUE":         &c.QuotaQueue.Enabled,
+	}
+	for key, dst := range bools {
+		if err := setBool(dst, key); err != nil {
+			return err
+		}
+	}
+	floats := map[string]*float64{
+		"RATE_LIMIT_RPS":    &c.RateLimit.RequestsPerSecond,
+		"ALERT_THRESHOLD":   &c.Alerting.Threshold,
+		"RETRY_JITTER":      &c.Retry.Jitter,
+		"TOPIC_IMPORT_RATE": &c.Topics.ImportRate,
+	}
+	for key, dst := range floats {
+		if err := setFloat(dst, key); err != nil {
+			return err
+		}
+	}
+
+	setList(&c.CORS.AllowedOrigins, "CORS_ALLOWED_ORIGINS")
+	setList(&c.AllowCIDRs, "ALLOW_CIDRS")
+	setList(&c.TrustedProxies, "TRUSTED_PROXIES")
+
+	// GOOGLE_APPLICATION_CREDENTIALS overrides the credentials of the default
+	// (first) project, or defines it when the file lists none.
+	if v, ok := os.LookupEnv("GOOGLE_APPLICATION_CREDENTIALS"); ok && v != "" {
+		if len(c.Firebase.Projects) == 0 {
+			c.Firebase.Projects = []FirebaseProject{{}}
+		}
+		c.Firebase.Projects[0].CredentialsFile = v
+	}
+
+	// FEATURES is a comma separated list of flags, "-name" disables one.
+	if v, ok := os.LookupEnv("FEATURES"); ok {
+		if c.Features == nil {
+			c.Features = map[string]bool{}
+		}
+		for _, f := range strings.Split(v, ",") {
+			f = strings.TrimSpace(f)
+			if f == "" {
+				continue
+			}
+			name, disabled := strings.CutPrefix(f, "-")
+			c.Features[name] = !disabled
+		}
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	if c.ListenAddr == "" {
+		return errors.New("listen_addr must not be empty")
+	}
+	if c.AdminListenAddr == c.ListenAddr {
+		return errors.New("admin_listen_addr must differ from listen_addr")
+	}
+	if _, err := strconv.ParseUint(c.SocketMode, 8, 32); err != nil {
+		return fmt.Errorf("socket_mode %q is not an octal file mode", c.SocketMode)
+	}
+	switch c.Log.Format {
+	case "text", "json", "logfmt":
+	default:
+		return fmt.Errorf("unknown log format %q", c.Log.Format)
+	}
+	if c.Log.MaxSizeMB < 0 || c.Log.MaxBackups < 0 || c.Log.MaxAgeDays < 0 {
+		return errors.New("log rotation values must not be negative")
+	}
+	if c.RateLimit.RequestsPerSecond < 0 || c.RateLimit.Burst < 0 {
+		return errors.New("rate_limit values must not be negative")
+	}
+	if c.Alerting.WebhookURL != "" {
+		if c.Alerting.Threshold <= 0 || c.Alerting.Threshold > 1 {
+			return errors.New("alerting.threshold must be in (0, 1]")
+		}
+		if c.Alerting.Window < alertBuckets*time.Second {
+			return fmt.Errorf("alerting.window must be at least %ds", alertBuckets)
+		}
+	}
+	if c.Auth.HMAC.Enabled && (c.Auth.HMAC.MaxSkew <= 0 || c.Auth.HMAC.NonceCacheSize <= 0 || c.Auth.HMAC.MaxBodyBytes <= 0) {
+		return errors.New("auth.hmac needs a positive max_skew, nonce_cache_size and max_body_bytes")
+	}
+	switch c.Auth.Backend {
+	case "static":
+	case "introspection":
+		i := c.Auth.Introspection
+		if u, err := url.Parse(i.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("auth.introspection.url must be an absolute http(s) URL, got %q", i.URL)
+		}
+		if i.TenantClaim == "" || i.ProjectsClaim == "" || i.Timeout <= 0 {
+			return errors.New("auth.introspection needs a tenant_claim, a projects_claim and a positive timeout")
+		}
+		if i.CacheTTL <= 0 || i.CacheSize <= 0 {
+			return errors.New("auth.introspection needs a positive cache_ttl and cache_size")
+		}
+	case "jwt":
+		j := c.Auth.JWT
+		if (j.PublicKeyFile == "") == (j.JWKSURL == "") {
+			return errors.New("auth.jwt needs exactly one of public_key_file and jwks_url")
+		}
+		if u, err := url.Parse(j.JWKSURL); j.JWKSURL != "" && (err != nil || u.Scheme != "https" || u.Host == "") {
+			return fmt.Errorf("auth.jwt.jwks_url must be an absolute https URL, got %q", j.JWKSURL)
+		}
+		if j.Issuer == "" || j.Audience == "" || j.TenantClaim == "" || j.ProjectsClaim == "" {
+			return errors.New("auth.jwt needs an issuer, an audience, a tenant_claim and a projects_claim")
+		}
+		if j.JWKSURL != "" && j.JWKSRefresh <= 0 {
+			return errors.New("auth.jwt.jwks_refresh must be positive")
+		}
+	default:
+		return fmt.Errorf("auth.backend must be static, introspection or jwt, got %q", c.Auth.Backend)
+	}
+	if c.Defaults.TTL < 0 {
+		return errors.New("defaults.ttl must not be negative")
+	}
+	for topic, p := range c.Defaults.TopicPriority {
+		if err := validatePriority(p); err != nil {
+			return fmt.Errorf("defaults.topic_priority[%s]: %w", topic, err)
+		}
+	}
+	if err := validateColor(c.Defaults.Color); err != nil {
+		return fmt.Errorf("defaults.%w", err)
+	}
+	if _, err := newQuietHours(c.QuietHours); err != nil {
+		return err
+	}
+	if q := c.QuotaQueue; q.Enabled && (q.Size <= 0 || q.DefaultDelay <= 0) {
+		return errors.New("quota_queue needs a positive size and default_delay")
+	}
+	if s := c.Store; s.OnError != "memory" && s.OnError != "open" {
+		return fmt.Errorf("store.on_error must be \"memory\" or \"open\", got %q", s.OnError)
+	}
+	if c.Store.RedisURL != "" {
+		if c.Store.Timeout <= 0 {
+			return errors.New("store.timeout must be positive")
+		}
+		if _, err := newRedisStore(c.Store.RedisURL, c.Store.Timeout); err != nil {
+			return fmt.Errorf("store.redis_url: %w", err)
+		}
+	}
+	r := c.Retry
+	policies := map[string]RetryPolicy{
+		"retry":           r.RetryPolicy,
+		"retry.send":      r.policy(r.Send),
+		"retry.multicast": r.policy(r.Multicast),
+		"retry.topics":    r.policy(r.Topics),
+		"retry.webhooks":  r.policy(r.Webhooks),
+	}
+	for name, p := range policies {
+		if p.MaxAttempts < 1 {
+			return fmt.Errorf("%s.max_attempts must be at least 1", name)
+		}
+		if p.InitialInterval < 0 || p.MaxInterval < 0 || p.MaxElapsed < 0 {
+			return fmt.Errorf("%s intervals must not be negative", name)
+		}
+		if p.Jitter < 0 || p.Jitter > 1 {
+			return fmt.Errorf("%s.jitter must be between 0 and 1", name)
+		}
+	}
+	if f := c.Fanout; f.Workers <= 0 || f.MaxTokens <= 0 || f.ChunkSize <= 0 || f.ChunkSize > maxMulticastTokens {
+		return fmt.Errorf("fanout needs positive workers and max_tokens and a chunk_size of 1 to %d", maxMulticastTokens)
+	}
+	if c.Dedup.Window > 0 && c.Dedup.CacheSize <= 0 {
+		return errors.New("dedup.cache_size must be positive")
+	}
+	if d := c.DeviceLimit; d.Messages > 0 {
+		if d.Window <= 0 || d.CacheSize <= 0 {
+			return errors.New("device_limit needs a positive window and cache_size")
+		}
+		if d.Mode != "reject" && d.Mode != "collapse" {
+			return fmt.Errorf("device_limit.mode must be reject or collapse, got %q", d.Mode)
+		}
+	}
+	if _, err := regexp.Compile(c.Tokens.StripPattern); err != nil {
+		return fmt.Errorf("invalid tokens.strip_pattern: %w", err)
+	}
+	if c.Concurrency.MaxInFlight < 0 || c.Concurrency.MaxWait < 0 {
+		return errors.New("concurrency values must not be negative")
+	}
+	if c.CircuitBreaker.Enabled && c.CircuitBreaker.Cooldown <= 0 {
+		return errors.New("circuit_breaker.cooldown must be positive")
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return errors.New("tls needs both cert_file and key_file")
+	}
+	if c.TLS.enabled() && c.HTTP2.H2C {
+		return errors.New("http2.h2c is for cleartext listeners, TLS negotiates HTTP/2 itself")
+	}
+	if c.HTTP2.MaxConcurrentStreams < 0 || c.HTTP2.IdleTimeout < 0 {
+		return errors.New("http2 values must not be negative")
+	}
+	if c.Compression.MinSize < 0 {
+		return errors.New("compression.min_size must not be negative")
+	}
+	if c.Topics.MaxTokens <= 0 {
+		return errors.New("topics.max_tokens must be positive")
+	}
+	if c.Topics.ImportRate < 0 {
+		return errors.New("topics.import_rate must not be negative")
+	}
+	if e := c.Firebase.EndpointOverride; e != "" {
+		u, err := url.Parse(e)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("firebase.endpoint_override must be an absolute http(s) URL, got %q", e)
+		}
+	}
+	if c.Firebase.ReinitCooldown < 0 {
+		return errors.New("firebase.reinit_cooldown must not be negative")
+	}
+	if c.Webhooks.DisableAfter < 0 {
+		return errors.New("webhooks.disable_after must not be negative")
+	}
+	if _, err := parseCIDRs(c.AllowCIDRs); err != nil {
+		return err
+	}
+	for _, p := range c.TrustedProxies {
+		if _, _, err := net.ParseCIDR(p); err != nil && net.ParseIP(p) == nil {
+			return fmt.Errorf("trusted_proxies entry %q is neither an IP address nor a CIDR", p)
+		}
+	}
+	seen := map[string]bool{}
+	for _, p := range c.Firebase.Projects {
+		if seen[p.ID] {
+			return fmt.Errorf("firebase project %q listed twice", p.ID)
+		}
+		seen[p.ID] = true
+	}
+	for _, k := range c.Auth.Keys {
+		if k.Tenant == "" {
+			return errors.New("every auth.keys entry needs a tenant")
+		}
+		for _, p := range k.Projects {
+			if !seen[p] {
+				return fmt.Errorf("auth key for tenant %q allows unknown project %q", k.Tenant, p)
+			}
+		}
+		if k.Project != "" && (!seen[k.Project] || !k.allows(k.Project)) {
+			return fmt.Errorf("auth key for tenant %q defaults to project %q it may not target", k.Tenant, k.Project)
+		}
+	}
+	return nil
+}
+
+// envFirebaseConfig reads the FCM endpoint settings from the environment
+// alone, for the CLI commands that run without a config file.
+func envFirebaseConfig() FirebaseConfig {
+	return FirebaseConfig{
+		EmulatorHost:     os.Getenv("FIREBASE_MESSAGING_EMULATOR_HOST"),
+		EndpointOverride: os.Getenv("FCM_ENDPOINT_OVERRIDE"),
+	}
+}
+
+// endpoint is the FCM base URL to use instead of production, empty when
+// neither the emulator nor an override is configured.
+func (f FirebaseConfig) endpoint() string {
+	switch {
+	case f.EndpointOverride != "":
+		return strings.TrimSuffix(f.EndpointOverride, "/")
+	case f.EmulatorHost != "":
+		return fmt.Sprintf("http://%s/v1", f.EmulatorHost)
+	}
+	return ""
+}
+
+// socketMode is the validated SocketMode.
+func (c *Config) socketMode() fs.FileMode {
+	mode, _ := strconv.ParseUint(c.SocketMode, 8, 32)
+	return fs.FileMode(mode)
+}
+
+// Feature reports whether the named feature flag is enabled.
+func (c *Config) Feature(name string) bool {
+	return c.Features[name]
+}
+
+// APIKeys returns every accepted API key: API_KEY (or the contents of
+// API_KEY_FILE, which wins) and the keys file lines may target any project,
+// the structured auth.keys entries carry their own tenant and project
+// restrictions.
+func (c *Config) APIKeys() (map[string]*APIKey, error) {
+	keys := map[string]*APIKey{}
+	add := func(k *APIKey) error {
+		v := k.value()
+		if v == "" {
+			return fmt.Errorf("API key for tenant %q is empty", k.Tenant)
+		}
+		if _, dup := keys[v]; dup {
+			return fmt.Errorf("API key for tenant %q is configured twice", k.Tenant)
+		}
+		keys[v] = k
+		return nil
+	}
+
+	defaultKey := c.Auth.APIKey
+	if c.Auth.APIKeyFile != "" {
+		raw, err := os.ReadFile(c.Auth.APIKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading API key file: %w", err)
+		}
+		if defaultKey = strings.TrimSpace(string(raw)); defaultKey == "" {
+			return nil, fmt.Errorf("API key file %s is empty", c.Auth.APIKeyFile)
+		}
+	}
+	if defaultKey != "" {
+		if err := add(&APIKey{Tenant: "default", Key: defaultKey}); err != nil {
+			return nil, err
+		}
+	}
+	for i := range c.Auth.Keys {
+		if err := add(&c.Auth.Keys[i]); err != nil {
+			return nil, err
+		}
+	}
+	if c.Auth.KeysFile == "" {
+		return keys, nil
+	}
+
+	f, err := os.Open(c.Auth.KeysFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading keys file: %w", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := add(&APIKey{Tenant: "keys_file", Key: line}); err != nil {
+			return nil, err
+		}
+	}
+	return keys, scanner.Err()
+}
+
+// Redacted returns a copy of the config that is safe to log.
+func (c *Config) Redacted() Config {
+	out := *c
+	if out.Auth.APIKey != "" {
+		out.Auth.APIKey = redacted
+	}
+	if out.Auth.Introspection.ClientSecret != "" {
+		out.Auth.Introspection.ClientSecret = redacted
+	}
+	out.Auth.Keys = make([]APIKey, len(c.Auth.Keys))
+	for i, k := range c.Auth.Keys {
+		if k.Key != "" {
+			k.Key = redacted
+		}
+		out.Auth.Keys[i] = k
+	}
+	if out.Reporting.SentryDSN != "" {
+		out.Reporting.SentryDSN = redacted
+	}
+	if out.Debug.Token != "" {
+		out.Debug.Token = redactToken(out.Debug.Token)
+	}
+	// Webhook URLs often carry their credentials, Slack's in the path.
+	out.Reporting.WebhookURL = redactURL(out.Reporting.WebhookURL)
+	out.Alerting.WebhookURL = redactURL(out.Alerting.WebhookURL)
+	out.Firebase.EndpointOverride = redactURL(out.Firebase.EndpointOverride)
+	out.Store.RedisURL = redactURL(out.Store.RedisURL)
+	return out
+}
+
+// redactURL keeps only the scheme and host of u.
+func redactURL(u string) string {
+	if u == "" {
+		return ""
+	}
+	parsed, err := url.Parse(u)
+	if err != nil || parsed.Host == "" {
+		return redacted
+	}
+	if parsed.User == nil && (parsed.Path == "" || parsed.Path == "/") && parsed.RawQuery == "" {
+		return u
+	}
+	return parsed.Scheme + "://" + parsed.Host + "/" + redacted
+}
+
+// String renders the redacted config as YAML.
+func (c *Config) String() string {
+	raw, err := yaml.Marshal(c.Redacted())
+	if err != nil {
+		return err.Error()
+	}
+	return string(raw)
+}
+
+func setString(dst *string, key string) {
+	if v, ok := os.LookupEnv(key); ok {
+		*dst = v
+	}
+}
+
+func setInt(dst *int, key string) error {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", key, v, err)
+	}
+	*dst = n
+	return nil
+}
+
+func setFloat(dst *float64, key string) error {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", key, v, err)
+	}
+	*dst = f
+	return nil
+}
+
+func setBool(dst *bool, key string) error {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", key, v, err)
+	}
+	*dst = b
+	return nil
+}
+
+func setList(dst *[]string, key string) {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return
+	}
+	*dst = nil
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*dst = append(*dst, item)
+		}
+	}
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allow_cidrs entry: %w", err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func setDuration(dst *time.Duration, key string) error {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", key, v, err)
+	}
+	*dst = d
+	return nil
+}
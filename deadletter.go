@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+	"github.com/baakel/go_fcm/api"
+	"github.com/charmbracelet/log"
+	"github.com/gin-gonic/gin"
+)
+
+// DeadLetter is a message FCM did not accept, kept for investigation or
+// replay. Retryable is set for transient errors that outlasted the
+// configured retries.
+type DeadLetter struct {
+	Time      time.Time          `json:"time"`
+	Op        string             `json:"op"`
+	Message   *messaging.Message `json:"message"`
+	Code      string             `json:"code"`
+	Error     string             `json:"error"`
+	Retryable bool               `json:"retryable"`
+}
+
+// DeadLetterSink receives every permanently failed message.
+type DeadLetterSink interface {
+	WriteDeadLetter(DeadLetter) error
+}
+
+// FileDeadLetterSink appends dead letters as JSON lines.
+type FileDeadLetterSink struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	enc  *json.Encoder
+}
+
+func NewFileDeadLetterSink(path string) (*FileDeadLetterSink, error) {
+	s := &FileDeadLetterSink{path: path}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileDeadLetterSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("opening dead letter file: %w", err)
+	}
+	s.f, s.enc = f, json.NewEncoder(f)
+	return nil
+}
+
+// take removes the dead letters matching match from the file and returns
+// them. The rest are rewritten in place.
+func (s *FileDeadLetterSink) take(match func(DeadLetter) bool) ([]DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	raw, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("reading dead letter file: %w", err)
+	}
+	var taken []DeadLetter
+	var kept bytes.Buffer
+	enc := json.NewEncoder(&kept)
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	for {
+		var d DeadLetter
+		if err := dec.Decode(&d); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("dead letter file is corrupt: %w", err)
+		}
+		if match(d) {
+			taken = append(taken, d)
+		} else if err := enc.Encode(d); err != nil {
+			return nil, err
+		}
+	}
+	if len(taken) == 0 {
+		return nil, nil
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, kept.Bytes(), 0o600); err != nil {
+		return nil, fmt.Errorf("rewriting dead letter file: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return nil, fmt.Errorf("rewriting dead letter file: %w", err)
+	}
+	s.f.Close()
+	return taken, s.open()
+}
+
+func (s *FileDeadLetterSink) WriteDeadLetter(d DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enc.Encode(d)
+}
+
+// ChanDeadLetterSink hands dead letters to an in-process consumer. It never
+// blocks the send path: when the channel is full the letter is dropped with
+// an error.
+type ChanDeadLetterSink chan DeadLetter
+
+func (s ChanDeadLetterSink) WriteDeadLetter(d DeadLetter) error {
+	select {
+	case s <- d:
+		return nil
+	default:
+		return errors.New("dead letter channel full")
+	}
+}
+
+func writeDeadLetter(sink DeadLetterSink, op string, message *messaging.Message, err error) {
+	if sink == nil {
+		return
+	}
+	code := fcmErrorCode(err)
+	d := DeadLetter{
+		Time:      time.Now().UTC(),
+		Op:        op,
+		Message:   message,
+		Code:      code,
+		Error:     err.Error(),
+		Retryable: retryable(code),
+	}
+	if err := sink.WriteDeadLetter(d); err != nil {
+		log.Error("error writing dead letter", "error", err)
+	}
+}
+
+// ReplayDeadLetters re-sends the dead letters in the file, optionally only
+// those with a given code or in a since/until RFC 3339 time range. Letters
+// are removed before sending; the ones failing again are dead-lettered anew
+// by the client.
+func ReplayDeadLetters(c *gin.Context) {
+	appState, _ := c.Get("state")
+	state := appState.(*AppState)
+	if state.DeadLetterFile == nil {
+		c.JSON(http.StatusNotImplemented, api.ErrorResponse{Error: "dead letters are not written to a file"})
+		return
+	}
+	var since, until time.Time
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"since", &since}, {"until", &until}} {
+		if v := c.Query(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, api.ErrorResponse{Error: fmt.Sprintf("%s must be an RFC 3339 time", p.name)})
+				return
+			}
+			*p.dst = t
+		}
+	}
+	code := c.Query("code")
+	client := state.clientFor(c, c.Query("project"))
+	if client == nil {
+		return
+	}
+
+	letters, err := state.DeadLetterFile.take(func(d DeadLetter) bool {
+		switch {
+		case d.Message == nil,
+			code != "" && d.Code != code,
+			!since.IsZero() && d.Time.Before(since),
+			!until.IsZero() && d.Time.After(until):
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, api.ErrorResponse{Error: "cannot read dead letters"})
+		return
+	}
+
+	succeeded := 0
+	for _, d := range letters {
+		ctx, cancel := state.fcmContext(c)
+		_, err := client.Send(ctx, d.Message)
+		cancel()
+		if err == nil {
+			succeeded++
+		}
+	}
+	log.Info("replayed dead letters", "replayed", len(letters), "succeeded", succeeded)
+	c.JSON(http.StatusOK, gin.H{
+		"replayed":  len(letters),
+		"succeeded": succeeded,
+		"failed":    len(letters) - succeeded,
+	})
+}
+
+// multicastMessage rebuilds the single message FCM sent to one token of m.
+func multicastMessage(m *messaging.MulticastMessage, token string) *messaging.Message {
+	return &messaging.Message{
+		Token:        token,
+		Data:         m.Data,
+		Notification: m.Notification,
+		Android:      m.Android,
+		Webpush:      m.Webpush,
+		APNS:         m.APNS,
+		FCMOptions:   m.FCMOptions,
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+	"github.com/baakel/go_fcm/api"
+	"github.com/gin-gonic/gin"
+)
+
+// DebugHeader asks for the constructed message in the response, like the
+// "debug" body field.
+const DebugHeader = "X-Debug"
+
+// explain inspects the message about to be sent: it records its warnings,
+// and the message itself to be echoed in the response when the request asked
+// for debug output. Only keys with the debug scope may; for others it
+// answers 403 and returns false.
+func explain(c *gin.Context, p api.PlatformInput, message *messaging.Message) bool {
+	if warnings := apnsWarnings(message); len(warnings) > 0 {
+		c.Set("warnings", warnings)
+	}
+	if label := analyticsLabel(message.FCMOptions); label != "" {
+		c.Set("analytics_label", label)
+	}
+	if !p.Debug && c.GetHeader(DebugHeader) == "" {
+		return true
+	}
+	if key := requestKey(c); key == nil || !key.Debug {
+		c.JSON(http.StatusForbidden, api.ErrorResponse{Error: "debug output needs an API key with the debug scope"})
+		return false
+	}
+	sanitized := *message
+	sanitized.Token = redactToken(message.Token)
+	// The rendering can hold notification text, which stays out of the
+	// info level logs.
+	requestLog(c).Debug("debug rendering of message", "message", &sanitized)
+	c.Set("debug_message", &sanitized)
+	c.Set("debug_sources", defaultSources(c, p, message))
+	return true
+}
+
+// defaultSources tells for each defaultable setting of message whether it
+// came from the request, the topic's defaults or the configured defaults,
+// and for the replace_key targets whether they came from replace_key or
+// their platform block. Unset settings are left out.
+func defaultSources(c *gin.Context, p api.PlatformInput, message *messaging.Message) map[string]string {
+	var fromTopic []string
+	if v, ok := c.Get("topic_defaults"); ok {
+		fromTopic = v.([]string)
+	}
+	var android api.AndroidInput
+	if p.Android != nil {
+		android = *p.Android
+	}
+	var apns api.APNSInput
+	if p.APNS != nil {
+		apns = *p.APNS
+	}
+	var label string
+	if p.FCMOptions != nil {
+		label = p.FCMOptions.AnalyticsLabel
+	}
+
+	var an messaging.AndroidNotification
+	if message.Android != nil && message.Android.Notification != nil {
+		an = *message.Android.Notification
+	}
+	var apnsSound string
+	if message.APNS != nil && message.APNS.Payload != nil && message.APNS.Payload.Aps != nil {
+		apnsSound = message.APNS.Payload.Aps.Sound
+	}
+	var sentLabel string
+	if message.FCMOptions != nil {
+		sentLabel = message.FCMOptions.AnalyticsLabel
+	}
+
+	sources := map[string]string{}
+	for _, f := range []struct {
+		field         string
+		sent, request bool
+	}{
+		{"android.channel_id", an.ChannelID != "", android.ChannelID != ""},
+		{"android.icon", an.Icon != "", android.Icon != ""},
+		{"android.color", an.Color != "", android.Color != ""},
+		{"android.sound", an.Sound != "", android.Sound != "" || p.Sound != ""},
+		{"apns.sound", apnsSound != "", apns.Sound != "" || p.Sound != ""},
+		{"fcm_options.analytics_label", sentLabel != "", label != ""},
+	} {
+		switch {
+		case !f.sent:
+		case slices.Contains(fromTopic, f.field):
+			sources[f.field] = "topic"
+		case f.request:
+			sources[f.field] = "request"
+		default:
+			sources[f.field] = "global"
+		}
+	}
+	// The replace_key targets, which platform blocks override.
+	for field, own := range map[string]bool{
+		"android.collapse_key": android.CollapseKey != "",
+		"android.tag":          android.Tag != "",
+		"apns.collapse_id":     apns.CollapseID != "",
+		"webpush.tag":          p.Webpush != nil && p.Webpush.Tag != "",
+	} {
+		switch {
+		case own:
+			sources[field] = "request"
+		case p.ReplaceKey != "":
+			sources[field] = "replace_key"
+		}
+	}
+	return sources
+}
+
+// echoInput records the parsed request body to be echoed in the response
+// when the request asked for it with ?echo=1, to show how the JSON was
+// read. It is the caller's own input, so no scope is needed. in is a copy,
+// taken before normalisation changes it.
+func echoInput(c *gin.Context, in any) {
+	if c.Query("echo") == "1" {
+		c.Set("echo", in)
+	}
+}
+
+// withDebug adds the message and warnings recorded by explain and the input
+// recorded by echoInput, if any, to the body of a failed send.
+func withDebug(c *gin.Context, resp api.ErrorResponse) api.ErrorResponse {
+	resp.AnalyticsLabel = c.GetString("analytics_label")
+	if w, ok := c.Get("warnings"); ok {
+		resp.Warnings = w.([]string)
+	}
+	resp.Echo, _ = c.Get("echo")
+	if m, ok := c.Get("debug_message"); ok {
+		resp.Debug = map[string]any{"message": m, "sources": c.MustGet("debug_sources")}
+	}
+	return resp
+}
+
+// analyticsLabel is the label a message is sent with, topic prefix
+// included. FCM does not report it back, so it is echoed in the response and
+// the logs for reconciling against the analytics reports.
+func analyticsLabel(o *messaging.FCMOptions) string {
+	if o == nil {
+		return ""
+	}
+	return o.AnalyticsLabel
+}
+
+// wantsTiming reports whether the request asked for the FCM call latency
+// with ?timing=1.
+func wantsTiming(c *gin.Context) bool {
+	return c.Query("timing") == "1"
+}
+
+// sendResponse completes the body of a successful single message send with
+// what withDebug adds to other bodies, and with the duration of the FCM call
+// when the request asked for it. Only the call itself is measured, so the
+// difference to the client's round trip is the relay's own overhead.
+func sendResponse(c *gin.Context, fcm time.Duration, resp api.SendResponse) api.SendResponse {
+	resp.AnalyticsLabel = c.GetString("analytics_label")
+	if w, ok := c.Get("warnings"); ok {
+		resp.Warnings = w.([]string)
+	}
+	resp.Echo, _ = c.Get("echo")
+	if m, ok := c.Get("debug_message"); ok {
+		resp.Debug = map[string]any{"message": m, "sources": c.MustGet("debug_sources")}
+	}
+	if wantsTiming(c) {
+		resp.FCMLatencyMS = float64(fcm.Microseconds()) / 1000
+	}
+	return resp
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// IdempotencyKeyHeader names a send explicitly. A request carrying one is
+// deduplicated by the key instead of its content: a retry with the same key
+// is answered with the original message ID whatever it carries, and a
+// different key is a different send even with identical content.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// dedupCache remembers the message ID of every recent send by a hash of its
+// target and content, so that an identical send within window is answered
+// with the original ID instead of reaching the device twice.
+type dedupCache struct {
+	window time.Duration
+	store  Store
+}
+
+// newDedupCache returns nil when deduplication is disabled.
+func newDedupCache(c DedupConfig, stores *Stores) *dedupCache {
+	if c.Window <= 0 {
+		return nil
+	}
+	return &dedupCache{window: c.Window, store: stores.open("dedup", c.CacheSize)}
+}
+
+// key identifies a send of message to target, one per target of a
+// multicast: by the request's Idempotency-Key when it has one, else by a
+// hash of the whole message, platform options included. message is a
+// *messaging.Message or a *messaging.MulticastMessage without tokens. The key
+// is empty, disabling deduplication for the send, when the cache is off.
+func (d *dedupCache) key(c *gin.Context, target string, message any) string {
+	if d == nil {
+		return ""
+	}
+	id := struct {
+		Tenant, Project, Target string
+		IdempotencyKey          string `json:",omitempty"`
+		Message                 any    `json:",omitempty"`
+	}{Tenant: requestTenant(c), Project: c.GetString("project"), Target: target}
+	if k := c.GetHeader(IdempotencyKeyHeader); k != "" {
+		id.IdempotencyKey = k
+	} else {
+		id.Message = message
+	}
+	raw, err := json.Marshal(id)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// lookup returns the message ID of an identical send within the window.
+func (d *dedupCache) lookup(ctx context.Context, key string) (string, bool) {
+	if d == nil || key == "" {
+		return "", false
+	}
+	id, ok, _ := d.store.Get(ctx, key)
+	return id, ok
+}
+
+func (d *dedupCache) remember(ctx context.Context, key, messageID string) {
+	if d == nil || key == "" {
+		return
+	}
+	d.store.Set(ctx, key, messageID, d.window)
+}
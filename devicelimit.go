@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"strconv"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+	"github.com/baakel/go_fcm/api"
+	"github.com/charmbracelet/log"
+	"github.com/gin-gonic/gin"
+)
+
+// deviceLimitCollapseKey groups the messages sent to a device over its limit,
+// so the device only keeps the latest of them.
+const deviceLimitCollapseKey = "over_device_limit"
+
+// deviceLimiter allows each device token at most max messages per window,
+// counted from the first message of the window.
+type deviceLimiter struct {
+	max      int
+	window   time.Duration
+	collapse bool
+	store    Store
+}
+
+// newDeviceLimiter returns nil when the limit is disabled.
+func newDeviceLimiter(c DeviceLimitConfig, stores *Stores) *deviceLimiter {
+	if c.Messages <= 0 {
+		return nil
+	}
+	return &deviceLimiter{
+		max:      c.Messages,
+		window:   c.Window,
+		collapse: c.Mode == "collapse",
+		store:    stores.open("device", c.CacheSize),
+	}
+}
+
+// allow counts a message to token and reports whether it is within the
+// limit. Sends without a token are always allowed, and so are sends whose
+// count could not be kept.
+func (l *deviceLimiter) allow(ctx context.Context, token string) bool {
+	if l == nil || token == "" {
+		return true
+	}
+	n, err := l.store.Incr(ctx, token, l.window)
+	if err != nil {
+		log.Warn("device limit unavailable, allowing the message", "token", redactToken(token), "error", err)
+		return true
+	}
+	return n <= int64(l.max)
+}
+
+// over reports, without counting, whether one more message to token would
+// exceed the limit.
+func (l *deviceLimiter) over(ctx context.Context, token string) bool {
+	if l == nil || token == "" {
+		return false
+	}
+	v, ok, err := l.store.Get(ctx, token)
+	if err != nil || !ok {
+		return false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	return err == nil && n >= int64(l.max)
+}
+
+// limitDevice applies the per-device limit to a single message, collapsing
+// it when over the limit in collapse mode. Otherwise an over-limit send is
+// answered with 429 and limitDevice returns false.
+func (s *AppState) limitDevice(c *gin.Context, message *messaging.Message, clientRef string) bool {
+	lim := s.DeviceLimit
+	if lim.allow(c, message.Token) {
+		return true
+	}
+	if lim.collapse {
+		message.Android, message.APNS = collapsedConfigs(message.Android, message.APNS)
+		return true
+	}
+	c.JSON(http.StatusTooManyRequests, api.ErrorResponse{Error: "too many messages to this device", Code: api.ErrCodeOverDeviceLimit, ClientRef: clientRef})
+	return false
+}
+
+// collapsedConfigs returns copies of the configs with the collapse key set
+// on both platforms, so that messages over the device limit replace each
+// other instead of piling up. The configs passed in are left alone, as
+// other devices of a multicast may share them.
+func collapsedConfigs(android *messaging.AndroidConfig, apns *messaging.APNSConfig) (*messaging.AndroidConfig, *messaging.APNSConfig) {
+	a, p := messaging.AndroidConfig{}, messaging.APNSConfig{}
+	if android != nil {
+		a = *android
+	}
+	if apns != nil {
+		p = *apns
+	}
+	p.Headers = maps.Clone(p.Headers)
+	if p.Headers == nil {
+		p.Headers = map[string]string{}
+	}
+	a.CollapseKey = deviceLimitCollapseKey
+	p.Headers["apns-collapse-id"] = deviceLimitCollapseKey
+	return &a, &p
+}
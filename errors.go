@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"firebase.google.com/go/v4/errorutils"
+	"firebase.google.com/go/v4/messaging"
+	"github.com/baakel/go_fcm/api"
+)
+
+// fcmErrorCode maps an error returned by the messaging client to one of the
+// ErrCode constants.
+func fcmErrorCode(err error) string {
+	switch {
+	case messaging.IsInvalidArgument(err):
+		return api.ErrCodeInvalidArgument
+	case messaging.IsUnregistered(err):
+		return api.ErrCodeUnregistered
+	case messaging.IsSenderIDMismatch(err):
+		return api.ErrCodeSenderMismatch
+	case messaging.IsQuotaExceeded(err):
+		return api.ErrCodeQuotaExceeded
+	case messaging.IsUnavailable(err):
+		return api.ErrCodeUnavailable
+	case messaging.IsInternal(err):
+		return api.ErrCodeInternal
+	case messaging.IsThirdPartyAuthError(err):
+		return api.ErrCodeThirdPartyAuth
+	case errorutils.IsUnauthenticated(err):
+		return api.ErrCodeUnauthenticated
+	case errorutils.IsPermissionDenied(err):
+		return api.ErrCodePermission
+	default:
+		return api.ErrCodeUnknown
+	}
+}
+
+// retryable reports whether a send failing with code may succeed if tried
+// again later.
+func retryable(code string) bool {
+	switch code {
+	case api.ErrCodeQuotaExceeded, api.ErrCodeUnavailable, api.ErrCodeInternal:
+		return true
+	}
+	return false
+}
+
+// fcmFieldViolations extracts the google.rpc.BadRequest details FCM attaches
+// to invalid argument errors, which the SDK flattens into the error string.
+func fcmFieldViolations(err error) []api.FieldViolation {
+	resp := errorutils.HTTPResponse(err)
+	if resp == nil || resp.Body == nil {
+		return nil
+	}
+	body, readErr := io.ReadAll(resp.Body)
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if readErr != nil {
+		return nil
+	}
+
+	var payload struct {
+		Error struct {
+			Details []struct {
+				Type            string               `json:"@type"`
+				FieldViolations []api.FieldViolation `json:"fieldViolations"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &payload) != nil {
+		return nil
+	}
+	var violations []api.FieldViolation
+	for _, d := range payload.Error.Details {
+		if strings.HasSuffix(d.Type, "google.rpc.BadRequest") {
+			violations = append(violations, d.FieldViolations...)
+		}
+	}
+	return violations
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/baakel/go_fcm/api"
+	"github.com/gin-gonic/gin"
+)
+
+// contentETag is a strong ETag over the JSON form of a stored resource. The
+// form includes updated_at, so every write gives a new tag even when the
+// content is the same.
+func contentETag(v any) string {
+	raw, _ := json.Marshal(v)
+	sum := sha256.Sum256(raw)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagListed reports whether a If-Match or If-None-Match header value names
+// etag, "*" naming any.
+func etagListed(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified sets the ETag header of a GET and answers 304 when the
+// client's If-None-Match already has it.
+func notModified(c *gin.Context, etag string) bool {
+	c.Header("ETag", etag)
+	if inm := c.GetHeader("If-None-Match"); inm != "" && etagListed(inm, etag) {
+		c.Status(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// writeAllowed checks the preconditions of a PUT against the stored
+// resource, whose ETag is current and empty when there is none. Replacing a
+// resource needs an If-Match naming its current tag, so a client can't
+// overwrite an edit it never saw; creating one needs no header, or
+// If-None-Match: * to be sure it doesn't exist yet. It must be called with
+// the store locked, so that no write slips in between check and store.
+func writeAllowed(c *gin.Context, current string) bool {
+	ifMatch, ifNoneMatch := c.GetHeader("If-Match"), c.GetHeader("If-None-Match")
+	switch {
+	case current == "" && ifMatch != "":
+		c.JSON(http.StatusPreconditionFailed, api.ErrorResponse{Error: "resource does not exist, If-Match cannot match"})
+	case current != "" && ifNoneMatch == "*":
+		c.JSON(http.StatusPreconditionFailed, api.ErrorResponse{Error: "resource already exists"})
+	case current != "" && ifMatch == "":
+		c.Header("ETag", current)
+		c.JSON(http.StatusPreconditionRequired, api.ErrorResponse{Error: "replacing a resource needs an If-Match header with its ETag"})
+	case current != "" && !etagListed(ifMatch, current):
+		c.Header("ETag", current)
+		c.JSON(http.StatusPreconditionFailed, api.ErrorResponse{Error: "resource was changed since it was read, fetch it again"})
+	default:
+		return true
+	}
+	return false
+}
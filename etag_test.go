@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newRequest returns an API client's request of body to path, with the
+// header key and value pairs.
+func newRequest(t testing.TB, srv *httptest.Server, method, path, body string, header ...string) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	return req
+}
+
+// request sends newRequest's request.
+func request(t testing.TB, srv *httptest.Server, method, path, body string, header ...string) *http.Response {
+	t.Helper()
+	resp, err := http.DefaultClient.Do(newRequest(t, srv, method, path, body, header...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// Two editors read the same version and both write it back changed. The
+// second write must fail instead of silently dropping the first.
+func TestLostUpdate(t *testing.T) {
+	tests := []struct {
+		name, path                string
+		created, alice, bob, read string
+	}{
+		{
+			name:    "template",
+			path:    "/templates/welcome",
+			created: `{"title":"Hello"}`,
+			alice:   `{"title":"Hello from Alice"}`,
+			bob:     `{"title":"Hello from Bob"}`,
+			read:    "title",
+		},
+		{
+			name:    "topic defaults",
+			path:    "/topics/news/defaults",
+			created: `{"analytics_label_prefix":"news"}`,
+			alice:   `{"analytics_label_prefix":"alice"}`,
+			bob:     `{"analytics_label_prefix":"bob"}`,
+			read:    "analytics_label_prefix",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, _ := newTestServer(t, &fakeMessenger{})
+			expect := func(resp *http.Response, status int) string {
+				t.Helper()
+				if resp.StatusCode != status {
+					t.Fatalf("%s %s: status %d, want %d", resp.Request.Method, tt.path, resp.StatusCode, status)
+				}
+				return resp.Header.Get("ETag")
+			}
+
+			created := expect(request(t, srv, http.MethodPut, tt.path, tt.created), http.StatusOK)
+			aliceRead := expect(request(t, srv, http.MethodGet, tt.path, ""), http.StatusOK)
+			bobRead := expect(request(t, srv, http.MethodGet, tt.path, ""), http.StatusOK)
+			if created == "" || aliceRead != created || bobRead != created {
+				t.Fatalf("ETags %q, %q and %q, want the created version's for both reads", created, aliceRead, bobRead)
+			}
+
+			aliceWrote := expect(request(t, srv, http.MethodPut, tt.path, tt.alice, "If-Match", aliceRead), http.StatusOK)
+			if aliceWrote == aliceRead {
+				t.Fatal("the write kept the ETag it replaced")
+			}
+			if current := expect(request(t, srv, http.MethodPut, tt.path, tt.bob, "If-Match", bobRead), http.StatusPreconditionFailed); current != aliceWrote {
+				t.Fatalf("the refused write reported ETag %q, want the current %q", current, aliceWrote)
+			}
+			expect(request(t, srv, http.MethodPut, tt.path, tt.bob), http.StatusPreconditionRequired)
+			expect(request(t, srv, http.MethodPut, tt.path, tt.bob, "If-None-Match", "*"), http.StatusPreconditionFailed)
+
+			resp := request(t, srv, http.MethodGet, tt.path, "")
+			if got := expect(resp, http.StatusOK); got != aliceWrote {
+				t.Fatalf("ETag %q after the refused writes, want Alice's %q", got, aliceWrote)
+			}
+			var stored, alice map[string]any
+			if err := json.NewDecoder(resp.Body).Decode(&stored); err != nil {
+				t.Fatal(err)
+			}
+			json.Unmarshal([]byte(tt.alice), &alice)
+			if stored[tt.read] != alice[tt.read] {
+				t.Fatalf("stored %s %v, want Alice's %v", tt.read, stored[tt.read], alice[tt.read])
+			}
+
+			expect(request(t, srv, http.MethodGet, tt.path, "", "If-None-Match", aliceWrote), http.StatusNotModified)
+			expect(request(t, srv, http.MethodGet, tt.path, "", "If-None-Match", aliceRead), http.StatusOK)
+		})
+	}
+}
+
+// Writers racing with the same If-Match: exactly one of them wins.
+func TestConcurrentConditionalWrites(t *testing.T) {
+	srv, _ := newTestServer(t, &fakeMessenger{})
+	const path = "/templates/welcome"
+	etag := request(t, srv, http.MethodPut, path, `{"title":"Hello"}`).Header.Get("ETag")
+
+	const writers = 16
+	statuses := make(chan int, writers)
+	var wg sync.WaitGroup
+	for range writers {
+		req := newRequest(t, srv, http.MethodPut, path, `{"title":"Hello again"}`, "If-Match", etag)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	won := 0
+	for status := range statuses {
+		switch status {
+		case http.StatusOK:
+			won++
+		case http.StatusPreconditionFailed:
+		default:
+			t.Errorf("status %d, want %d or %d", status, http.StatusOK, http.StatusPreconditionFailed)
+		}
+	}
+	if won != 1 {
+		t.Fatalf("%d writes won, want exactly 1", won)
+	}
+}
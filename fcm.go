@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+	"github.com/charmbracelet/log"
+	"github.com/gin-gonic/gin"
+)
+
+// Messenger is the part of *messaging.Client the handlers use. AppState holds
+// an FCMClient that wraps the SDK client with our own instrumentation.
+type Messenger interface {
+	Send(ctx context.Context, message *messaging.Message) (string, error)
+	SendDryRun(ctx context.Context, message *messaging.Message) (string, error)
+	SendEachForMulticast(ctx context.Context, message *messaging.MulticastMessage) (*messaging.BatchResponse, error)
+	SendEachForMulticastDryRun(ctx context.Context, message *messaging.MulticastMessage) (*messaging.BatchResponse, error)
+	SubscribeToTopic(ctx context.Context, tokens []string, topic string) (*messaging.TopicManagementResponse, error)
+	UnsubscribeFromTopic(ctx context.Context, tokens []string, topic string) (*messaging.TopicManagementResponse, error)
+}
+
+// FCMObserver is told about the outcome of every message FCM accepted or
+// rejected. err is nil on success.
+type FCMObserver interface {
+	ObserveFCM(op string, err error)
+}
+
+// errFCMBusy is returned instead of calling FCM when the in-flight limit
+// stayed saturated for longer than the configured wait.
+var errFCMBusy = errors.New("too many FCM calls in flight, retry later")
+
+// shed reports whether err means the call was refused before reaching FCM,
+// by the in-flight limit or the circuit breaker.
+func shed(err error) bool {
+	var open *breakerOpenError
+	return errors.Is(err, errFCMBusy) || errors.As(err, &open)
+}
+
+// inFlightLimiter bounds the FCM calls made at once across all clients. A
+// nil limiter allows any number.
+type inFlightLimiter struct {
+	slots   chan struct{}
+	maxWait time.Duration
+	// waits has the milliseconds each acquire waited, a timed out one
+	// included.
+	waits *histogram
+}
+
+func newInFlightLimiter(c ConcurrencyConfig) *inFlightLimiter {
+	if c.MaxInFlight <= 0 {
+		return nil
+	}
+	return &inFlightLimiter{
+		slots:   make(chan struct{}, c.MaxInFlight),
+		maxWait: c.MaxWait,
+		waits:   newHistogram(0, 1, 5, 10, 50, 100, 250, 500, 1000, 5000),
+	}
+}
+
+// acquire waits up to maxWait for a slot. The caller must release it.
+func (l *inFlightLimiter) acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		l.waits.observe(0)
+		return nil
+	default:
+	}
+	start := time.Now()
+	defer func() { l.waits.observe(float64(time.Since(start).Microseconds()) / 1000) }()
+	timer := time.NewTimer(l.maxWait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return errFCMBusy
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *inFlightLimiter) release() {
+	if l != nil {
+		<-l.slots
+	}
+}
+
+// stats reports the calls in flight and the limit, zero when unlimited, and
+// the time calls waited for a slot in milliseconds, nil when unlimited.
+func (l *inFlightLimiter) stats() (inFlight, limit int, waits *histogramSnapshot) {
+	if l == nil {
+		return 0, 0, nil
+	}
+	s := l.waits.snapshot()
+	return len(l.slots), cap(l.slots), &s
+}
+
+// fcmErrorStatus is the response status for a failed FCM call: 503 with a
+// Retry-After when the call was shed by the in-flight limit or the circuit
+// breaker, 503 when FCM itself is failing, else 502.
+func fcmErrorStatus(c *gin.Context, err error) int {
+	if errors.Is(err, errFCMBusy) {
+		c.Header("Retry-After", "1")
+		return http.StatusServiceUnavailable
+	}
+	var open *breakerOpenError
+	if errors.As(err, &open) {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(open.retryAfter.Seconds()))))
+		return http.StatusServiceUnavailable
+	}
+	if isOutage(err) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
+
+// FCMClient wraps a Messenger, retries transient failures, reports every
+// outcome to its observers and hands failed sends to the dead letter sink,
+// if any. Every attempt passes the shared circuit breaker and holds a slot of
+// the shared in-flight limiter; a multicast counts as one call.
+type FCMClient struct {
+	inner       Messenger
+	breaker     *circuitBreaker
+	limiter     *inFlightLimiter
+	retries     fcmRetries
+	quotaQueue  *quotaQueue
+	deadLetters DeadLetterSink
+	observers   []FCMObserver
+}
+
+func NewFCMClient(inner Messenger, breaker *circuitBreaker, limiter *inFlightLimiter, retries fcmRetries, quotaQueue *quotaQueue, deadLetters DeadLetterSink, observers ...FCMObserver) *FCMClient {
+	return &FCMClient{inner: inner, breaker: breaker, limiter: limiter, retries: retries, quotaQueue: quotaQueue, deadLetters: deadLetters, observers: observers}
+}
+
+func (c *FCMClient) observe(op string, err error) {
+	for _, o := range c.observers {
+		o.ObserveFCM(op, err)
+	}
+}
+
+// limited runs call holding an in-flight slot.
+func limited[T any](ctx context.Context, l *inFlightLimiter, call func() (T, error)) (T, error) {
+	if err := l.acquire(ctx); err != nil {
+		var zero T
+		return zero, err
+	}
+	defer l.release()
+	return call()
+}
+
+func (c *FCMClient) Send(ctx context.Context, message *messaging.Message) (string, error) {
+	send := func() (string, error) {
+		return withRetry(ctx, c.retries.send, "send", func() (string, error) {
+			return guarded(ctx, c.breaker, c.limiter, func() (string, error) { return c.inner.Send(ctx, message) })
+		})
+	}
+	id, err := send()
+	if shed(err) {
+		return "", err
+	}
+	// Only the boosted attempt's outcome counts, so a boost that gets
+	// through leaves nothing in the dead letter sink.
+	if shouldBoost(ctx, err) && boostPriority(message) {
+		log.Warn("escalating undelivered message to high priority", "code", fcmErrorCode(err), "error", err)
+		c.observe("send", err)
+		if id, err = send(); shed(err) {
+			return "", err
+		}
+	}
+	c.observe("send", err)
+	if queued := c.quotaQueue.park(ctx, message, err, c.sendQueued); queued != nil {
+		return "", queued
+	}
+	if err != nil {
+		writeDeadLetter(c.deadLetters, "send", message, err)
+	}
+	return id, err
+}
+
+// sendQueued sends a message from the quota queue, which may park it again.
+func (c *FCMClient) sendQueued(ctx context.Context, message *messaging.Message) {
+	id, err := c.Send(ctx, message)
+	switch {
+	case queuedSend(err) != nil:
+	case err != nil:
+		log.Error("error sending queued message", "error", err)
+	default:
+		log.Info("sent queued message", "message_id", id)
+	}
+}
+
+func (c *FCMClient) SendDryRun(ctx context.Context, message *messaging.Message) (string, error) {
+	id, err := guarded(ctx, c.breaker, c.limiter, func() (string, error) { return c.inner.SendDryRun(ctx, message) })
+	if !shed(err) {
+		c.observe("send_dry_run", err)
+	}
+	return id, err
+}
+
+func (c *FCMClient) SendEachForMulticast(ctx context.Context, message *messaging.MulticastMessage) (*messaging.BatchResponse, error) {
+	resp, err := withRetry(ctx, c.retries.multicast, "multicast", func() (*messaging.BatchResponse, error) {
+		return guarded(ctx, c.breaker, c.limiter, func() (*messaging.BatchResponse, error) {
+			return c.inner.SendEachForMulticast(ctx, message)
+		})
+	})
+	if shed(err) {
+		return nil, err
+	}
+	if err != nil {
+		c.observe("multicast", err)
+		for _, token := range message.Tokens {
+			writeDeadLetter(c.deadLetters, "multicast", multicastMessage(message, token), err)
+		}
+		return resp, err
+	}
+	for i, r := range resp.Responses {
+		c.observe("multicast", r.Error)
+		if r.Error != nil {
+			writeDeadLetter(c.deadLetters, "multicast", multicastMessage(message, message.Tokens[i]), r.Error)
+		}
+	}
+	return resp, nil
+}
+
+// SendEachForMulticastDryRun has FCM validate message for every token
+// without delivering it. Like SendDryRun it is neither retried, queued nor
+// dead-lettered.
+func (c *FCMClient) SendEachForMulticastDryRun(ctx context.Context, message *messaging.MulticastMessage) (*messaging.BatchResponse, error) {
+	resp, err := guarded(ctx, c.breaker, c.limiter, func() (*messaging.BatchResponse, error) {
+		return c.inner.SendEachForMulticastDryRun(ctx, message)
+	})
+	if !shed(err) {
+		c.observe("multicast_dry_run", err)
+	}
+	return resp, err
+}
+
+func (c *FCMClient) SubscribeToTopic(ctx context.Context, tokens []string, topic string) (*messaging.TopicManagementResponse, error) {
+	resp, err := withRetry(ctx, c.retries.topics, "subscribe", func() (*messaging.TopicManagementResponse, error) {
+		return guarded(ctx, c.breaker, c.limiter, func() (*messaging.TopicManagementResponse, error) {
+			return c.inner.SubscribeToTopic(ctx, tokens, topic)
+		})
+	})
+	if shed(err) {
+		return nil, err
+	}
+	c.observe("subscribe", err)
+	return resp, err
+}
+
+func (c *FCMClient) UnsubscribeFromTopic(ctx context.Context, tokens []string, topic string) (*messaging.TopicManagementResponse, error) {
+	resp, err := withRetry(ctx, c.retries.topics, "unsubscribe", func() (*messaging.TopicManagementResponse, error) {
+		return guarded(ctx, c.breaker, c.limiter, func() (*messaging.TopicManagementResponse, error) {
+			return c.inner.UnsubscribeFromTopic(ctx, tokens, topic)
+		})
+	})
+	if shed(err) {
+		return nil, err
+	}
+	c.observe("unsubscribe", err)
+	return resp, err
+}
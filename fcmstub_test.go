@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"firebase.google.com/go/v4/messaging"
+	"github.com/baakel/go_fcm/api"
+)
+
+// fcmStub is an httptest server shaped like the FCM v1 send API, for running
+// the real messaging client against. It records the messages it receives
+// and answers each with a new message name, or with the canned error set
+// for its token.
+type fcmStub struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	errors   map[string]fcmStubError
+	times    map[string]int
+	received []map[string]any
+}
+
+// fcmStubError is a canned FCM error answer.
+type fcmStubError struct {
+	status int
+	body   string
+}
+
+// fcmError returns the error FCM answers with for the given HTTP status,
+// google.rpc status and FCM error code, such as 404, NOT_FOUND and
+// UNREGISTERED, with field violations for invalid arguments.
+func fcmError(status int, rpcStatus, errorCode string, violations ...api.FieldViolation) fcmStubError {
+	details := []map[string]any{{
+		"@type":     "type.googleapis.com/google.firebase.fcm.v1.FcmError",
+		"errorCode": errorCode,
+	}}
+	if len(violations) > 0 {
+		details = append(details, map[string]any{
+			"@type":           "type.googleapis.com/google.rpc.BadRequest",
+			"fieldViolations": violations,
+		})
+	}
+	body, _ := json.Marshal(map[string]any{"error": map[string]any{
+		"code":    status,
+		"message": "canned " + errorCode,
+		"status":  rpcStatus,
+		"details": details,
+	}})
+	return fcmStubError{status: status, body: string(body)}
+}
+
+func newFCMStub(t *testing.T) *fcmStub {
+	t.Helper()
+	s := &fcmStub{errors: map[string]fcmStubError{}, times: map[string]int{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fcmStub) serve(w http.ResponseWriter, r *http.Request) {
+	project, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/projects/"), "/messages:send")
+	if r.Method != http.MethodPost || !ok {
+		http.NotFound(w, r)
+		return
+	}
+	var req struct {
+		Message map[string]any `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	token, _ := req.Message["token"].(string)
+
+	s.mu.Lock()
+	s.received = append(s.received, req.Message)
+	n := len(s.received)
+	e, failed := s.errors[token]
+	if n, limited := s.times[token]; failed && limited {
+		if n == 1 {
+			delete(s.errors, token)
+		}
+		s.times[token] = n - 1
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if failed {
+		w.WriteHeader(e.status)
+		fmt.Fprint(w, e.body)
+		return
+	}
+	fmt.Fprintf(w, `{"name":"projects/%s/messages/%d"}`, project, n)
+}
+
+// fail makes the stub answer sends to token with e.
+func (s *fcmStub) fail(token string, e fcmStubError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors[token] = e
+}
+
+// failTimes makes the stub answer the next n sends to token with e.
+func (s *fcmStub) failTimes(token string, n int, e fcmStubError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors[token], s.times[token] = e, n
+}
+
+// messages returns the messages received so far, as FCM saw their JSON.
+func (s *fcmStub) messages() []map[string]any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]map[string]any(nil), s.received...)
+}
+
+// newStubServer serves the real router in front of the real messaging
+// client, configured to talk to a fresh fcmStub.
+func newStubServer(t *testing.T) (*httptest.Server, *fcmStub) {
+	t.Helper()
+	stub := newFCMStub(t)
+	client, err := newMessagingClient(context.Background(), FirebaseProject{ID: "stub-project"}, stub.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, state := newTestServer(t, client)
+	state.Emulator = stub.URL
+	return srv, stub
+}
+
+func TestStubFCMPublish(t *testing.T) {
+	srv, stub := newStubServer(t)
+
+	resp := post(t, srv, "/publish", publishBody(testToken(1)))
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusAccepted)
+	}
+	var out api.SendResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out.MessageID != "projects/stub-project/messages/1" {
+		t.Fatalf("message_id %q, want the stub's name", out.MessageID)
+	}
+
+	got := stub.messages()
+	if len(got) != 1 || got[0]["token"] != testToken(1) {
+		t.Fatalf("stub received %v, want one message to %s", got, testToken(1))
+	}
+	if n, _ := got[0]["notification"].(map[string]any); n["title"] != "T" {
+		t.Fatalf("stub received notification %v, want title T", got[0]["notification"])
+	}
+}
+
+func TestStubFCMErrors(t *testing.T) {
+	srv, stub := newStubServer(t)
+	unregistered, invalid := testToken(1), testToken(2)
+	stub.fail(unregistered, fcmError(http.StatusNotFound, "NOT_FOUND", "UNREGISTERED"))
+	stub.fail(invalid, fcmError(http.StatusBadRequest, "INVALID_ARGUMENT", "INVALID_ARGUMENT",
+		api.FieldViolation{Field: "message.token", Description: "Invalid registration token"}))
+
+	tests := []struct {
+		name, token, code string
+		details           int
+	}{
+		{"unregistered", unregistered, api.ErrCodeUnregistered, 0},
+		{"invalid argument", invalid, api.ErrCodeInvalidArgument, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := post(t, srv, "/send", fmt.Sprintf(`{"token":%q,"notification":{"title":"T"}}`, tt.token))
+			if resp.StatusCode != http.StatusBadGateway {
+				t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusBadGateway)
+			}
+			var e api.ErrorResponse
+			if err := json.NewDecoder(resp.Body).Decode(&e); err != nil {
+				t.Fatal(err)
+			}
+			if e.Code != tt.code || len(e.Details) != tt.details {
+				t.Fatalf("got %+v, want code %s with %d details", e, tt.code, tt.details)
+			}
+		})
+	}
+}
+
+func TestStubFCMMulticast(t *testing.T) {
+	srv, stub := newStubServer(t)
+	stub.fail(testToken(2), fcmError(http.StatusNotFound, "NOT_FOUND", "UNREGISTERED"))
+
+	body := fmt.Sprintf(`{"tokens":[%q,%q,%q],"notification":{"title":"T"}}`, testToken(1), testToken(2), testToken(3))
+	resp := post(t, srv, "/send", body)
+	var out api.MulticastResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out.SuccessCount != 2 || out.FailureCount != 1 || len(out.Failures) != 1 {
+		t.Fatalf("unexpected response %+v", out)
+	}
+	if f := out.Failures[0]; f.Index != 1 || f.Code != api.ErrCodeUnregistered {
+		t.Fatalf("failure %+v, want index 1 unregistered", f)
+	}
+	if n := len(stub.messages()); n != 3 {
+		t.Fatalf("stub received %d messages, want 3", n)
+	}
+}
+
+func TestStubFCMReadyzReportsEmulator(t *testing.T) {
+	srv, stub := newStubServer(t)
+
+	resp, err := http.Get(srv.URL + "/readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var out map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out["emulator"] != true || out["fcm_endpoint"] != stub.URL {
+		t.Fatalf("readyz %v, want emulator mode with the stub's URL", out)
+	}
+}
+
+// The webpush block reaches FCM as the notification the service worker
+// shows, data included.
+func TestStubFCMWebpush(t *testing.T) {
+	srv, stub := newStubServer(t)
+
+	body := fmt.Sprintf(`{"token":%q,"notification":{"title":"T"},"data":{"thread":"42"},"webpush":{"actions":[{"action":"reply","title":"Reply"}],"require_interaction":true,"vibrate":[200,100]}}`, testToken(1))
+	if resp := post(t, srv, "/send", body); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusAccepted)
+	}
+	got := stub.messages()
+	if len(got) != 1 {
+		t.Fatalf("stub received %d messages, want 1", len(got))
+	}
+	webpush, _ := got[0]["webpush"].(map[string]any)
+	want := map[string]any{
+		"actions":            []any{map[string]any{"action": "reply", "title": "Reply"}},
+		"data":               map[string]any{"thread": "42"},
+		"requireInteraction": true,
+		"vibrate":            []any{200.0, 100.0},
+	}
+	if !reflect.DeepEqual(webpush["notification"], want) {
+		t.Fatalf("webpush notification %v, want %v", webpush["notification"], want)
+	}
+}
+
+// deadLetters collects what an FCMClient dead-letters.
+type deadLetters struct {
+	mu      sync.Mutex
+	letters []DeadLetter
+}
+
+func (d *deadLetters) WriteDeadLetter(l DeadLetter) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.letters = append(d.letters, l)
+	return nil
+}
+
+// A boosted resend that gets through leaves nothing to replay; one that
+// fails too is dead-lettered once.
+func TestBoostDeadLettersOnlyTheFinalFailure(t *testing.T) {
+	tests := []struct {
+		name        string
+		failures    int
+		wantErr     bool
+		wantLetters int
+	}{
+		{"boost delivers", 1, false, 0},
+		{"boost fails too", 2, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newFCMStub(t)
+			inner, err := newMessagingClient(context.Background(), FirebaseProject{ID: "stub-project"}, stub.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stub.failTimes(testToken(1), tt.failures, fcmError(http.StatusInternalServerError, "INTERNAL", "INTERNAL"))
+			sink := &deadLetters{}
+			client := NewFCMClient(inner, nil, nil, fcmRetries{}, nil, sink)
+
+			message := &messaging.Message{Token: testToken(1), Notification: &messaging.Notification{Title: "T"}}
+			_, err = client.Send(withBoost(context.Background(), true), message)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Send error %v, want error %v", err, tt.wantErr)
+			}
+			got := stub.messages()
+			if len(got) != 2 {
+				t.Fatalf("stub received %d messages, want the first attempt and the boost", len(got))
+			}
+			if android, _ := got[1]["android"].(map[string]any); android["priority"] != "high" {
+				t.Fatalf("boosted message has android %v, want high priority", got[1]["android"])
+			}
+			if len(sink.letters) != tt.wantLetters {
+				t.Fatalf("%d dead letters, want %d", len(sink.letters), tt.wantLetters)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GzipMiddleware compresses responses of at least minSize bytes for clients
+// that accept gzip. Smaller responses are sent as is, since compressing them
+// costs more than it saves.
+func GzipMiddleware(minSize int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodHead || !strings.Contains(c.GetHeader("Accept-Encoding"), "gzip") {
+			c.Next()
+			return
+		}
+		w := &gzipWriter{ResponseWriter: c.Writer, minSize: minSize}
+		c.Writer = w
+		c.Header("Vary", "Accept-Encoding")
+		c.Next()
+		w.close()
+	}
+}
+
+// gzipWriter buffers the start of a response until it knows whether the
+// response is large enough to compress.
+type gzipWriter struct {
+	gin.ResponseWriter
+	minSize int
+	buf     bytes.Buffer
+	gz      *gzip.Writer
+	// raw is set once buffered bytes went out uncompressed, after a flush.
+	raw bool
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+	switch {
+	case w.gz != nil:
+		return w.gz.Write(b)
+	case w.raw:
+		return w.ResponseWriter.Write(b)
+	}
+	w.buf.Write(b)
+	if w.buf.Len() >= w.minSize && w.Header().Get("Content-Encoding") == "" {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Del("Content-Length")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+		if _, err := w.gz.Write(w.buf.Bytes()); err != nil {
+			return 0, err
+		}
+		w.buf.Reset()
+	}
+	return len(b), nil
+}
+
+func (w *gzipWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Flush sends what is buffered. A response that is not being compressed by
+// then stays uncompressed.
+func (w *gzipWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	} else if !w.raw {
+		w.raw = true
+		w.ResponseWriter.Write(w.buf.Bytes())
+		w.buf.Reset()
+	}
+	w.ResponseWriter.Flush()
+}
+
+func (w *gzipWriter) close() {
+	if w.gz != nil {
+		w.gz.Close()
+		return
+	}
+	if w.buf.Len() > 0 {
+		w.ResponseWriter.Write(w.buf.Bytes())
+	}
+}
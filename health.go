@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/baakel/go_fcm/api"
+)
+
+const (
+	// upstreamWindow is how many recent FCM outcomes the health ratio
+	// covers.
+	upstreamWindow = 100
+	// upstreamMinSamples keeps a handful of early failures from marking a
+	// freshly started relay degraded.
+	upstreamMinSamples = 10
+	// upstreamDegradedRatio is the success ratio below which FCM counts as
+	// degraded.
+	upstreamDegradedRatio = 0.5
+)
+
+// UpstreamHealth tracks FCM's server side health from the outcomes of the
+// last upstreamWindow calls. Only outage errors (unavailable, internal) and
+// timeouts count against it; a rejected message says nothing about FCM
+// itself. The circuit breaker opens on the same signal.
+type UpstreamHealth struct {
+	mu      sync.Mutex
+	results [upstreamWindow]bool // true for an outage error
+	next    int
+	count   int
+	outages int
+}
+
+// isOutage reports whether err means FCM itself is failing.
+func isOutage(err error) bool {
+	code := fcmErrorCode(err)
+	return code == api.ErrCodeUnavailable || code == api.ErrCodeInternal
+}
+
+// upstreamFailure reports whether err counts against FCM's health.
+func upstreamFailure(err error) bool {
+	return err != nil && (isOutage(err) || errors.Is(err, context.DeadlineExceeded))
+}
+
+func (h *UpstreamHealth) ObserveFCM(_ string, err error) {
+	outage := upstreamFailure(err)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.count == upstreamWindow {
+		if h.results[h.next] {
+			h.outages--
+		}
+	} else {
+		h.count++
+	}
+	h.results[h.next] = outage
+	if outage {
+		h.outages++
+	}
+	h.next = (h.next + 1) % upstreamWindow
+}
+
+// status returns the success ratio of the recent calls, 1 when there were
+// none, and whether FCM counts as degraded.
+func (h *UpstreamHealth) status() (ratio float64, degraded bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.count == 0 {
+		return 1, false
+	}
+	ratio = 1 - float64(h.outages)/float64(h.count)
+	return ratio, h.count >= upstreamMinSamples && ratio < upstreamDegradedRatio
+}
+
+// reset forgets the recorded outcomes, once a successful call proved FCM
+// is back and the old ones no longer describe it.
+func (h *UpstreamHealth) reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.results, h.next, h.count, h.outages = [upstreamWindow]bool{}, 0, 0, 0
+}
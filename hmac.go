@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/baakel/go_fcm/api"
+	"github.com/gin-gonic/gin"
+)
+
+// HMACVerifier authenticates requests signed with an API key instead of
+// carrying it:
+//
+//	Authorization: HMAC <key id>:<hex signature>
+//	X-Timestamp:   <unix seconds>
+//	X-Nonce:       <unique per request>
+//
+// The signature is HMAC-SHA256, keyed with the API key, over
+// timestamp, nonce, method, request URI and the hex SHA-256 of the body,
+// joined by newlines. The key id is the one reported in the audit log.
+type HMACVerifier struct {
+	maxSkew time.Duration
+	maxBody int64
+	nonces  *nonceCache
+}
+
+func NewHMACVerifier(c HMACConfig) *HMACVerifier {
+	if !c.Enabled {
+		return nil
+	}
+	// A nonce only has to be remembered for as long as its timestamp would
+	// still be accepted, on either side of now.
+	return &HMACVerifier{
+		maxSkew: c.MaxSkew,
+		maxBody: int64(c.MaxBodyBytes),
+		nonces:  newNonceCache(c.NonceCacheSize, 2*c.MaxSkew),
+	}
+}
+
+type hmacError struct {
+	code string
+	msg  string
+	// retryAfter is set when the request may be retried as is, which is
+	// answered with 503 rather than 401.
+	retryAfter time.Duration
+	// status replaces 401 when set.
+	status int
+}
+
+func (e *hmacError) Error() string { return e.msg }
+
+// verify checks the signature of c and returns the API key it was made with.
+// keyIDs maps key IDs to the currently accepted keys.
+func (v *HMACVerifier) verify(c *gin.Context, authHeader string, keyIDs map[string]string) (string, error) {
+	id, sig, ok := strings.Cut(strings.TrimPrefix(authHeader, "HMAC "), ":")
+	key, known := keyIDs[id]
+	if !ok || !known {
+		return "", &hmacError{code: api.ErrCodeBadSignature, msg: "Unauthorized: unknown key or malformed signature"}
+	}
+
+	ts, err := strconv.ParseInt(c.GetHeader("X-Timestamp"), 10, 64)
+	if err != nil {
+		return "", &hmacError{code: api.ErrCodeStaleRequest, msg: "Unauthorized: missing or invalid X-Timestamp"}
+	}
+	if skew := time.Since(time.Unix(ts, 0)).Abs(); skew > v.maxSkew {
+		return "", &hmacError{code: api.ErrCodeStaleRequest, msg: fmt.Sprintf("Unauthorized: timestamp outside the allowed %s skew", v.maxSkew)}
+	}
+	nonce := c.GetHeader("X-Nonce")
+	if nonce == "" {
+		return "", &hmacError{code: api.ErrCodeBadSignature, msg: "Unauthorized: missing X-Nonce"}
+	}
+
+	// The body is hashed before the signature can be checked, so cap what an
+	// unauthenticated client can make us buffer.
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, v.maxBody))
+	if tooLarge := (*http.MaxBytesError)(nil); errors.As(err, &tooLarge) {
+		return "", &hmacError{code: api.ErrCodeBodyTooLarge, msg: fmt.Sprintf("request body over %d bytes", v.maxBody), status: http.StatusRequestEntityTooLarge}
+	}
+	if err != nil {
+		return "", errors.New("reading request body")
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	bodySum := sha256.Sum256(body)
+
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%d\n%s\n%s\n%s\n%s", ts, nonce, c.Request.Method, c.Request.URL.RequestURI(), hex.EncodeToString(bodySum[:]))
+	want := mac.Sum(nil)
+	got, err := hex.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, want) {
+		return "", &hmacError{code: api.ErrCodeBadSignature, msg: "Unauthorized: signature mismatch"}
+	}
+
+	// Only remember nonces of correctly signed requests, so forged requests
+	// can't burn nonces of legitimate clients.
+	fresh, wait := v.nonces.add(id + ":" + nonce)
+	if wait > 0 {
+		return "", &hmacError{code: api.ErrCodeNonceCacheFull, msg: "too many signed requests, retry later", retryAfter: wait}
+	}
+	if !fresh {
+		return "", &hmacError{code: api.ErrCodeNonceReused, msg: "Unauthorized: nonce already used"}
+	}
+	return key, nil
+}
+
+// nonceCache remembers nonces for ttl, holding at most size of them. A
+// nonce is never forgotten while its request could still be replayed, so
+// when the cache is full of live nonces new ones are refused instead.
+type nonceCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type nonceEntry struct {
+	nonce string
+	seen  time.Time
+}
+
+func newNonceCache(size int, ttl time.Duration) *nonceCache {
+	return &nonceCache{size: size, ttl: ttl, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+// add records nonce and reports whether it was unseen. When the cache is
+// full it records nothing and returns how long until the oldest nonce
+// expires.
+func (n *nonceCache) add(nonce string) (bool, time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := time.Now()
+	for e := n.order.Front(); e != nil; e = n.order.Front() {
+		if now.Sub(e.Value.(*nonceEntry).seen) < n.ttl {
+			break
+		}
+		delete(n.entries, e.Value.(*nonceEntry).nonce)
+		n.order.Remove(e)
+	}
+
+	if _, seen := n.entries[nonce]; seen {
+		return false, 0
+	}
+	if n.order.Len() >= n.size {
+		oldest := n.order.Front().Value.(*nonceEntry)
+		return false, max(n.ttl-now.Sub(oldest.seen), time.Second)
+	}
+	n.entries[nonce] = n.order.PushBack(&nonceEntry{nonce: nonce, seen: now})
+	return true, 0
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baakel/go_fcm/api"
+	"github.com/gin-gonic/gin"
+)
+
+// signedContext returns a gin context for a request signed with key, as a
+// client following the HMACVerifier docs would send it.
+func signedContext(key, keyID, nonce string, ts time.Time, body string) *gin.Context {
+	sum := sha256.Sum256([]byte(body))
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%d\n%s\n%s\n%s\n%s", ts.Unix(), nonce, http.MethodPost, "/publish", hex.EncodeToString(sum[:]))
+
+	req := httptest.NewRequest(http.MethodPost, "/publish", strings.NewReader(body))
+	req.Header.Set("Authorization", "HMAC "+keyID+":"+hex.EncodeToString(mac.Sum(nil)))
+	req.Header.Set("X-Timestamp", strconv.FormatInt(ts.Unix(), 10))
+	req.Header.Set("X-Nonce", nonce)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = req
+	return c
+}
+
+func hmacCode(err error) string {
+	var herr *hmacError
+	if errors.As(err, &herr) {
+		return herr.code
+	}
+	return ""
+}
+
+func TestHMACRejectsReplayedNonce(t *testing.T) {
+	v := NewHMACVerifier(HMACConfig{Enabled: true, MaxSkew: time.Minute, NonceCacheSize: 10, MaxBodyBytes: 1 << 10})
+	keys := map[string]string{"k1": "secret"}
+	now := time.Now()
+
+	c := signedContext("secret", "k1", "n1", now, `{"to":"x"}`)
+	if _, err := v.verify(c, c.GetHeader("Authorization"), keys); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	c = signedContext("secret", "k1", "n1", now, `{"to":"x"}`)
+	if _, err := v.verify(c, c.GetHeader("Authorization"), keys); hmacCode(err) != api.ErrCodeNonceReused {
+		t.Fatalf("replayed request: got %v, want %s", err, api.ErrCodeNonceReused)
+	}
+}
+
+func TestHMACForgedRequestDoesNotBurnNonce(t *testing.T) {
+	v := NewHMACVerifier(HMACConfig{Enabled: true, MaxSkew: time.Minute, NonceCacheSize: 10, MaxBodyBytes: 1 << 10})
+	keys := map[string]string{"k1": "secret"}
+	now := time.Now()
+
+	c := signedContext("wrong", "k1", "n1", now, "{}")
+	if _, err := v.verify(c, c.GetHeader("Authorization"), keys); hmacCode(err) != api.ErrCodeBadSignature {
+		t.Fatalf("forged request: got %v, want %s", err, api.ErrCodeBadSignature)
+	}
+	c = signedContext("secret", "k1", "n1", now, "{}")
+	if _, err := v.verify(c, c.GetHeader("Authorization"), keys); err != nil {
+		t.Fatalf("genuine request after forgery: %v", err)
+	}
+}
+
+func TestHMACRejectsOversizeBody(t *testing.T) {
+	v := NewHMACVerifier(HMACConfig{Enabled: true, MaxSkew: time.Minute, NonceCacheSize: 10, MaxBodyBytes: 16})
+	keys := map[string]string{"k1": "secret"}
+	now := time.Now()
+
+	c := signedContext("secret", "k1", "n1", now, strings.Repeat("x", 17))
+	_, err := v.verify(c, c.GetHeader("Authorization"), keys)
+	var herr *hmacError
+	if !errors.As(err, &herr) || herr.code != api.ErrCodeBodyTooLarge || herr.status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("oversize request: got %v, want %s with 413", err, api.ErrCodeBodyTooLarge)
+	}
+	c = signedContext("secret", "k1", "n2", now, strings.Repeat("x", 16))
+	if _, err := v.verify(c, c.GetHeader("Authorization"), keys); err != nil {
+		t.Fatalf("request at the limit: %v", err)
+	}
+}
+
+func TestHMACFullNonceCacheFailsClosed(t *testing.T) {
+	v := NewHMACVerifier(HMACConfig{Enabled: true, MaxSkew: time.Minute, NonceCacheSize: 2, MaxBodyBytes: 1 << 10})
+	keys := map[string]string{"k1": "secret"}
+	now := time.Now()
+
+	for _, nonce := range []string{"n1", "n2"} {
+		c := signedContext("secret", "k1", nonce, now, "{}")
+		if _, err := v.verify(c, c.GetHeader("Authorization"), keys); err != nil {
+			t.Fatalf("request %s: %v", nonce, err)
+		}
+	}
+	c := signedContext("secret", "k1", "n3", now, "{}")
+	_, err := v.verify(c, c.GetHeader("Authorization"), keys)
+	var herr *hmacError
+	if !errors.As(err, &herr) || herr.code != api.ErrCodeNonceCacheFull || herr.retryAfter <= 0 {
+		t.Fatalf("request over capacity: got %v, want %s with a retry delay", err, api.ErrCodeNonceCacheFull)
+	}
+	// n1 must still be remembered, or its request could be replayed now.
+	c = signedContext("secret", "k1", "n1", now, "{}")
+	if _, err := v.verify(c, c.GetHeader("Authorization"), keys); hmacCode(err) != api.ErrCodeNonceReused {
+		t.Fatalf("replay while full: got %v, want %s", err, api.ErrCodeNonceReused)
+	}
+}
+
+func TestNonceCacheForgetsExpiredNonces(t *testing.T) {
+	n := newNonceCache(1, 10*time.Millisecond)
+	if fresh, _ := n.add("a"); !fresh {
+		t.Fatal("first add of a was not fresh")
+	}
+	if _, wait := n.add("b"); wait <= 0 {
+		t.Fatal("add to a full cache of live nonces was accepted")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if fresh, wait := n.add("b"); !fresh || wait != 0 {
+		t.Fatalf("add after expiry: fresh %v, wait %s", fresh, wait)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// startServer runs srv on a loopback port until the test ends and returns
+// the address. serve is srv.Serve or a wrapper of srv.ServeTLS.
+func startServer(t *testing.T, srv *http.Server, serve func(net.Listener) error) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serve(l)
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+	return l.Addr().String()
+}
+
+// h2cClient speaks HTTP/2 over cleartext with prior knowledge: HTTP/2
+// frames from the first byte, no upgrade.
+func h2cClient() *http.Client {
+	return &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+}
+
+func TestH2CPriorKnowledge(t *testing.T) {
+	cfg, _, router := newTestRouter(t, &fakeMessenger{}, func(c *Config) { c.HTTP2.H2C = true })
+	srv := newServer(cfg, "127.0.0.1:0", router)
+	addr := startServer(t, srv, srv.Serve)
+
+	client := h2cClient()
+
+	resp, err := client.Get("http://" + addr + "/readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+		t.Fatalf("readyz: status %d over %s, want 200 over HTTP/2", resp.StatusCode, resp.Proto)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, "http://"+addr+"/publish", strings.NewReader(publishBody(testToken(1))))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted || resp.ProtoMajor != 2 {
+		t.Fatalf("publish: status %d over %s, want 202 over HTTP/2", resp.StatusCode, resp.Proto)
+	}
+}
+
+// Without h2c the plaintext listener speaks HTTP/1.1 only.
+func TestH2CDisabled(t *testing.T) {
+	cfg, _, router := newTestRouter(t, &fakeMessenger{})
+	srv := newServer(cfg, "127.0.0.1:0", router)
+	addr := startServer(t, srv, srv.Serve)
+
+	client := h2cClient()
+	if resp, err := client.Get("http://" + addr + "/readyz"); err == nil {
+		resp.Body.Close()
+		t.Fatalf("got %s over prior knowledge HTTP/2 with h2c disabled", resp.Proto)
+	}
+}
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and its key
+// as PEM files, and returns their paths and a pool trusting it.
+func writeTestCert(t *testing.T) (certFile, keyFile string, roots *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "relay test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots = x509.NewCertPool()
+	roots.AddCert(cert)
+	return certFile, keyFile, roots
+}
+
+func TestTLSNegotiatesHTTP2(t *testing.T) {
+	certFile, keyFile, roots := writeTestCert(t)
+	cfg, _, router := newTestRouter(t, &fakeMessenger{}, func(c *Config) {
+		c.TLS = TLSConfig{CertFile: certFile, KeyFile: keyFile}
+	})
+	srv := newServer(cfg, "127.0.0.1:0", router)
+	addr := startServer(t, srv, func(l net.Listener) error { return srv.ServeTLS(l, certFile, keyFile) })
+
+	// A stock client, which offers h2 and http/1.1 over ALPN.
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots},
+		ForceAttemptHTTP2: true,
+	}}
+	req, _ := http.NewRequest(http.MethodPost, "https://"+addr+"/publish", strings.NewReader(publishBody(testToken(1))))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusAccepted)
+	}
+	if resp.TLS == nil || resp.TLS.NegotiatedProtocol != "h2" || resp.ProtoMajor != 2 {
+		t.Fatalf("served over %s, TLS state %+v; want HTTP/2 negotiated as h2", resp.Proto, resp.TLS)
+	}
+}
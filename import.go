@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/baakel/go_fcm/api"
+	"github.com/gin-gonic/gin"
+)
+
+// importMaxPending bounds the tokens an import holds while it groups them by
+// topic. Past it the batch waiting longest is sent even if not yet full.
+const importMaxPending = 100 * maxTopicBatch
+
+// importBatch is the tokens of one topic waiting to be subscribed.
+type importBatch struct {
+	topic     string
+	tokens    []string
+	firstLine int
+}
+
+// ImportSubscriptions subscribes the token/topic pairs of an NDJSON body,
+// one {"token", "topic"} object per line. Pairs are grouped by topic into
+// calls of up to maxTopicBatch tokens, paced by the import rate, and a
+// progress record is streamed back after every call. Each record's line is
+// the last input line everything up to which was handled; an interrupted
+// import resumes by sending the same body with start_line set past it.
+func ImportSubscriptions(c *gin.Context) {
+	appState, _ := c.Get("state")
+	state := appState.(*AppState)
+	startLine := 1
+	if v := c.Query("start_line"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			c.JSON(http.StatusBadRequest, api.ErrorResponse{Error: "start_line must be a positive line number"})
+			return
+		}
+		startLine = n
+	}
+	client := state.clientFor(c, c.Query("project"))
+	if client == nil {
+		return
+	}
+
+	// An import of millions of pairs outlives the server's read and write
+	// timeouts, which are meant for ordinary requests.
+	rc := http.NewResponseController(c.Writer)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(http.StatusOK)
+	enc := json.NewEncoder(c.Writer)
+	emit := func(p api.ImportProgress) {
+		enc.Encode(p)
+		c.Writer.Flush()
+	}
+
+	pending := map[string]*importBatch{}
+	var held, line int
+	// done is the line up to which every pair was either sent or rejected.
+	done := func() int {
+		safe := line
+		for _, b := range pending {
+			safe = min(safe, b.firstLine-1)
+		}
+		return safe
+	}
+	var total api.ImportProgress
+	// flush subscribes a batch. On failure it reports the line to resume
+	// from, which the still pending batch keeps before its first line.
+	flush := func(b *importBatch) bool {
+		if err := state.ImportLimiter.Wait(c); err != nil {
+			emit(api.ImportProgress{Topic: b.topic, Line: done(), Error: err.Error()})
+			return false
+		}
+		resp, err := state.manageTopic(c, client.SubscribeToTopic, b.tokens, b.topic)
+		state.Audit.recordTopic(c, "subscribe", b.topic, len(b.tokens), resp, err)
+		if err != nil {
+			requestLog(c).Error("error importing subscriptions", "topic", b.topic, "error", err)
+			emit(api.ImportProgress{Topic: b.topic, Line: done(), Error: err.Error()})
+			return false
+		}
+		delete(pending, b.topic)
+		held -= len(b.tokens)
+		total.Processed += resp.SuccessCount
+		total.Failed += resp.FailureCount
+		emit(api.ImportProgress{Topic: b.topic, Processed: resp.SuccessCount, Failed: resp.FailureCount, Line: done()})
+		return true
+	}
+	oldest := func() *importBatch {
+		var o *importBatch
+		for _, b := range pending {
+			if o == nil || b.firstLine < o.firstLine {
+				o = b
+			}
+		}
+		return o
+	}
+
+	scanner := bufio.NewScanner(c.Request.Body)
+	for scanner.Scan() {
+		line++
+		if line < startLine || len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var pair struct {
+			Token string `json:"token"`
+			Topic string `json:"topic"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &pair); err != nil || !validToken(pair.Token) || !topicPattern.MatchString(pair.Topic) {
+			total.Failed++
+			emit(api.ImportProgress{Failed: 1, Line: done(), Error: fmt.Sprintf("line %d is not a valid token/topic pair", line)})
+			continue
+		}
+		topic := canonicalTopic(pair.Topic)
+		b, ok := pending[topic]
+		if !ok {
+			b = &importBatch{topic: topic, firstLine: line}
+			pending[topic] = b
+		}
+		b.tokens = append(b.tokens, state.normalizeToken(pair.Token))
+		held++
+		if len(b.tokens) == maxTopicBatch && !flush(b) {
+			return
+		}
+		if held > importMaxPending && !flush(oldest()) {
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		emit(api.ImportProgress{Line: done(), Error: fmt.Sprintf("reading body: %s", err)})
+		return
+	}
+	for len(pending) > 0 {
+		if !flush(oldest()) {
+			return
+		}
+	}
+	total.Line, total.Done = line, true
+	requestLog(c).Info("imported subscriptions", "lines", line, "processed", total.Processed, "failed", total.Failed)
+	emit(total)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/MicahParks/keyfunc"
+	"github.com/charmbracelet/log"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// jwtMethods are the signing algorithms accepted. Symmetric ones are left
+// out: a public key must never double as an HMAC secret.
+var jwtMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// jwtAuthenticator verifies bearer tokens as JWTs signed by the identity
+// provider, with either a fixed public key or the keys of a JWKS URL. The
+// tenant and the allowed projects are read from configurable claims, and a
+// "debug" scope grants the debug scope. Tokens that are not JWTs at all go
+// to fallback, when set.
+type jwtAuthenticator struct {
+	config   JWTConfig
+	keyFunc  jwt.Keyfunc
+	parser   *jwt.Parser
+	fallback Authenticator
+}
+
+func newJWTAuthenticator(c JWTConfig, fallback Authenticator) (*jwtAuthenticator, error) {
+	a := &jwtAuthenticator{config: c, parser: jwt.NewParser(jwt.WithValidMethods(jwtMethods))}
+	if c.FallbackStatic {
+		a.fallback = fallback
+	}
+	if c.PublicKeyFile != "" {
+		raw, err := os.ReadFile(c.PublicKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading JWT public key: %w", err)
+		}
+		key, err := parsePublicKey(raw)
+		if err != nil {
+			return nil, fmt.Errorf("parsing JWT public key: %w", err)
+		}
+		a.keyFunc = func(*jwt.Token) (any, error) { return key, nil }
+		return a, nil
+	}
+	jwks, err := keyfunc.Get(c.JWKSURL, keyfunc.Options{
+		RefreshInterval:   c.JWKSRefresh,
+		RefreshRateLimit:  time.Minute,
+		RefreshTimeout:    10 * time.Second,
+		RefreshUnknownKID: true,
+		RefreshErrorHandler: func(err error) {
+			log.Error("error refreshing JWKS", "url", c.JWKSURL, "error", err)
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fetching JWKS: %w", err)
+	}
+	a.keyFunc = jwks.Keyfunc
+	return a, nil
+}
+
+// parsePublicKey reads a PEM encoded RSA, ECDSA or Ed25519 public key.
+func parsePublicKey(raw []byte) (any, error) {
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(raw); err == nil {
+		return key, nil
+	}
+	if key, err := jwt.ParseECPublicKeyFromPEM(raw); err == nil {
+		return key, nil
+	}
+	return jwt.ParseEdPublicKeyFromPEM(raw)
+}
+
+func (a *jwtAuthenticator) Authenticate(ctx context.Context, token string) (*APIKey, error) {
+	claims := jwt.MapClaims{}
+	_, err := a.parser.ParseWithClaims(token, claims, a.keyFunc)
+	var verr *jwt.ValidationError
+	if errors.As(err, &verr) && verr.Errors&jwt.ValidationErrorMalformed != 0 && a.fallback != nil {
+		return a.fallback.Authenticate(ctx, token)
+	}
+	if err != nil {
+		return nil, errUnknownCredential
+	}
+	// Valid only checks exp when present; short-lived tokens must carry it.
+	if _, ok := claims["exp"]; !ok {
+		return nil, errUnknownCredential
+	}
+	if !claims.VerifyIssuer(a.config.Issuer, true) || !claims.VerifyAudience(a.config.Audience, true) {
+		return nil, errUnknownCredential
+	}
+	tenant, _ := claims[a.config.TenantClaim].(string)
+	if tenant == "" {
+		return nil, errUnknownCredential
+	}
+	return withProjects(&APIKey{
+		Tenant:   tenant,
+		Projects: claimList(claims[a.config.ProjectsClaim]),
+		Debug:    slices.Contains(claimList(claims["scope"]), "debug"),
+	})
+}
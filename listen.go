@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+)
+
+// unixPrefix marks a listen address as a unix socket path.
+const unixPrefix = "unix:"
+
+// listen opens addr, either host:port or unix:/path/to.sock. A stale socket
+// file from an unclean exit is removed first; the listener removes the file
+// again when the server shuts down.
+func listen(addr string, mode fs.FileMode) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, unixPrefix)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("removing stale socket: %w", err)
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("setting socket mode: %w", err)
+	}
+	return l, nil
+}
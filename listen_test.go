@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnixSocketListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "relay.sock")
+	// A socket file left behind by an unclean exit.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	fake := &fakeMessenger{}
+	addr := unixPrefix + path
+	cfg, _, router := newTestRouter(t, fake, func(c *Config) { c.ListenAddr = addr })
+	l, err := listen(addr, cfg.socketMode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o660 {
+		t.Errorf("socket mode %v, want 0660", fi.Mode().Perm())
+	}
+
+	srv := newServer(cfg, addr, router)
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	req, _ := http.NewRequest(http.MethodPost, "http://relay/publish", strings.NewReader(publishBody(testToken(1))))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusAccepted)
+	}
+	if len(fake.messages()) != 1 {
+		t.Fatalf("FCM got %d messages, want 1", len(fake.messages()))
+	}
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		t.Fatalf("serve: %v", err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("socket file left after shutdown: %v", err)
+	}
+}
+
+func TestUnixSocketListenerKeepsOtherFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "relay.sock")
+	if err := os.WriteFile(path, []byte("not a socket"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listen(unixPrefix+path, 0o660); err == nil {
+		t.Fatal("listened over a regular file")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("regular file was removed: %v", err)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+const backupTimeFormat = "20060102T150405.000"
+
+// rotatingFile is an io.Writer appending to a log file that is rotated once
+// it grows past maxSize. Rotated files are renamed with a timestamp suffix
+// and pruned by count and age.
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	maxAge     time.Duration
+
+	file *os.File
+	size int64
+}
+
+func newRotatingFile(c LogConfig) (*rotatingFile, error) {
+	r := &rotatingFile{
+		path:       c.File,
+		maxSize:    int64(c.MaxSizeMB) * 1024 * 1024,
+		maxBackups: c.MaxBackups,
+		maxAge:     time.Duration(c.MaxAgeDays) * 24 * time.Hour,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening log file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("opening log file: %w", err)
+	}
+	r.file, r.size = f, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.maxSize > 0 && r.size+int64(len(p)) > r.maxSize && r.size > 0 {
+		if err := r.rotate(); err != nil {
+			fmt.Fprintln(os.Stderr, "log rotation failed:", err)
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Reopen closes and reopens the file at the same path, for use after an
+// external tool such as logrotate moved it away.
+func (r *rotatingFile) Reopen() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.file.Close()
+	return r.open()
+}
+
+func (r *rotatingFile) rotate() error {
+	r.file.Close()
+	backup := r.path + "." + time.Now().Format(backupTimeFormat)
+	if err := os.Rename(r.path, backup); err != nil {
+		return err
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	r.prune()
+	return nil
+}
+
+func (r *rotatingFile) prune() {
+	backups, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return
+	}
+	// The timestamp suffix sorts chronologically, newest last.
+	sort.Strings(backups)
+	cutoff := time.Now().Add(-r.maxAge)
+	for i, b := range backups {
+		tooMany := r.maxBackups > 0 && i < len(backups)-r.maxBackups
+		tooOld := false
+		if r.maxAge > 0 {
+			ts, err := time.Parse(backupTimeFormat, strings.TrimPrefix(b, r.path+"."))
+			tooOld = err == nil && ts.Before(cutoff)
+		}
+		if tooMany || tooOld {
+			os.Remove(b)
+		}
+	}
+}
+
+// logToStderr is false while the default logger writes only to a file. fatal
+// uses it to make sure the reason the process died still reaches stderr.
+var logToStderr = true
+
+// setupLogOutput points the default logger at the configured file, if any,
+// and reopens it whenever the process gets SIGUSR1.
+func setupLogOutput(c LogConfig) error {
+	if c.File == "" {
+		return nil
+	}
+	rf, err := newRotatingFile(c)
+	if err != nil {
+		return err
+	}
+	if c.Tee {
+		log.SetOutput(teeWriter{rf, os.Stdout})
+	} else {
+		log.SetOutput(rf)
+		logToStderr = false
+	}
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	go func() {
+		for range ch {
+			if err := rf.Reopen(); err != nil {
+				fmt.Fprintln(os.Stderr, "reopening log file failed:", err)
+				continue
+			}
+			log.Info("reopened log file", "path", c.File)
+		}
+	}()
+	return nil
+}
+
+type teeWriter struct {
+	file   *rotatingFile
+	stdout *os.File
+}
+
+func (t teeWriter) Write(p []byte) (int, error) {
+	t.stdout.Write(p)
+	return t.file.Write(p)
+}
+
+// fatal logs msg and exits, echoing it to stderr when the default logger only
+// writes to a file.
+func fatal(msg string, keyvals ...interface{}) {
+	if !logToStderr {
+		log.New(os.Stderr).Error(msg, keyvals...)
+	}
+	log.Fatal(msg, keyvals...)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/charmbracelet/log"
+)
+
+func applyLogConfig(c LogConfig) error {
+	level, err := log.ParseLevel(c.Level)
+	if err != nil {
+		return fmt.Errorf("invalid log level %q: %w", c.Level, err)
+	}
+	log.SetLevel(level)
+
+	switch c.Format {
+	case "json":
+		log.SetFormatter(log.JSONFormatter)
+	case "logfmt":
+		log.SetFormatter(log.LogfmtFormatter)
+	default:
+		log.SetFormatter(log.TextFormatter)
+	}
+	return nil
+}
+
+// redactToken renders a device token for logs as a short stable hash plus its
+// last four characters, enough to correlate log lines without exposing the
+// token itself.
+func redactToken(token string) string {
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:4]) + "…" + token[max(0, len(token)-4):]
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/charmbracelet/log"
+	"github.com/gin-gonic/gin"
+)
+
+// logBuffer is a bytes.Buffer the server's goroutines can write to while
+// the test reads it.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// take returns what was written so far and empties the buffer.
+func (b *logBuffer) take() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	defer b.buf.Reset()
+	return b.buf.String()
+}
+
+// captureLogs sends the log and gin's request log to the returned buffer,
+// at debug level, until the test ends. Routers must be built after it.
+func captureLogs(t *testing.T) *logBuffer {
+	t.Helper()
+	buf := &logBuffer{}
+	prevWriter, prevLevel := gin.DefaultWriter, log.GetLevel()
+	log.SetOutput(buf)
+	log.SetLevel(log.DebugLevel)
+	gin.DefaultWriter = buf
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		log.SetLevel(prevLevel)
+		gin.DefaultWriter = prevWriter
+	})
+	return buf
+}
+
+func TestHandlersNeverLogFullTokens(t *testing.T) {
+	ok, failing, debug := testToken(1), testToken(2), testToken(3)
+	fake := &fakeMessenger{
+		failTokens:    map[string]error{failing: errors.New("requested entity was not found")},
+		topicFailures: map[string]string{failing: "NOT_FOUND"},
+	}
+	buf := captureLogs(t)
+	srv, _ := newTestServer(t, fake, func(c *Config) {
+		c.Log.Payloads = true
+		c.Debug.Token = debug
+	})
+
+	tests := []struct {
+		name, path, body string
+	}{
+		{"publish", "/publish", fmt.Sprintf(`{"to":%q,"notification":{"title":"T","body":"B"}}`, ok)},
+		{"publish failing", "/publish", fmt.Sprintf(`{"to":%q,"notification":{"title":"T"}}`, failing)},
+		{"send token", "/send", fmt.Sprintf(`{"token":%q,"notification":{"title":"T"}}`, ok)},
+		{"send token failing", "/send", fmt.Sprintf(`{"token":%q,"notification":{"title":"T"}}`, failing)},
+		{"send tokens", "/send", fmt.Sprintf(`{"tokens":[%q,%q],"notification":{"title":"T"}}`, ok, failing)},
+		{"send tokens all or nothing", "/send", fmt.Sprintf(`{"tokens":[%q,%q],"all_or_nothing":true}`, ok, failing)},
+		{"preview", "/preview", fmt.Sprintf(`{"to":%q,"notification":{"title":"T"}}`, ok)},
+		{"subscribe", "/subscribe", fmt.Sprintf(`{"tokens":[%q,%q],"topic":"news"}`, ok, failing)},
+		{"subscribe failing", "/subscribe", fmt.Sprintf(`{"tokens":[%q],"topic":"news"}`, failing)},
+		{"unsubscribe", "/unsubscribe", fmt.Sprintf(`{"tokens":[%q,%q],"topic":"news"}`, ok, failing)},
+		{"test", "/test", ""},
+		{"invalid token", "/publish", fmt.Sprintf(`{"to":"%s!","notification":{"title":"T"}}`, ok)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.take()
+			post(t, srv, tt.path, tt.body)
+			out := buf.take()
+			if out == "" {
+				t.Fatal("nothing was logged")
+			}
+			for _, token := range []string{ok, failing, debug} {
+				if strings.Contains(out, token) {
+					t.Errorf("log output contains the full token %s:\n%s", token, out)
+				}
+			}
+		})
+	}
+}
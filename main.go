@@ -1,72 +1,492 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"math"
 	"net/http"
 	"os"
+	"os/signal"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	firebase "firebase.google.com/go/v4"
 	"firebase.google.com/go/v4/messaging"
+	"github.com/baakel/go_fcm/api"
 	"github.com/charmbracelet/log"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/time/rate"
+	"google.golang.org/api/option"
 )
 
 type AppState struct {
-	MsgClient *messaging.Client
+	MsgClient Messenger
+	// Projects holds one client per configured Firebase project, keyed by
+	// project ID. MsgClient is the first of them.
+	Projects       map[string]Messenger
+	DefaultProject string
+	Audit          *AuditLog
+	Webhooks       *WebhookRegistry
+	Templates      *TemplateStore
+	TopicDefaults  *TopicDefaultsStore
+	Defaults       DefaultsConfig
+	// TokenStrip, when set, is removed from device tokens before they reach
+	// FCM.
+	TokenStrip  *regexp.Regexp
+	DeviceLimit *deviceLimiter
+	QuietHours  *quietHours
+	// DeadLetterFile is the dead letter sink when it is a file, which
+	// /admin/replay re-sends from.
+	DeadLetterFile *FileDeadLetterSink
+	QuotaQueue     *quotaQueue
+	Upstream       *UpstreamHealth
+	Dedup          *dedupCache
+	// SharedRateLimit counts requests for the rate limit across replicas.
+	// It is nil when the state is not shared, leaving the limit to the
+	// replica's own token bucket.
+	SharedRateLimit Store
+	Limiter         *inFlightLimiter
+	ImportLimiter   *rate.Limiter
+	Breaker         *circuitBreaker
+	Fanout          FanoutConfig
+	DebugToken      string
+	// Emulator is the FCM endpoint override, empty when talking to
+	// production.
+	Emulator string
+
+	settings atomic.Pointer[Settings]
 }
 
-type PublishInput struct {
-	Token        string       `json:"to"`
-	Notification Notification `json:"notification"`
+// Settings returns the current reloadable settings.
+func (s *AppState) Settings() *Settings {
+	return s.settings.Load()
 }
 
-type BroadCastInput struct {
-	Topic        string       `json:"topic"`
-	Notification Notification `json:"notification"`
+// normalizeToken removes the TokenStrip pattern from token.
+func (s *AppState) normalizeToken(token string) string {
+	if s.TokenStrip == nil {
+		return token
+	}
+	return s.TokenStrip.ReplaceAllString(token, "")
 }
 
-type Notification struct {
-	Title string `json:"title"`
-	Body  string `json:"body"`
+// normalizeTokens applies normalizeToken to tokens in place.
+func (s *AppState) normalizeTokens(tokens []string) {
+	for i, t := range tokens {
+		tokens[i] = s.normalizeToken(t)
+	}
 }
 
-type SubscribeInput struct {
-	Tokens []string `json:"tokens"`
-	Topic  string   `json:"topic"`
+// uniqueTokens drops repeated tokens, keeping the first occurrence of each,
+// and returns the result with the number removed.
+func uniqueTokens(tokens []string) ([]string, int) {
+	seen := make(map[string]bool, len(tokens))
+	unique := tokens[:0]
+	for _, t := range tokens {
+		if !seen[t] {
+			seen[t] = true
+			unique = append(unique, t)
+		}
+	}
+	return unique, len(tokens) - len(unique)
+}
+
+// fcmContext bounds a single FCM call by the configured timeout.
+func (s *AppState) fcmContext(parent context.Context) (context.Context, context.CancelFunc) {
+	timeout := s.Settings().FCMTimeout
+	if timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, timeout)
+}
+
+// loadEnv reads .env.<APP_ENV> when APP_ENV is set, then .env. Variables
+// already set win over both files, and the environment's file over .env. It
+// is fatal only when no file could be read at all.
+func loadEnv() {
+	var files []string
+	if env := os.Getenv("APP_ENV"); env != "" {
+		files = append(files, ".env."+env)
+	}
+	files = append(files, ".env")
+	var loaded []string
+	var lastErr error
+	for _, f := range files {
+		if err := godotenv.Load(f); err != nil {
+			if !os.IsNotExist(err) {
+				log.Fatal("Cannot read env file", "file", f, "error", err)
+			}
+			lastErr = err
+			continue
+		}
+		loaded = append(loaded, f)
+	}
+	if len(loaded) == 0 {
+		log.Fatal("Cannot read .env file", "error", lastErr)
+	}
+	log.Info("loaded env files", "files", loaded)
 }
 
 func main() {
-	envErr := godotenv.Load()
-	if envErr != nil {
-		log.Fatal("Cannot read .env file", "error", envErr)
+	loadEnv()
+
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+
+	switch cmd {
+	case "serve":
+		serve(args)
+	case "send":
+		os.Exit(runSend(args))
+	case "subscribe", "unsubscribe":
+		os.Exit(runSubscribe(cmd, args))
+	case "smoketest":
+		os.Exit(runSmoketest(args))
+	case "help":
+		usage()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", cmd)
+		usage()
+		os.Exit(exitUsage)
+	}
+}
+
+func newMessagingClient(ctx context.Context, p FirebaseProject, endpoint string) (*messaging.Client, error) {
+	var opts []option.ClientOption
+	// The emulator takes no credentials, and the client library refuses
+	// credentials next to WithoutAuthentication.
+	if p.CredentialsFile != "" && endpoint == "" {
+		opts = append(opts, option.WithCredentialsFile(p.CredentialsFile))
+	}
+	projectID := p.ID
+	if endpoint != "" {
+		opts = append(opts,
+			option.WithEndpoint(endpoint),
+			option.WithoutAuthentication(),
+		)
+		if projectID == "" {
+			projectID = "demo-project"
+		}
+		log.Warn("using an FCM emulator, messages will not reach real devices", "endpoint", endpoint, "project", projectID)
+		log.Warn("topic management is not emulated and still targets production")
+	}
+
+	var conf *firebase.Config
+	if projectID != "" {
+		conf = &firebase.Config{ProjectID: projectID}
+	}
+	app, err := firebase.NewApp(ctx, conf, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error while starting app: %w", err)
 	}
-	app, err := firebase.NewApp(context.Background(), nil)
+	client, err := app.Messaging(ctx)
 	if err != nil {
-		log.Fatal("error while starting app", "error", err)
+		return nil, fmt.Errorf("error getting messaging client: %w", err)
 	}
+	return client, nil
+}
 
-	log.Info("started app")
+func serve(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML config file (env CONFIG_FILE)")
+	fs.Parse(args)
+
+	cfg, err := LoadConfig(*configFile)
+	if err != nil {
+		log.Fatal("Invalid configuration", "error", err)
+	}
+	if err := registerValidators(); err != nil {
+		log.Fatal("Error registering validators", "error", err)
+	}
+	if err := applyLogConfig(cfg.Log); err != nil {
+		log.Fatal("Invalid configuration", "error", err)
+	}
+	if err := setupLogOutput(cfg.Log); err != nil {
+		log.Fatal("Cannot open log file", "error", err)
+	}
+	log.Info("loaded configuration", "file", *configFile, "config", cfg)
 
 	ctx := context.Background()
-	client, err := app.Messaging(ctx)
+	settings, err := newSettings(cfg)
+	if err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	var tenants []string
+	for _, k := range settings.APIKeys {
+		if k.Tenant != "" && !slices.Contains(tenants, k.Tenant) {
+			tenants = append(tenants, k.Tenant)
+		}
+	}
+	slices.Sort(tenants)
+	log.Info("authentication", "api_keys", len(settings.APIKeys), "tenants", tenants, "hmac", cfg.Auth.HMAC.Enabled)
+	audit, err := NewAuditLog(cfg.Audit.File)
+	if err != nil {
+		fatal("Cannot open audit log", "error", err)
+	}
+	webhooks, err := NewWebhookRegistry(cfg.Webhooks, cfg.Retry.policy(cfg.Retry.Webhooks), audit)
+	if err != nil {
+		fatal("Cannot load webhooks", "error", err)
+	}
+	templates, err := NewTemplateStore(cfg.Templates.File)
+	if err != nil {
+		fatal("Cannot load templates", "error", err)
+	}
+	topicDefaults, err := NewTopicDefaultsStore(cfg.Topics.DefaultsFile)
+	if err != nil {
+		fatal("Cannot load topic defaults", "error", err)
+	}
+	stores, err := newStores(cfg.Store)
+	if err != nil {
+		fatal("Cannot set up the shared store", "error", err)
+	}
+	state := &AppState{Projects: map[string]Messenger{}, Audit: audit, Webhooks: webhooks, Templates: templates, TopicDefaults: topicDefaults, Defaults: cfg.Defaults, DebugToken: cfg.Debug.Token, Fanout: cfg.Fanout}
+	state.DeviceLimit = newDeviceLimiter(cfg.DeviceLimit, stores)
+	// Already validated with the rest of the configuration.
+	state.QuietHours, _ = newQuietHours(cfg.QuietHours)
+	state.Dedup = newDedupCache(cfg.Dedup, stores)
+	if stores.Shared() {
+		state.SharedRateLimit = stores.open("ratelimit", 4)
+	}
+	state.Emulator = cfg.Firebase.endpoint()
+	if cfg.Tokens.StripPattern != "" {
+		state.TokenStrip = regexp.MustCompile(cfg.Tokens.StripPattern)
+	}
+	state.settings.Store(settings)
+	state.Upstream = &UpstreamHealth{}
+	observers := []FCMObserver{state.Upstream}
+	if monitor := NewFailureMonitor(cfg.Alerting); monitor != nil {
+		observers = append(observers, monitor)
+	}
 
-	state := &AppState{MsgClient: client}
+	var deadLetters DeadLetterSink
+	if cfg.DeadLetter.File != "" {
+		sink, err := NewFileDeadLetterSink(cfg.DeadLetter.File)
+		if err != nil {
+			fatal("Cannot open dead letter file", "error", err)
+		}
+		deadLetters, state.DeadLetterFile = sink, sink
+	}
+
+	limiter := newInFlightLimiter(cfg.Concurrency)
+	state.Limiter = limiter
+	state.ImportLimiter = rate.NewLimiter(rate.Inf, 1)
+	if cfg.Topics.ImportRate > 0 {
+		state.ImportLimiter = rate.NewLimiter(rate.Limit(cfg.Topics.ImportRate), 1)
+	}
+	breaker := newCircuitBreaker(cfg.CircuitBreaker, state.Upstream)
+	state.Breaker = breaker
+	retries := newFCMRetries(cfg.Retry)
+	state.QuotaQueue = newQuotaQueue(cfg.QuotaQueue, cfg.Timeouts.FCM, deadLetters)
 
+	projects := cfg.Firebase.Projects
+	if len(projects) == 0 {
+		projects = []FirebaseProject{{}}
+	}
+	for _, p := range projects {
+		client, err := newMessagingClient(ctx, p, cfg.Firebase.endpoint())
+		if err != nil {
+			fatal("Error getting messaging client", "project", p.ID, "error", err)
+		}
+		reinit := newReinitClient(p.ID, client, cfg.Firebase.ReinitCooldown, func() (Messenger, error) {
+			return newMessagingClient(ctx, p, cfg.Firebase.endpoint())
+		})
+		wrapped := NewFCMClient(reinit, breaker, limiter, retries, state.QuotaQueue, deadLetters, observers...)
+		state.Projects[p.ID] = wrapped
+		if state.MsgClient == nil {
+			state.MsgClient, state.DefaultProject = wrapped, p.ID
+		}
+	}
+
+	log.Info("started app")
+
+	reporter, err := NewReporter(cfg.Reporting)
+	if err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+
+	reloader := NewReloader(*configFile, cfg, state)
+	reloader.WatchSIGHUP()
+
+	verifier := NewHMACVerifier(cfg.Auth.HMAC)
+	authenticator, err := newAuthenticator(cfg.Auth, state)
 	if err != nil {
-		log.Fatal("Error getting messaging client", "error", err)
+		fatal("Cannot set up authentication", "error", err)
+	}
+	router := newRouter(cfg, state, reporter, verifier, authenticator)
+	registerRoutes(router, state)
+
+	// Admin routes get their own listener when one is configured, and are
+	// then absent from the public one.
+	admin := router
+	if cfg.AdminListenAddr != "" {
+		admin = newRouter(cfg, state, reporter, verifier, authenticator)
+	}
+	admin.POST("/admin/reload", reloader.Handler)
+	admin.POST("/admin/replay", ReplayDeadLetters)
+	admin.GET("/audit/topics", audit.TopicHistory)
+	admin.GET("/stats", Stats)
+
+	servers := []*http.Server{newServer(cfg, cfg.ListenAddr, router)}
+	if admin != router {
+		servers = append(servers, newServer(cfg, cfg.AdminListenAddr, admin))
 	}
 
+	sigCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	for _, srv := range servers {
+		l, err := listen(srv.Addr, cfg.socketMode())
+		if err != nil {
+			fatal("Cannot listen", "addr", srv.Addr, "error", err)
+		}
+		go func() {
+			log.Info("listening", "addr", srv.Addr, "tls", cfg.TLS.enabled())
+			serve := func() error { return srv.Serve(l) }
+			if cfg.TLS.enabled() {
+				serve = func() error { return srv.ServeTLS(l, cfg.TLS.CertFile, cfg.TLS.KeyFile) }
+			}
+			if err := serve(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				fatal("server error", "addr", srv.Addr, "error", err)
+			}
+		}()
+	}
+
+	<-sigCtx.Done()
+	log.Info("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(ctx, cfg.Timeouts.Shutdown)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				log.Error("error during shutdown", "addr", srv.Addr, "error", err)
+			}
+		}()
+	}
+	wg.Wait()
+	// Handlers are done, so nothing parks after this.
+	state.QuotaQueue.flush()
+}
+
+// newRouter returns an engine with the middleware every listener runs
+// behind.
+func newRouter(cfg *Config, state *AppState, reporter *Reporter, verifier *HMACVerifier, authenticator Authenticator) *gin.Engine {
 	router := gin.Default()
-	router.Use(APIKeyAuthMiddleware())
+	// Validated with the config; nil trusts no proxy at all.
+	router.SetTrustedProxies(cfg.TrustedProxies)
+	if cfg.Compression.Gzip {
+		router.Use(GzipMiddleware(cfg.Compression.MinSize))
+	}
+	router.Use(RequestIDMiddleware())
+	// Probes come without credentials, so /readyz sits before auth.
+	router.GET("/readyz", Readyz(state))
+	router.Use(ErrorReportingMiddleware(reporter))
+	router.Use(CORSMiddleware(state))
+	router.Use(AllowlistMiddleware(state))
+	router.Use(APIKeyAuthMiddleware(state, verifier, authenticator))
+	router.Use(RateLimitMiddleware(state))
 	router.Use(StateMiddleware(state))
-	router.POST("/publish", publishDryRun)
-	router.POST("/broadcast", BroadcastMsg)
-	router.POST("/subscribe", SubscribeToTopic)
-	router.POST("/unsubscribe", UnsubscribeFromTopic)
-	router.Run("0.0.0.0:42069")
+	return router
+}
+
+// registerRoutes adds the public API to router.
+func registerRoutes(router *gin.Engine, state *AppState) {
+	jsonOnly := RequireJSONMiddleware()
+	router.POST("/publish", jsonOnly, publishDryRun)
+	router.POST("/broadcast", jsonOnly, BroadcastMsg)
+	router.POST("/send", jsonOnly, SendUnified)
+	router.POST("/preview", jsonOnly, Preview)
+	router.POST("/subscribe", jsonOnly, SubscribeToTopic)
+	router.POST("/unsubscribe", jsonOnly, UnsubscribeFromTopic)
+	router.POST("/subscribe/import", ImportSubscriptions)
+	router.POST("/test", SendTest)
+	router.POST("/webhooks", jsonOnly, state.Webhooks.Create)
+	router.GET("/webhooks", state.Webhooks.List)
+	router.DELETE("/webhooks/:id", state.Webhooks.Delete)
+	router.GET("/webhooks/:id/deliveries", state.Webhooks.Deliveries)
+	router.PUT("/templates/:name", jsonOnly, state.Templates.Put)
+	router.GET("/templates", state.Templates.List)
+	router.GET("/templates/:name", state.Templates.Get)
+	router.DELETE("/templates/:name", state.Templates.Delete)
+	router.POST("/publish-named", jsonOnly, PublishNamed)
+	router.PUT("/topics/:topic/defaults", jsonOnly, state.TopicDefaults.Put)
+	router.GET("/topics/:topic/defaults", state.TopicDefaults.Get)
+	router.DELETE("/topics/:topic/defaults", state.TopicDefaults.Delete)
+}
+
+func newServer(cfg *Config, addr string, handler http.Handler) *http.Server {
+	h2 := &http2.Server{
+		MaxConcurrentStreams: uint32(cfg.HTTP2.MaxConcurrentStreams),
+		IdleTimeout:          cfg.HTTP2.IdleTimeout,
+	}
+	if cfg.HTTP2.H2C {
+		handler = h2c.NewHandler(handler, h2)
+	}
+	srv := &http.Server{
+		Addr:         addr,
+		Handler:      handler,
+		ReadTimeout:  cfg.Timeouts.Read,
+		WriteTimeout: cfg.Timeouts.Write,
+		IdleTimeout:  cfg.Timeouts.Idle,
+	}
+	if cfg.TLS.enabled() {
+		// ServeTLS would advertise h2 on its own, but with the default
+		// stream limits rather than ours.
+		if err := http2.ConfigureServer(srv, h2); err != nil {
+			fatal("Cannot configure HTTP/2", "addr", addr, "error", err)
+		}
+	}
+	return srv
+}
+
+// Stats reports runtime counters.
+func Stats(c *gin.Context) {
+	appState, _ := c.Get("state")
+	state := appState.(*AppState)
+	inFlight, limit, waits := state.Limiter.stats()
+	c.JSON(http.StatusOK, gin.H{
+		"fcm_in_flight":     inFlight,
+		"fcm_max_in_flight": limit,
+		"fcm_slot_wait_ms":  waits,
+		"retry_attempts":    retryAttempts.snapshot(),
+		"quota_queued":      state.QuotaQueue.len(),
+		"circuit_breaker":   state.Breaker.state(),
+	})
+}
+
+// Readyz reports that the relay is serving, whether its messages go to an
+// emulator rather than FCM, and whether FCM is degraded. A degraded relay is
+// still ready: there is nothing another instance would do better.
+func Readyz(state *AppState) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ratio, degraded := state.Upstream.status()
+		resp := gin.H{
+			"status":                 "ready",
+			"emulator":               state.Emulator != "",
+			"degraded":               degraded,
+			"upstream_success_ratio": ratio,
+		}
+		if state.Emulator != "" {
+			resp["fcm_endpoint"] = state.Emulator
+		}
+		c.JSON(http.StatusOK, resp)
+	}
 }
 
 func StateMiddleware(state *AppState) gin.HandlerFunc {
@@ -77,118 +497,389 @@ func StateMiddleware(state *AppState) gin.HandlerFunc {
 }
 
 func publishDryRun(ctx *gin.Context) {
-	var p PublishInput
-	ctx.Bind(&p)
-	registrationToken := p.Token
+	var p api.PublishInput
+	if !bindInput(ctx, &p) {
+		return
+	}
+	echoInput(ctx, p)
 	notification := messaging.Notification{Title: p.Notification.Title, Body: p.Notification.Body}
-	log.Info(fmt.Sprintf("notification is %v", notification))
+
+	appState, _ := ctx.Get("state")
+	state := appState.(*AppState)
+	registrationToken := state.normalizeToken(p.Token)
+	if state.Settings().Log.Payloads {
+		requestLog(ctx).Info("notification", "title", notification.Title, "body", notification.Body, "token", redactToken(registrationToken), "client_ref", p.ClientRef)
+	}
+	android, apns, err := platformConfigs(p.PlatformInput, &notification, state.Defaults)
+	if err != nil {
+		ctx.JSON(http.StatusUnprocessableEntity, api.ErrorResponse{Error: err.Error(), ClientRef: p.ClientRef})
+		return
+	}
 	message := &messaging.Message{
 		Notification: &notification,
 		Token:        registrationToken,
+		Android:      android,
+		APNS:         apns,
+		Webpush:      webpushConfig(p.PlatformInput, nil),
+		FCMOptions:   fcmOptions(p.PlatformInput, &notification),
 	}
 
-	appState, _ := ctx.Get("state")
+	client := state.clientFor(ctx, p.Project)
+	if client == nil {
+		return
+	}
+	dedupKey := state.Dedup.key(ctx, "token:"+registrationToken, message)
+	if id, ok := state.Dedup.lookup(ctx, dedupKey); ok {
+		requestLog(ctx).Info("dropped duplicate message", "token", redactToken(registrationToken), "original", id, "client_ref", p.ClientRef)
+		ctx.JSON(http.StatusOK, api.SendResponse{Deduplicated: true, MessageID: id, ClientRef: p.ClientRef})
+		return
+	}
+	if !state.limitDevice(ctx, message, p.ClientRef) {
+		return
+	}
+	state.applyQuietHours(message)
+	if !explain(ctx, p.PlatformInput, message) {
+		return
+	}
+
+	sendCtx, cancel := state.fcmContext(ctx)
+	defer cancel()
+	start := time.Now()
+	response, err := client.Send(withBoost(withQuotaQueue(sendCtx, !p.Sync), p.BoostOnFailure), message)
+	latency := time.Since(start)
+	if respondQueued(ctx, err, p.ClientRef) {
+		return
+	}
+	state.recordSend(ctx, "publish", "token:"+registrationToken, notification.Title, response, err, p.ClientRef)
+	if err != nil {
+		requestLog(ctx).Error("error sending message", "error", err, "token", redactToken(registrationToken), "client_ref", p.ClientRef)
+		ctx.Error(err)
+		ctx.JSON(fcmErrorStatus(ctx, err), withDebug(ctx, api.ErrorResponse{Error: fmt.Sprintf("error found while publishing message: %s", err), ClientRef: p.ClientRef}))
+		return
+	}
+	state.Dedup.remember(ctx, dedupKey, response)
+	requestLog(ctx).Info(fmt.Sprintf("Successfully sent message: %v", response), "token", redactToken(registrationToken), "client_ref", p.ClientRef, "analytics_label", ctx.GetString("analytics_label"))
+	ctx.JSON(http.StatusAccepted, sendResponse(ctx, latency, api.SendResponse{MessageID: response, ClientRef: p.ClientRef}))
+}
+
+// SendTest sends a canned notification to the configured debug token, a
+// smoke test that needs no payload.
+func SendTest(c *gin.Context) {
+	appState, _ := c.Get("state")
 	state := appState.(*AppState)
+	if state.DebugToken == "" {
+		c.JSON(http.StatusBadRequest, api.ErrorResponse{Error: "no debug token configured, set DEBUG_TOKEN"})
+		return
+	}
+	client := state.clientFor(c, "")
+	if client == nil {
+		return
+	}
+	message := &messaging.Message{
+		Token: state.DebugToken,
+		Notification: &messaging.Notification{
+			Title: "Test notification",
+			Body:  fmt.Sprintf("Sent by fcmrelay at %s", time.Now().UTC().Format(time.RFC3339)),
+		},
+	}
 
-	response, err := state.MsgClient.Send(ctx, message)
+	sendCtx, cancel := state.fcmContext(c)
+	defer cancel()
+	response, err := client.Send(sendCtx, message)
+	state.recordSend(c, "test", "token:"+state.DebugToken, message.Notification.Title, response, err, "")
 	if err != nil {
-		log.Error("error sending message", "error", err)
-		ctx.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("error found while publishing message: %s", err)})
+		requestLog(c).Error("error sending test message", "error", err, "token", redactToken(state.DebugToken))
+		c.Error(err)
+		c.JSON(fcmErrorStatus(c, err), api.ErrorResponse{Error: fmt.Sprintf("error found while sending test message: %s", err)})
 		return
 	}
-	log.Info(fmt.Sprintf("Successfully sent message: %v", response))
-	ctx.Status(http.StatusAccepted)
+	requestLog(c).Info("Successfully sent test message", "resp", response)
+	c.JSON(http.StatusAccepted, api.SendResponse{MessageID: response})
 }
 
 func BroadcastMsg(c *gin.Context) {
-	var b BroadCastInput
-	c.Bind(&b)
+	var b api.BroadCastInput
+	if !bindInput(c, &b) {
+		return
+	}
+	echoInput(c, b)
 	notification := messaging.Notification{Title: b.Notification.Title, Body: b.Notification.Body}
+
+	appState, _ := c.Get("state")
+	state := appState.(*AppState)
+	platform := state.TopicDefaults.apply(c, b.Topic, b.PlatformInput)
+	android, apns, err := platformConfigs(platform, &notification, state.Defaults)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, api.ErrorResponse{Error: err.Error()})
+		return
+	}
 	message := &messaging.Message{
 		Notification: &notification,
 		Topic:        b.Topic,
+		Android:      broadcastAndroid(android, b.Topic, state.Defaults),
+		APNS:         apns,
+		Webpush:      webpushConfig(platform, nil),
+		FCMOptions:   fcmOptions(platform, &notification),
 	}
 
-	appState, _ := c.Get("state")
-	state := appState.(*AppState)
-	response, err := state.MsgClient.Send(c, message)
+	client := state.clientFor(c, b.Project)
+	if client == nil {
+		return
+	}
+	dedupKey := state.Dedup.key(c, "topic:"+b.Topic, message)
+	if id, ok := state.Dedup.lookup(c, dedupKey); ok {
+		requestLog(c).Info("dropped duplicate message", "topic", b.Topic, "original", id)
+		c.JSON(http.StatusOK, api.SendResponse{Deduplicated: true, MessageID: id})
+		return
+	}
+	state.applyQuietHours(message)
+	if !explain(c, b.PlatformInput, message) {
+		return
+	}
+	sendCtx, cancel := state.fcmContext(c)
+	defer cancel()
+	start := time.Now()
+	response, err := client.Send(withBoost(withQuotaQueue(sendCtx, !b.Sync), b.BoostOnFailure), message)
+	latency := time.Since(start)
+	if respondQueued(c, err, "") {
+		return
+	}
+	state.recordSend(c, "broadcast", "topic:"+b.Topic, notification.Title, response, err, "")
 	if err != nil {
-		log.Error("error broadcasting message", "error", err)
-		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("error found while broadcasting message: %s", err)})
+		requestLog(c).Error("error broadcasting message", "error", err)
+		c.Error(err)
+		c.JSON(fcmErrorStatus(c, err), withDebug(c, api.ErrorResponse{Error: fmt.Sprintf("error found while broadcasting message: %s", err)}))
 		return
 	}
-	log.Info("Successfully broadcasted message", "resp", response)
-	c.Status(http.StatusAccepted)
+	state.Dedup.remember(c, dedupKey, response)
+	requestLog(c).Info("Successfully broadcasted message", "resp", response, "analytics_label", c.GetString("analytics_label"))
+	c.JSON(http.StatusAccepted, sendResponse(c, latency, api.SendResponse{MessageID: response}))
 }
 
 func SubscribeToTopic(c *gin.Context) {
-	var s SubscribeInput
-	c.Bind(&s)
+	var s api.SubscribeInput
+	if !bindInput(c, &s) {
+		return
+	}
 
 	appState, _ := c.Get("state")
 	state := appState.(*AppState)
-	response, err := state.MsgClient.SubscribeToTopic(c, s.Tokens, s.Topic)
+	if limit := state.Settings().MaxTopicTokens; len(s.Tokens) > limit {
+		respondTooMany(c, "tokens", limit, "")
+		return
+	}
+	state.normalizeTokens(s.Tokens)
+	// Normalising can turn distinct tokens into duplicates, so this comes
+	// after it. Error indexes refer to the deduplicated tokens.
+	var duplicates int
+	s.Tokens, duplicates = uniqueTokens(s.Tokens)
+	s.Topic = canonicalTopic(s.Topic)
+	client := state.clientFor(c, s.Project)
+	if client == nil {
+		return
+	}
+	response, err := state.manageTopic(c, client.SubscribeToTopic, s.Tokens, s.Topic)
+	state.Audit.recordTopic(c, "subscribe", s.Topic, len(s.Tokens), response, err)
 	if err != nil {
-		log.Error("error while subscribing to topic", "error", err)
-		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("error found while subscribing to topic: %s", err)})
+		requestLog(c).Error("error while subscribing to topic", "error", err)
+		c.Error(err)
+		c.JSON(fcmErrorStatus(c, err), api.ErrorResponse{Error: fmt.Sprintf("error found while subscribing to topic: %s", err), Code: fcmErrorCode(err)})
+		return
+	}
+	if response.FailureCount != 0 && response.SuccessCount > 0 {
+		requestLog(c).Warn("partial topic subscribe", "topic", s.Topic, "success", response.SuccessCount, "failure", response.FailureCount)
+		c.JSON(http.StatusMultiStatus, topicResult(s.Topic, duplicates, response))
 		return
 	}
 	if response.FailureCount != 0 {
-		var sb strings.Builder
-		for _, err := range response.Errors {
-			fmt.Fprintf(&sb, "Code: %d, Message: %s", err.Index, err.Reason)
-		}
-		log.Error("error while subscribing to topic", "errors", sb.String())
-		c.JSON(http.StatusBadGateway, gin.H{"errors": fmt.Sprintf("errors while subscribing to topic: %v", sb.String())})
+		respondTopicFailed(c, "subscribing to", response)
 		return
 	}
-	log.Info("Successfully subbed to topic", "resp", response)
-	c.Status(http.StatusAccepted)
+	requestLog(c).Info("Successfully subbed to topic", "resp", response, "duplicates_removed", duplicates)
+	c.JSON(http.StatusAccepted, topicResult(s.Topic, duplicates, response))
 }
 
 func UnsubscribeFromTopic(c *gin.Context) {
-	var s SubscribeInput
-	c.Bind(&s)
+	var s api.SubscribeInput
+	if !bindInput(c, &s) {
+		return
+	}
 
 	appState, _ := c.Get("state")
 	state := appState.(*AppState)
-	response, err := state.MsgClient.UnsubscribeFromTopic(c, s.Tokens, s.Topic)
+	if limit := state.Settings().MaxTopicTokens; len(s.Tokens) > limit {
+		respondTooMany(c, "tokens", limit, "")
+		return
+	}
+	state.normalizeTokens(s.Tokens)
+	var duplicates int
+	s.Tokens, duplicates = uniqueTokens(s.Tokens)
+	s.Topic = canonicalTopic(s.Topic)
+	client := state.clientFor(c, s.Project)
+	if client == nil {
+		return
+	}
+	response, err := state.manageTopic(c, client.UnsubscribeFromTopic, s.Tokens, s.Topic)
+	state.Audit.recordTopic(c, "unsubscribe", s.Topic, len(s.Tokens), response, err)
 	if err != nil {
-		log.Error("error while unsubscribing from topic", "error", err)
-		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("error found while unsubscribing from topic: %s", err)})
+		requestLog(c).Error("error while unsubscribing from topic", "error", err)
+		c.Error(err)
+		c.JSON(fcmErrorStatus(c, err), api.ErrorResponse{Error: fmt.Sprintf("error found while unsubscribing from topic: %s", err), Code: fcmErrorCode(err)})
+		return
+	}
+	if response.FailureCount != 0 && response.SuccessCount > 0 {
+		requestLog(c).Warn("partial topic unsubscribe", "topic", s.Topic, "success", response.SuccessCount, "failure", response.FailureCount)
+		c.JSON(http.StatusMultiStatus, topicResult(s.Topic, duplicates, response))
 		return
 	}
 	if response.FailureCount != 0 {
-		var sb strings.Builder
-		for _, err := range response.Errors {
-			fmt.Fprintf(&sb, "Code: %d, Message: %s", err.Index, err.Reason)
-		}
-		log.Error("error while subscribing to topic", "errors", sb.String())
-		c.JSON(http.StatusBadGateway, gin.H{"errors": fmt.Sprintf("errors while subscribing to topic: %v", sb.String())})
+		respondTopicFailed(c, "unsubscribing from", response)
 		return
 	}
-	log.Info("Successfully unsubbed from topic", "resp", response)
-	c.Status(http.StatusAccepted)
+	requestLog(c).Info("Successfully unsubbed from topic", "resp", response, "duplicates_removed", duplicates)
+	c.JSON(http.StatusAccepted, topicResult(s.Topic, duplicates, response))
 }
 
-func APIKeyAuthMiddleware() gin.HandlerFunc {
+// respondTopicFailed answers 502 for a topic call FCM refused every token of,
+// with each token's reason in the message.
+func respondTopicFailed(c *gin.Context, action string, resp *messaging.TopicManagementResponse) {
+	reasons := make([]string, 0, len(resp.Errors))
+	for _, e := range resp.Errors {
+		reasons = append(reasons, fmt.Sprintf("token %d: %s", e.Index, e.Reason))
+	}
+	requestLog(c).Error("error while "+action+" topic", "errors", reasons)
+	c.JSON(http.StatusBadGateway, api.ErrorResponse{Error: fmt.Sprintf("errors while %s topic: %s", action, strings.Join(reasons, "; "))})
+}
+
+// maxTopicBatch is the most tokens FCM accepts in one topic management call.
+const maxTopicBatch = 1000
+
+// topicResult maps a merged topic management response onto the response
+// body.
+func topicResult(topic string, duplicates int, resp *messaging.TopicManagementResponse) api.SubscribeResponse {
+	out := api.SubscribeResponse{Topic: topic, DuplicatesRemoved: duplicates, SuccessCount: resp.SuccessCount, FailureCount: resp.FailureCount}
+	for _, e := range resp.Errors {
+		out.Failures = append(out.Failures, api.TopicFailure{Index: e.Index, Reason: e.Reason})
+	}
+	return out
+}
+
+type topicOp func(ctx context.Context, tokens []string, topic string) (*messaging.TopicManagementResponse, error)
+
+// manageTopic runs op over tokens in batches FCM accepts, each bounded by the
+// FCM timeout, and merges the responses. Error indexes refer to tokens. A
+// batch that fails as a whole counts every one of its tokens as failed with
+// the error as reason, so the batches that went through are not lost; only
+// when every batch fails is the error returned.
+func (s *AppState) manageTopic(c *gin.Context, op topicOp, tokens []string, topic string) (*messaging.TopicManagementResponse, error) {
+	if len(tokens) <= maxTopicBatch {
+		ctx, cancel := s.fcmContext(c)
+		defer cancel()
+		return op(ctx, tokens, topic)
+	}
+	merged := &messaging.TopicManagementResponse{}
+	var firstErr error
+	failedBatches := 0
+	for start := 0; start < len(tokens); start += maxTopicBatch {
+		end := min(start+maxTopicBatch, len(tokens))
+		ctx, cancel := s.fcmContext(c)
+		resp, err := op(ctx, tokens[start:end], topic)
+		cancel()
+		if err != nil {
+			requestLog(c).Error("topic batch failed", "topic", topic, "from", start, "to", end, "error", err)
+			firstErr = cmp.Or(firstErr, err)
+			failedBatches++
+			merged.FailureCount += end - start
+			for i := start; i < end; i++ {
+				merged.Errors = append(merged.Errors, &messaging.ErrorInfo{Index: i, Reason: err.Error()})
+			}
+			continue
+		}
+		merged.SuccessCount += resp.SuccessCount
+		merged.FailureCount += resp.FailureCount
+		for _, e := range resp.Errors {
+			merged.Errors = append(merged.Errors, &messaging.ErrorInfo{Index: start + e.Index, Reason: e.Reason})
+		}
+	}
+	if failedBatches == (len(tokens)+maxTopicBatch-1)/maxTopicBatch {
+		return nil, firstErr
+	}
+	return merged, nil
+}
+
+// RequireJSONMiddleware rejects bodies that are not application/json, which
+// Bind would otherwise decode by guessing and turn into empty messages.
+func RequireJSONMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.ContentType() != gin.MIMEJSON {
+			c.JSON(http.StatusUnsupportedMediaType, api.ErrorResponse{Error: fmt.Sprintf("Content-Type must be %s", gin.MIMEJSON)})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// APIKeyAuthMiddleware resolves the request's credential to its identity:
+// bearer tokens through auth, HMAC signatures through the static keys they
+// are signed with.
+func APIKeyAuthMiddleware(state *AppState, verifier *HMACVerifier, auth Authenticator) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
+		settings := state.Settings()
 
-		if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: Missing or invalid token"})
+		var apiKey string
+		backend := auth
+		switch {
+		case verifier != nil && strings.HasPrefix(authHeader, "HMAC "):
+			key, err := verifier.verify(c, authHeader, settings.keyIDs)
+			if err != nil {
+				resp := api.ErrorResponse{Error: err.Error()}
+				status := http.StatusUnauthorized
+				var herr *hmacError
+				if errors.As(err, &herr) {
+					resp.Code = herr.code
+					if herr.status != 0 {
+						status = herr.status
+					}
+					if herr.retryAfter > 0 {
+						status = http.StatusServiceUnavailable
+						c.Header("Retry-After", strconv.Itoa(int(math.Ceil(herr.retryAfter.Seconds()))))
+					}
+				}
+				c.JSON(status, resp)
+				c.Abort()
+				return
+			}
+			apiKey, backend = key, staticAuthenticator{state: state}
+		case strings.HasPrefix(authHeader, "Bearer "):
+			apiKey = strings.TrimPrefix(authHeader, "Bearer ")
+		default:
+			c.JSON(http.StatusUnauthorized, api.ErrorResponse{Error: "Unauthorized: Missing or invalid token"})
 			c.Abort()
 			return
 		}
 
-		appApiKey := os.Getenv("API_KEY")
-
-		apiKey := strings.TrimPrefix(authHeader, "Bearer ")
-		if apiKey != appApiKey {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: Invalid API Key"})
+		key, err := backend.Authenticate(c, apiKey)
+		if errors.Is(err, errUnknownCredential) {
+			c.JSON(http.StatusUnauthorized, api.ErrorResponse{Error: err.Error()})
+			c.Abort()
+			return
+		}
+		if errors.Is(err, errNoProjects) {
+			c.JSON(http.StatusForbidden, api.ErrorResponse{Error: err.Error()})
+			c.Abort()
+			return
+		}
+		if err != nil {
+			requestLog(c).Error("authentication backend failed", "error", err)
+			c.JSON(http.StatusServiceUnavailable, api.ErrorResponse{Error: "authentication is unavailable, retry later"})
 			c.Abort()
 			return
 		}
+		c.Set("api_key", key)
+		c.Set("tenant", key.Tenant)
+		c.Set("api_key_id", keyID(apiKey))
 
 		c.Next()
 	}
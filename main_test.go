@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+	"github.com/gin-gonic/gin"
+)
+
+const testAPIKey = "test-api-key"
+
+// testToken returns a distinct token the fcmtoken rule accepts.
+func testToken(i int) string {
+	return fmt.Sprintf("device-token-%08d-abcdefghij", i)
+}
+
+// fakeMessenger stands in for FCM. It records the messages it is given and
+// answers with sequential message IDs. Tokens in failTokens fail with their
+// error, and tokens in topicFailures fail topic calls with their reason.
+type fakeMessenger struct {
+	failTokens    map[string]error
+	topicFailures map[string]string
+	// latency is slept once per call, as a stand-in for the round trip.
+	latency time.Duration
+
+	mu   sync.Mutex
+	sent []*messaging.Message
+}
+
+func (f *fakeMessenger) send(message *messaging.Message) (string, error) {
+	time.Sleep(f.latency)
+	return f.record(message)
+}
+
+func (f *fakeMessenger) record(message *messaging.Message) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent = append(f.sent, message)
+	if err := f.failTokens[message.Token]; err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("projects/test/messages/%d", len(f.sent)), nil
+}
+
+// messages returns what was sent so far.
+func (f *fakeMessenger) messages() []*messaging.Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*messaging.Message(nil), f.sent...)
+}
+
+func (f *fakeMessenger) Send(_ context.Context, message *messaging.Message) (string, error) {
+	return f.send(message)
+}
+
+func (f *fakeMessenger) SendDryRun(_ context.Context, message *messaging.Message) (string, error) {
+	return f.send(message)
+}
+
+func (f *fakeMessenger) SendEachForMulticast(_ context.Context, m *messaging.MulticastMessage) (*messaging.BatchResponse, error) {
+	time.Sleep(f.latency)
+	resp := &messaging.BatchResponse{}
+	for _, token := range m.Tokens {
+		id, err := f.record(&messaging.Message{
+			Token:        token,
+			Data:         m.Data,
+			Notification: m.Notification,
+			Android:      m.Android,
+			Webpush:      m.Webpush,
+			APNS:         m.APNS,
+			FCMOptions:   m.FCMOptions,
+		})
+		resp.Responses = append(resp.Responses, &messaging.SendResponse{Success: err == nil, MessageID: id, Error: err})
+		if err != nil {
+			resp.FailureCount++
+		} else {
+			resp.SuccessCount++
+		}
+	}
+	return resp, nil
+}
+
+func (f *fakeMessenger) SendEachForMulticastDryRun(ctx context.Context, m *messaging.MulticastMessage) (*messaging.BatchResponse, error) {
+	return f.SendEachForMulticast(ctx, m)
+}
+
+func (f *fakeMessenger) topic(tokens []string) (*messaging.TopicManagementResponse, error) {
+	time.Sleep(f.latency)
+	resp := &messaging.TopicManagementResponse{}
+	for i, token := range tokens {
+		if reason, ok := f.topicFailures[token]; ok {
+			resp.FailureCount++
+			resp.Errors = append(resp.Errors, &messaging.ErrorInfo{Index: i, Reason: reason})
+			continue
+		}
+		resp.SuccessCount++
+	}
+	return resp, nil
+}
+
+func (f *fakeMessenger) SubscribeToTopic(_ context.Context, tokens []string, _ string) (*messaging.TopicManagementResponse, error) {
+	return f.topic(tokens)
+}
+
+func (f *fakeMessenger) UnsubscribeFromTopic(_ context.Context, tokens []string, _ string) (*messaging.TopicManagementResponse, error) {
+	return f.topic(tokens)
+}
+
+var registerValidatorsOnce = sync.OnceValue(registerValidators)
+
+// newTestState returns the state serve would build for cfg, with m as the
+// only Firebase project. configure, when given, adjusts the default config
+// first; the API key is testAPIKey.
+func newTestState(t testing.TB, m Messenger, configure ...func(*Config)) (*Config, *AppState) {
+	t.Helper()
+	if err := registerValidatorsOnce(); err != nil {
+		t.Fatal(err)
+	}
+	cfg := defaultConfig()
+	cfg.Auth.APIKey = testAPIKey
+	for _, f := range configure {
+		f(cfg)
+	}
+	settings, err := newSettings(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	templates, _ := NewTemplateStore("")
+	topicDefaults, _ := NewTopicDefaultsStore("")
+	state := &AppState{
+		MsgClient:     m,
+		Projects:      map[string]Messenger{"": m},
+		Templates:     templates,
+		TopicDefaults: topicDefaults,
+		Defaults:      cfg.Defaults,
+		Fanout:        cfg.Fanout,
+		DebugToken:    cfg.Debug.Token,
+		Upstream:      &UpstreamHealth{},
+	}
+	state.settings.Store(settings)
+	return cfg, state
+}
+
+// newTestRouter returns the real router, routes and middleware included, in
+// front of m.
+func newTestRouter(t testing.TB, m Messenger, configure ...func(*Config)) (*Config, *AppState, *gin.Engine) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	cfg, state := newTestState(t, m, configure...)
+	router := newRouter(cfg, state, nil, NewHMACVerifier(cfg.Auth.HMAC), staticAuthenticator{state: state})
+	registerRoutes(router, state)
+	return cfg, state, router
+}
+
+// newTestServer serves newTestRouter's router over HTTP/1.1.
+func newTestServer(t testing.TB, m Messenger, configure ...func(*Config)) (*httptest.Server, *AppState) {
+	t.Helper()
+	_, state, router := newTestRouter(t, m, configure...)
+	srv := httptest.NewServer(router)
+	t.Cleanup(srv.Close)
+	return srv, state
+}
+
+// publishBody is a valid /publish body.
+func publishBody(token string) string {
+	return fmt.Sprintf(`{"to":%q,"notification":{"title":"T"}}`, token)
+}
+
+// post sends body to path as an API client would.
+func post(t testing.TB, srv *httptest.Server, path, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
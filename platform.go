@@ -0,0 +1,383 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+	"github.com/baakel/go_fcm/api"
+	"github.com/charmbracelet/log"
+)
+
+// maxLocArgs bounds the number of localization arguments per key. Neither
+// platform documents a hard limit, but format strings with more arguments
+// than this are almost certainly a client bug.
+const maxLocArgs = 10
+
+// maxAPNSCollapseID is the longest apns-collapse-id APNs accepts, in bytes.
+const maxAPNSCollapseID = 64
+
+// apnsPushTypes are the apns-push-type values the relay sends. Apple knows
+// more, but they need certificates and payloads the relay doesn't handle.
+var apnsPushTypes = []string{"alert", "background", "voip"}
+
+// richImageKey is the APNs custom data key our service extension reads the
+// attachment URL from.
+const richImageKey = "image_url"
+
+// platformConfigs builds the SDK platform configs from the input, the
+// message's notification n, which may be nil, and the configured defaults.
+// Both are nil when there is nothing to set for the platform.
+func platformConfigs(p api.PlatformInput, n *messaging.Notification, d DefaultsConfig) (*messaging.AndroidConfig, *messaging.APNSConfig, error) {
+	var android *messaging.AndroidConfig
+	var apns *messaging.APNSConfig
+
+	ttl := d.TTL
+	if p.TTL != nil {
+		if *p.TTL < 0 {
+			return nil, nil, errors.New("ttl must not be negative")
+		}
+		ttl = time.Duration(*p.TTL) * time.Second
+	}
+
+	// A shared sound or configured notification defaults need the platform
+	// configs even when the request has no platform specific settings.
+	androidIn, apnsIn := p.Android, p.APNS
+	sound := cmp.Or(p.Sound, d.Sound)
+	if androidIn == nil && (sound != "" || p.ReplaceKey != "" || d.AndroidChannel != "" || d.Icon != "" || d.Color != "") {
+		androidIn = &api.AndroidInput{}
+	}
+	if apnsIn == nil && (sound != "" || p.ReplaceKey != "") {
+		apnsIn = &api.APNSInput{}
+	}
+	if len(p.ReplaceKey) > maxAPNSCollapseID {
+		return nil, nil, fmt.Errorf("replace_key must be at most %d bytes, the apns-collapse-id limit, got %d", maxAPNSCollapseID, len(p.ReplaceKey))
+	}
+	var defaulted []string
+	withDefault := func(field, value, fallback string) string {
+		if value == "" && fallback != "" {
+			defaulted = append(defaulted, field)
+			return fallback
+		}
+		return value
+	}
+	defer func() {
+		if len(defaulted) > 0 {
+			log.Debug("applied notification defaults", "fields", defaulted)
+		}
+	}()
+
+	if a := androidIn; a != nil {
+		if err := validateLocArgs("android.body_loc", a.BodyLocKey, a.BodyLocArgs); err != nil {
+			return nil, nil, err
+		}
+		if err := validateLocArgs("android.title_loc", a.TitleLocKey, a.TitleLocArgs); err != nil {
+			return nil, nil, err
+		}
+		if err := validateColor(a.Color); err != nil {
+			return nil, nil, fmt.Errorf("android.%w", err)
+		}
+		sound := cmp.Or(a.Sound, p.Sound)
+		if !a.DefaultSound {
+			sound = withDefault("android.sound", sound, d.Sound)
+		}
+		notification := &messaging.AndroidNotification{
+			BodyLocKey:            a.BodyLocKey,
+			BodyLocArgs:           a.BodyLocArgs,
+			TitleLocKey:           a.TitleLocKey,
+			TitleLocArgs:          a.TitleLocArgs,
+			Sound:                 sound,
+			ChannelID:             withDefault("android.channel_id", a.ChannelID, d.AndroidChannel),
+			Icon:                  withDefault("android.icon", a.Icon, d.Icon),
+			Color:                 withDefault("android.color", a.Color, d.Color),
+			Ticker:                a.Ticker,
+			Tag:                   cmp.Or(a.Tag, p.ReplaceKey),
+			Sticky:                a.Sticky,
+			EventTimestamp:        a.EventTime,
+			NotificationCount:     a.NotificationCount,
+			DefaultSound:          a.DefaultSound,
+			DefaultVibrateTimings: a.DefaultVibrateTimings,
+			DefaultLightSettings:  a.DefaultLightSettings,
+		}
+		if err := validatePriority(a.Priority); err != nil {
+			return nil, nil, fmt.Errorf("android.%w", err)
+		}
+		android = &messaging.AndroidConfig{DirectBootOK: a.DirectBootOK, Priority: a.Priority, CollapseKey: cmp.Or(a.CollapseKey, p.ReplaceKey)}
+		if !reflect.ValueOf(*notification).IsZero() {
+			android.Notification = notification
+		}
+	}
+
+	if a := apnsIn; a != nil {
+		if err := validateLocArgs("apns.loc", a.LocKey, a.LocArgs); err != nil {
+			return nil, nil, err
+		}
+		if err := validateLocArgs("apns.title_loc", a.TitleLocKey, a.TitleLocArgs); err != nil {
+			return nil, nil, err
+		}
+		// Only a content-available push without anything to show is a
+		// background push; one with an alert must stay an alert at priority
+		// 10, or APNs throttles or drops it.
+		alert := n != nil && (n.Title != "" || n.Body != "") || a.LocKey != "" || a.TitleLocKey != ""
+		pushType := a.PushType
+		switch {
+		case pushType == "" && a.ContentAvailable && !alert:
+			pushType = "background"
+		case pushType == "":
+			pushType = "alert"
+		case !slices.Contains(apnsPushTypes, pushType):
+			return nil, nil, fmt.Errorf("apns.push_type must be one of %v, got %q", apnsPushTypes, pushType)
+		}
+		if len(a.CollapseID) > maxAPNSCollapseID {
+			return nil, nil, fmt.Errorf("apns.collapse_id must be at most %d bytes, got %d", maxAPNSCollapseID, len(a.CollapseID))
+		}
+		priority := a.Priority
+		switch {
+		case priority == 0 && pushType == "background":
+			priority = 5
+		case priority == 0:
+			priority = 10
+		case priority == 10 && pushType == "background":
+			return nil, nil, errors.New("apns.priority must be 5 for background pushes, APNs rejects 10")
+		}
+		expiration, err := apnsExpiration(a.Expiration)
+		if err != nil {
+			return nil, nil, err
+		}
+		aps := &messaging.Aps{
+			ContentAvailable: a.ContentAvailable,
+			Sound:            withDefault("apns.sound", cmp.Or(a.Sound, p.Sound), d.Sound),
+		}
+		if a.LocKey != "" || a.TitleLocKey != "" {
+			aps.Alert = &messaging.ApsAlert{
+				LocKey:       a.LocKey,
+				LocArgs:      a.LocArgs,
+				TitleLocKey:  a.TitleLocKey,
+				TitleLocArgs: a.TitleLocArgs,
+			}
+		}
+		payload := &messaging.APNSPayload{Aps: aps}
+		if r := a.Rich; r != nil {
+			aps.MutableContent = true
+			aps.Category = r.Category
+			payload.CustomData = map[string]interface{}{richImageKey: r.ImageURL}
+		}
+		apns = &messaging.APNSConfig{
+			Headers: map[string]string{"apns-push-type": pushType, "apns-priority": strconv.Itoa(priority)},
+			Payload: payload,
+		}
+		if id := cmp.Or(a.CollapseID, p.ReplaceKey); id != "" {
+			apns.Headers["apns-collapse-id"] = id
+		}
+		if expiration != "" {
+			apns.Headers["apns-expiration"] = expiration
+		}
+	}
+
+	if ttl > 0 || p.TTL != nil {
+		if android == nil {
+			android = &messaging.AndroidConfig{}
+		}
+		if apns == nil {
+			apns = &messaging.APNSConfig{}
+		}
+		android.TTL = &ttl
+		if apns.Headers == nil {
+			apns.Headers = map[string]string{}
+		}
+		// An apns-expiration of 0 means deliver once or drop, matching a zero
+		// Android TTL. apns.expiration wins.
+		expiration := int64(0)
+		if ttl > 0 {
+			expiration = time.Now().Add(ttl).Unix()
+		}
+		if _, set := apns.Headers["apns-expiration"]; !set {
+			apns.Headers["apns-expiration"] = strconv.FormatInt(expiration, 10)
+		}
+	}
+
+	return android, apns, nil
+}
+
+// fcmOptions returns the message-level FCM options, nil when unset, and sets
+// the requested image on n.
+func fcmOptions(p api.PlatformInput, n *messaging.Notification) *messaging.FCMOptions {
+	o := p.FCMOptions
+	if o == nil {
+		return nil
+	}
+	if o.Image != "" {
+		n.ImageURL = o.Image
+	}
+	if o.AnalyticsLabel == "" {
+		return nil
+	}
+	return &messaging.FCMOptions{AnalyticsLabel: o.AnalyticsLabel}
+}
+
+// broadcastAndroid returns the Android config of a broadcast to topic:
+// android with the topic's configured priority when it sets none.
+func broadcastAndroid(android *messaging.AndroidConfig, topic string, d DefaultsConfig) *messaging.AndroidConfig {
+	if android == nil {
+		android = &messaging.AndroidConfig{}
+	}
+	if android.Priority == "" {
+		android.Priority = d.topicPriority(topic)
+	}
+	return android
+}
+
+// webpushConfig returns the Webpush config of the input, nil when neither
+// the webpush block nor replace_key is set.
+// data, the message's data, is also put on the notification itself, where
+// the service worker finds it as event.notification.data when the
+// notification is clicked.
+func webpushConfig(p api.PlatformInput, data map[string]string) *messaging.WebpushConfig {
+	w := p.Webpush
+	if w == nil && p.ReplaceKey == "" {
+		return nil
+	}
+	if w == nil {
+		w = &api.WebpushInput{}
+	}
+	n := &messaging.WebpushNotification{
+		Badge:              w.Badge,
+		RequireInteraction: w.RequireInteraction,
+		Silent:             w.Silent,
+		Renotify:           w.Renotify,
+		Tag:                cmp.Or(w.Tag, p.ReplaceKey),
+		Vibrate:            w.Vibrate,
+	}
+	for _, a := range w.Actions {
+		n.Actions = append(n.Actions, &messaging.WebpushNotificationAction{Action: a.Action, Title: a.Title, Icon: a.Icon})
+	}
+	if len(data) > 0 {
+		n.Data = data
+	}
+	return &messaging.WebpushConfig{Notification: n}
+}
+
+type boostKey struct{}
+
+// withBoost marks ctx as asking FCMClient.Send to re-send a message FCM
+// could not deliver once more at high priority, before the failure is
+// dead-lettered.
+func withBoost(ctx context.Context, boost bool) context.Context {
+	if !boost {
+		return ctx
+	}
+	return context.WithValue(ctx, boostKey{}, true)
+}
+
+// shouldBoost reports whether a send failing with err may be re-sent at high
+// priority under ctx.
+func shouldBoost(ctx context.Context, err error) bool {
+	if err == nil || ctx.Value(boostKey{}) == nil {
+		return false
+	}
+	code := fcmErrorCode(err)
+	return code == api.ErrCodeUnavailable || code == api.ErrCodeInternal
+}
+
+// boostPriority raises message to high priority on Android and 10 on APNs,
+// and reports whether that changed anything. Background APNs pushes keep
+// their priority since Apple rejects them at 10.
+func boostPriority(message *messaging.Message) bool {
+	changed := false
+	if message.Android == nil {
+		message.Android = &messaging.AndroidConfig{}
+	}
+	if message.Android.Priority != "high" {
+		message.Android.Priority, changed = "high", true
+	}
+	if message.APNS == nil {
+		message.APNS = &messaging.APNSConfig{}
+	}
+	h := message.APNS.Headers
+	if h["apns-push-type"] != "background" && h["apns-priority"] != "10" {
+		if h == nil {
+			h = map[string]string{}
+			message.APNS.Headers = h
+		}
+		h["apns-priority"], changed = "10", true
+	}
+	return changed
+}
+
+// apnsExpiration turns apns.expiration, unix seconds or a duration from now,
+// into the apns-expiration header value. It is empty when unset.
+func apnsExpiration(v string) (string, error) {
+	if v == "" {
+		return "", nil
+	}
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if secs < 0 {
+			return "", fmt.Errorf("apns.expiration must not be negative, got %d", secs)
+		}
+		return v, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return "", fmt.Errorf("apns.expiration must be unix seconds or a duration such as \"1h\", got %q", v)
+	}
+	return strconv.FormatInt(time.Now().Add(d).Unix(), 10), nil
+}
+
+// apnsWarnings lists APNs settings that are allowed but defeat themselves.
+func apnsWarnings(message *messaging.Message) []string {
+	if message.APNS == nil {
+		return nil
+	}
+	var aps *messaging.Aps
+	if p := message.APNS.Payload; p != nil {
+		aps = p.Aps
+	}
+	var warnings []string
+	alert := message.Notification != nil && (message.Notification.Title != "" || message.Notification.Body != "")
+	if aps != nil && aps.Alert != nil {
+		alert = true
+	}
+	if alert && message.APNS.Headers["apns-push-type"] == "background" {
+		warnings = append(warnings, "background push has an alert: iOS does not show it, and may throttle the app for it; use push_type alert or drop the text")
+	}
+	if aps != nil && aps.MutableContent && aps.ContentAvailable {
+		warnings = append(warnings, "apns.content_available with apns.rich (mutable-content) is likely unintended: "+
+			"the service extension only runs for visible alerts, while content-available makes this a background push that iOS throttles. "+
+			"Use rich with an alert to modify a shown notification, or content_available without rich and without text to wake the app silently")
+	}
+	return warnings
+}
+
+func validatePriority(p string) error {
+	switch p {
+	case "", "high", "normal":
+		return nil
+	}
+	return fmt.Errorf("priority must be \"high\" or \"normal\", got %q", p)
+}
+
+var colorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+func validateColor(c string) error {
+	if c != "" && !colorPattern.MatchString(c) {
+		return fmt.Errorf("color must be in the #rrggbb form, got %q", c)
+	}
+	return nil
+}
+
+func validateLocArgs(field, key string, args []string) error {
+	if len(args) > 0 && key == "" {
+		return fmt.Errorf("%s_args given without %s_key", field, field)
+	}
+	if len(args) > maxLocArgs {
+		return fmt.Errorf("%s_args has %d entries, at most %d are allowed", field, len(args), maxLocArgs)
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+	"github.com/baakel/go_fcm/api"
+)
+
+// sentDefaults is what the defaultable settings came out as.
+type sentDefaults struct {
+	channel, icon, color, androidSound, apnsSound string
+	ttl                                           time.Duration
+}
+
+func sentSettings(android *messaging.AndroidConfig, apns *messaging.APNSConfig) sentDefaults {
+	var s sentDefaults
+	if android != nil {
+		if android.TTL != nil {
+			s.ttl = *android.TTL
+		}
+		if n := android.Notification; n != nil {
+			s.channel, s.icon, s.color, s.androidSound = n.ChannelID, n.Icon, n.Color, n.Sound
+		}
+	}
+	if apns != nil && apns.Payload != nil && apns.Payload.Aps != nil {
+		s.apnsSound = apns.Payload.Aps.Sound
+	}
+	return s
+}
+
+func TestPlatformDefaults(t *testing.T) {
+	configured := DefaultsConfig{
+		TTL:            time.Hour,
+		AndroidChannel: "general",
+		Icon:           "ic_default",
+		Color:          "#112233",
+		Sound:          "default.caf",
+	}
+	topic := &TopicDefaults{
+		Topic:   "news",
+		Android: &TopicAndroidDefaults{ChannelID: "news", Color: "#445566"},
+		APNS:    &TopicAPNSDefaults{Sound: "news.caf"},
+	}
+	ttl := int64(60)
+	request := api.PlatformInput{
+		TTL:     &ttl,
+		Sound:   "request.caf",
+		Android: &api.AndroidInput{ChannelID: "request", Icon: "ic_request", Color: "#778899"},
+	}
+
+	tests := []struct {
+		name       string
+		in         api.PlatformInput
+		topic      *TopicDefaults
+		defaults   DefaultsConfig
+		want       sentDefaults
+		wantFilled []string
+	}{
+		{
+			name: "unset",
+			want: sentDefaults{},
+		},
+		{
+			name:     "configured defaults",
+			defaults: configured,
+			want:     sentDefaults{channel: "general", icon: "ic_default", color: "#112233", androidSound: "default.caf", apnsSound: "default.caf", ttl: time.Hour},
+		},
+		{
+			name:       "topic defaults over configured ones",
+			topic:      topic,
+			defaults:   configured,
+			want:       sentDefaults{channel: "news", icon: "ic_default", color: "#445566", androidSound: "default.caf", apnsSound: "news.caf", ttl: time.Hour},
+			wantFilled: []string{"android.channel_id", "android.color", "apns.sound"},
+		},
+		{
+			name:     "request over both",
+			in:       request,
+			topic:    topic,
+			defaults: configured,
+			want:     sentDefaults{channel: "request", icon: "ic_request", color: "#778899", androidSound: "request.caf", apnsSound: "request.caf", ttl: time.Minute},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := tt.in
+			var filled []string
+			if tt.topic != nil {
+				in, filled = tt.topic.apply(in)
+			}
+			android, apns, err := platformConfigs(in, &messaging.Notification{Title: "T"}, tt.defaults)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := sentSettings(android, apns); got != tt.want {
+				t.Errorf("sent %+v, want %+v", got, tt.want)
+			}
+			if !slices.Equal(filled, tt.wantFilled) {
+				t.Errorf("topic filled %v, want %v", filled, tt.wantFilled)
+			}
+		})
+	}
+}
+
+// The request's own values survive the topic's defaults being applied, so
+// the debug output can still tell them apart.
+func TestTopicDefaultsLeaveRequestAlone(t *testing.T) {
+	in := api.PlatformInput{Android: &api.AndroidInput{ChannelID: "request"}}
+	topic := &TopicDefaults{Android: &TopicAndroidDefaults{ChannelID: "news", Icon: "ic_news"}}
+	out, _ := topic.apply(in)
+	if in.Android.Icon != "" {
+		t.Fatalf("apply changed the request's android block: %+v", in.Android)
+	}
+	if out.Android.ChannelID != "request" || out.Android.Icon != "ic_news" {
+		t.Fatalf("applied %+v, want the request's channel and the topic's icon", out.Android)
+	}
+}
+
+// The SDK flattens WebpushNotification into a map when marshalling, so
+// nothing but the JSON shows the fields arrive under the names browsers use.
+func TestWebpushConfigJSON(t *testing.T) {
+	full := &api.WebpushInput{
+		Actions: []api.WebpushAction{
+			{Action: "reply", Title: "Reply", Icon: "https://example.com/reply.png"},
+			{Action: "dismiss", Title: "Dismiss"},
+		},
+		Badge:              "https://example.com/badge.png",
+		RequireInteraction: true,
+		Silent:             true,
+		Renotify:           true,
+		Tag:                "thread-42",
+		Vibrate:            []int{200, 100, 200},
+	}
+	tests := []struct {
+		name string
+		in   api.PlatformInput
+		data map[string]string
+		want string
+	}{
+		{
+			name: "unset",
+			want: `null`,
+		},
+		{
+			name: "all options",
+			in:   api.PlatformInput{Webpush: full},
+			want: `{"notification":{"actions":[{"action":"reply","title":"Reply","icon":"https://example.com/reply.png"},{"action":"dismiss","title":"Dismiss"}],"badge":"https://example.com/badge.png","renotify":true,"requireInteraction":true,"silent":true,"tag":"thread-42","vibrate":[200,100,200]}}`,
+		},
+		{
+			name: "data for the service worker",
+			in:   api.PlatformInput{Webpush: &api.WebpushInput{Tag: "t"}},
+			data: map[string]string{"thread": "42"},
+			want: `{"notification":{"data":{"thread":"42"},"tag":"t"}}`,
+		},
+		{
+			name: "replace key as the tag",
+			in:   api.PlatformInput{ReplaceKey: "score"},
+			want: `{"notification":{"tag":"score"}}`,
+		},
+		{
+			name: "own tag over replace key",
+			in:   api.PlatformInput{ReplaceKey: "score", Webpush: &api.WebpushInput{Tag: "t"}},
+			want: `{"notification":{"tag":"t"}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := json.Marshal(webpushConfig(tt.in, tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPNSPushTypes(t *testing.T) {
+	for _, pushType := range []string{"alert", "background", "voip", "location", "liveactivity", "ALERT"} {
+		t.Run(pushType, func(t *testing.T) {
+			p := api.PlatformInput{APNS: &api.APNSInput{PushType: pushType, ContentAvailable: true}}
+			_, apns, err := platformConfigs(p, nil, DefaultsConfig{})
+			valid := slices.Contains([]string{"alert", "background", "voip"}, pushType)
+			if valid != (err == nil) {
+				t.Fatalf("push_type %q: error %v, want valid %v", pushType, err, valid)
+			}
+			if valid && apns.Headers["apns-push-type"] != pushType {
+				t.Fatalf("apns-push-type %q, want %q", apns.Headers["apns-push-type"], pushType)
+			}
+		})
+	}
+}
+
+func TestBroadcastAndroid(t *testing.T) {
+	d := DefaultsConfig{TopicPriority: map[string]string{"alerts": "high"}}
+	tests := []struct {
+		name    string
+		android *messaging.AndroidConfig
+		topic   string
+		want    string
+	}{
+		{name: "configured topic", topic: "alerts", want: "high"},
+		{name: "other topic", topic: "news", want: "normal"},
+		{name: "own priority", android: &messaging.AndroidConfig{Priority: "normal"}, topic: "alerts", want: "normal"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := broadcastAndroid(tt.android, tt.topic, d).Priority; got != tt.want {
+				t.Fatalf("priority %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
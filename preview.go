@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"unicode/utf8"
+
+	"firebase.google.com/go/v4/messaging"
+	"github.com/baakel/go_fcm/api"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// maxPayloadBytes is FCM's limit on a message payload.
+	maxPayloadBytes = 4096
+	// previewTitleChars and previewBodyChars are roughly what lock screens
+	// show before truncating, used for preview warnings only.
+	previewTitleChars = 50
+	previewBodyChars  = 150
+)
+
+// Preview runs a send body through the same construction as the send
+// endpoints: validation, template rendering, defaults, platform configs and
+// quiet hours. It answers with the resulting message and warnings about it,
+// without contacting FCM.
+func Preview(c *gin.Context) {
+	var in api.PreviewInput
+	if !bindInput(c, &in) {
+		return
+	}
+	targets := 0
+	for _, set := range []bool{in.To != "", in.Token != "", in.Topic != "", in.Condition != ""} {
+		if set {
+			targets++
+		}
+	}
+	if targets > 1 {
+		c.JSON(http.StatusUnprocessableEntity, api.ErrorResponse{Error: "at most one of to, token, topic or condition may be given", ClientRef: in.ClientRef})
+		return
+	}
+
+	appState, _ := c.Get("state")
+	state := appState.(*AppState)
+	notification := &messaging.Notification{Title: in.Notification.Title, Body: in.Notification.Body}
+	data := in.Data
+	if in.Template != "" {
+		t, ok := state.Templates.get(in.Template)
+		if !ok {
+			c.JSON(http.StatusNotFound, api.ErrorResponse{Error: fmt.Sprintf("unknown template %q", in.Template), ClientRef: in.ClientRef})
+			return
+		}
+		var err error
+		notification.Title, notification.Body, data, err = t.render(in.Variables)
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, api.ErrorResponse{Error: fmt.Sprintf("rendering template %q: %s", in.Template, err), ClientRef: in.ClientRef})
+			return
+		}
+	}
+	platform := state.TopicDefaults.apply(c, in.Topic, in.PlatformInput)
+	android, apns, err := platformConfigs(platform, notification, state.Defaults)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, api.ErrorResponse{Error: err.Error(), ClientRef: in.ClientRef})
+		return
+	}
+	if in.Topic != "" {
+		android = broadcastAndroid(android, in.Topic, state.Defaults)
+	}
+
+	message := &messaging.Message{
+		Token:        state.normalizeToken(in.To + in.Token),
+		Topic:        in.Topic,
+		Condition:    in.Condition,
+		Notification: notification,
+		Data:         data,
+		Android:      android,
+		APNS:         apns,
+		Webpush:      webpushConfig(platform, data),
+		FCMOptions:   fcmOptions(platform, notification),
+	}
+	state.applyQuietHours(message)
+
+	// Round trip through the SDK's JSON, the form FCM receives, so the size
+	// warning measures what would be sent.
+	raw, err := json.Marshal(message)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, api.ErrorResponse{Error: fmt.Sprintf("invalid message: %s", err), ClientRef: in.ClientRef})
+		return
+	}
+	var rendered map[string]any
+	json.Unmarshal(raw, &rendered)
+	c.JSON(http.StatusOK, api.PreviewResponse{Message: rendered, Warnings: previewWarnings(message, in.PlatformInput, len(raw)), ClientRef: in.ClientRef})
+}
+
+// previewWarnings lists what is allowed but likely unintended about message.
+func previewWarnings(message *messaging.Message, p api.PlatformInput, size int) []string {
+	warnings := []string{}
+	if size > maxPayloadBytes {
+		warnings = append(warnings, fmt.Sprintf("message is %d bytes, FCM rejects payloads over %d", size, maxPayloadBytes))
+	}
+	n := message.Notification
+	if l := utf8.RuneCountInString(n.Title); l > previewTitleChars {
+		warnings = append(warnings, fmt.Sprintf("title is %d characters, devices may truncate it after about %d", l, previewTitleChars))
+	}
+	if l := utf8.RuneCountInString(n.Body); l > previewBodyChars {
+		warnings = append(warnings, fmt.Sprintf("body is %d characters, devices may truncate it after about %d", l, previewBodyChars))
+	}
+	if n.Title == "" && n.Body == "" && len(message.Data) == 0 {
+		warnings = append(warnings, "message has neither notification text nor data")
+	}
+
+	type locKey struct {
+		field, key string
+		args       []string
+	}
+	var locKeys []locKey
+	if a := p.Android; a != nil {
+		locKeys = append(locKeys, locKey{"android.body_loc_key", a.BodyLocKey, a.BodyLocArgs}, locKey{"android.title_loc_key", a.TitleLocKey, a.TitleLocArgs})
+	}
+	if a := p.APNS; a != nil {
+		locKeys = append(locKeys, locKey{"apns.loc_key", a.LocKey, a.LocArgs}, locKey{"apns.title_loc_key", a.TitleLocKey, a.TitleLocArgs})
+	}
+	for _, l := range locKeys {
+		if l.key != "" && len(l.args) == 0 {
+			warnings = append(warnings, fmt.Sprintf("%s %q has no args, fine only if the string has no placeholders", l.field, l.key))
+		}
+	}
+	return append(warnings, apnsWarnings(message)...)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+)
+
+// quietWindow is a daily window in minutes since midnight. It wraps past
+// midnight when end is before start.
+type quietWindow struct {
+	start, end int
+}
+
+func parseQuietWindow(s string) (quietWindow, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return quietWindow{}, fmt.Errorf("quiet hours window %q must look like 22:00-07:00", s)
+	}
+	var w quietWindow
+	for _, p := range []struct {
+		s   string
+		dst *int
+	}{{from, &w.start}, {to, &w.end}} {
+		t, err := time.Parse("15:04", strings.TrimSpace(p.s))
+		if err != nil {
+			return quietWindow{}, fmt.Errorf("quiet hours window %q must look like 22:00-07:00", s)
+		}
+		*p.dst = t.Hour()*60 + t.Minute()
+	}
+	return w, nil
+}
+
+func (w quietWindow) contains(minute int) bool {
+	if w.start <= w.end {
+		return minute >= w.start && minute < w.end
+	}
+	return minute >= w.start || minute < w.end
+}
+
+// quietHours strips the notification from messages sent during a quiet
+// window, so that only silent data pushes go out.
+type quietHours struct {
+	loc    *time.Location
+	global *quietWindow
+	topics map[string]*quietWindow
+}
+
+// newQuietHours returns nil when no window is configured.
+func newQuietHours(c QuietHoursConfig) (*quietHours, error) {
+	if c.Window == "" && len(c.Topics) == 0 {
+		return nil, nil
+	}
+	loc, err := time.LoadLocation(c.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid quiet_hours.timezone: %w", err)
+	}
+	q := &quietHours{loc: loc, topics: map[string]*quietWindow{}}
+	if c.Window != "" {
+		w, err := parseQuietWindow(c.Window)
+		if err != nil {
+			return nil, err
+		}
+		q.global = &w
+	}
+	for topic, window := range c.Topics {
+		// An "off" topic is never quiet, even inside the global window.
+		if window == "off" {
+			q.topics[topic] = nil
+			continue
+		}
+		w, err := parseQuietWindow(window)
+		if err != nil {
+			return nil, fmt.Errorf("quiet_hours.topics[%s]: %w", topic, err)
+		}
+		q.topics[topic] = &w
+	}
+	return q, nil
+}
+
+// active reports whether messages to topic are in their quiet window at
+// now. Sends to anything but a topic follow the global window.
+func (q *quietHours) active(topic string, now time.Time) bool {
+	if q == nil {
+		return false
+	}
+	w := q.global
+	if tw, ok := q.topics[canonicalTopic(topic)]; ok && topic != "" {
+		w = tw
+	}
+	if w == nil {
+		return false
+	}
+	local := now.In(q.loc)
+	return w.contains(local.Hour()*60 + local.Minute())
+}
+
+// applyQuietHours turns message into a silent data push when its target is
+// in quiet hours.
+func (s *AppState) applyQuietHours(message *messaging.Message) {
+	if s.QuietHours.active(message.Topic, time.Now()) {
+		message.Notification, message.Webpush = nil, nil
+		message.Android, message.APNS = silencedConfigs(message.Android, message.APNS)
+	}
+}
+
+// applyQuietHoursMulticast is applyQuietHours for token sends, which follow
+// the global window.
+func (s *AppState) applyQuietHoursMulticast(message *messaging.MulticastMessage) {
+	if s.QuietHours.active("", time.Now()) {
+		message.Notification, message.Webpush = nil, nil
+		message.Android, message.APNS = silencedConfigs(message.Android, message.APNS)
+	}
+}
+
+// silencedConfigs drops everything the devices would show or play and marks
+// the APNs payload as a background push.
+func silencedConfigs(android *messaging.AndroidConfig, apns *messaging.APNSConfig) (*messaging.AndroidConfig, *messaging.APNSConfig) {
+	if android != nil {
+		android.Notification = nil
+	}
+	if apns == nil {
+		apns = &messaging.APNSConfig{}
+	}
+	if apns.Headers == nil {
+		apns.Headers = map[string]string{}
+	}
+	apns.Headers["apns-push-type"] = "background"
+	// Apple rejects background pushes sent at priority 10.
+	apns.Headers["apns-priority"] = "5"
+	if apns.Payload == nil {
+		apns.Payload = &messaging.APNSPayload{}
+	}
+	if apns.Payload.Aps == nil {
+		apns.Payload.Aps = &messaging.Aps{}
+	}
+	aps := apns.Payload.Aps
+	aps.Alert, aps.AlertString, aps.Sound, aps.CriticalSound, aps.Badge = nil, "", "", nil, nil
+	aps.MutableContent = false
+	aps.ContentAvailable = true
+	return android, apns
+}
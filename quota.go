@@ -0,0 +1,186 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"firebase.google.com/go/v4/errorutils"
+	"firebase.google.com/go/v4/messaging"
+	"github.com/baakel/go_fcm/api"
+	"github.com/charmbracelet/log"
+	"github.com/gin-gonic/gin"
+)
+
+// QueuedError is returned by FCMClient.Send instead of a quota exceeded
+// error when the message was parked to be sent once the quota resets.
+type QueuedError struct {
+	Handle string
+	SendAt time.Time
+}
+
+func (e *QueuedError) Error() string {
+	return fmt.Sprintf("quota exceeded, message %s queued until %s", e.Handle, e.SendAt.Format(time.RFC3339))
+}
+
+// queuedSend returns the QueuedError in err, if any.
+func queuedSend(err error) *QueuedError {
+	var q *QueuedError
+	if errors.As(err, &q) {
+		return q
+	}
+	return nil
+}
+
+// respondQueued answers 202 with the queue handle when err says the send
+// was parked, and reports whether it did.
+func respondQueued(c *gin.Context, err error, clientRef string) bool {
+	q := queuedSend(err)
+	if q == nil {
+		return false
+	}
+	requestLog(c).Info("queued message until the FCM quota resets", "handle", q.Handle, "send_at", q.SendAt, "client_ref", clientRef)
+	c.JSON(http.StatusAccepted, sendResponse(c, 0, api.SendResponse{Queued: true, Handle: q.Handle, SendAt: &q.SendAt, ClientRef: clientRef}))
+	return true
+}
+
+type quotaQueueKey struct{}
+
+// withQuotaQueue marks ctx as allowing a send to be parked in the quota
+// queue. Callers that need the outcome synchronously leave it unmarked.
+func withQuotaQueue(ctx context.Context, allow bool) context.Context {
+	if !allow {
+		return ctx
+	}
+	return context.WithValue(ctx, quotaQueueKey{}, true)
+}
+
+// quotaQueue holds messages FCM refused for quota until the quota window
+// resets. It keeps at most size messages; parking one more spills the
+// oldest to the dead letter sink.
+type quotaQueue struct {
+	size         int
+	defaultDelay time.Duration
+	timeout      time.Duration
+	deadLetters  DeadLetterSink
+
+	mu     sync.Mutex
+	order  *list.List
+	closed bool
+}
+
+type parkedMessage struct {
+	handle  string
+	message *messaging.Message
+	err     error
+	timer   *time.Timer
+	spilled bool
+}
+
+// newQuotaQueue returns nil when the queue is disabled.
+func newQuotaQueue(c QuotaQueueConfig, fcmTimeout time.Duration, deadLetters DeadLetterSink) *quotaQueue {
+	if !c.Enabled {
+		return nil
+	}
+	return &quotaQueue{
+		size:         c.Size,
+		defaultDelay: c.DefaultDelay,
+		timeout:      fcmTimeout,
+		deadLetters:  deadLetters,
+		order:        list.New(),
+	}
+}
+
+// park queues message when err is a quota error and ctx allows it, and
+// returns the QueuedError to hand back in place of err. send is called with
+// the message once the delay FCM asked for has passed.
+func (q *quotaQueue) park(ctx context.Context, message *messaging.Message, err error, send func(context.Context, *messaging.Message)) error {
+	if q == nil || !messaging.IsQuotaExceeded(err) || ctx.Value(quotaQueueKey{}) == nil {
+		return nil
+	}
+	delay := q.defaultDelay
+	if resp := errorutils.HTTPResponse(err); resp != nil {
+		if secs, convErr := strconv.Atoi(resp.Header.Get("Retry-After")); convErr == nil && secs > 0 {
+			delay = time.Duration(secs) * time.Second
+		}
+	}
+
+	p := &parkedMessage{handle: randomHex(8), message: message, err: err}
+	q.mu.Lock()
+	if q.closed {
+		// Shutting down: nothing would send it, so the caller gets the error.
+		q.mu.Unlock()
+		return nil
+	}
+	for q.order.Len() >= q.size {
+		oldest := q.order.Remove(q.order.Front()).(*parkedMessage)
+		oldest.timer.Stop()
+		oldest.spilled = true
+		log.Warn("quota queue full, dead-lettering oldest message", "handle", oldest.handle)
+		writeDeadLetter(q.deadLetters, "quota_queue", oldest.message, oldest.err)
+	}
+	e := q.order.PushBack(p)
+	p.timer = time.AfterFunc(delay, func() {
+		q.mu.Lock()
+		spilled := p.spilled
+		q.order.Remove(e)
+		q.mu.Unlock()
+		if spilled {
+			return
+		}
+
+		ctx := withQuotaQueue(context.Background(), true)
+		if q.timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, q.timeout)
+			defer cancel()
+		}
+		send(ctx, p.message)
+	})
+	q.mu.Unlock()
+
+	return &QueuedError{Handle: p.handle, SendAt: time.Now().Add(delay).UTC()}
+}
+
+// flush dead-letters every parked message whose send has not started yet,
+// as the process is about to exit and the callers were already answered
+// 202. Messages parked afterwards fail with their quota error instead.
+func (q *quotaQueue) flush() {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	flushed := 0
+	for e := q.order.Front(); e != nil; {
+		next := e.Next()
+		p := e.Value.(*parkedMessage)
+		if p.timer.Stop() {
+			q.order.Remove(e)
+			p.spilled = true
+			writeDeadLetter(q.deadLetters, "quota_queue", p.message, p.err)
+			flushed++
+		}
+		// A timer that already fired is sending its message; leave it be.
+		e = next
+	}
+	if flushed > 0 {
+		log.Warn("dead-lettered parked messages on shutdown", "count", flushed)
+	}
+}
+
+// len reports the number of parked messages.
+func (q *quotaQueue) len() int {
+	if q == nil {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.order.Len()
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/baakel/go_fcm/api"
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimitMiddleware applies the global token bucket from the current
+// settings to every request. A zero requests per second disables the limit.
+// With a shared store the replicas count together instead, allowing the
+// configured rate per one second window, or the burst when it is larger.
+func RateLimitMiddleware(state *AppState) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limiter := state.Settings().limiter
+		allowed := true
+		switch {
+		case limiter == nil:
+		case state.SharedRateLimit != nil:
+			window := strconv.FormatInt(time.Now().Unix(), 10)
+			n, err := state.SharedRateLimit.Incr(c, window, 2*time.Second)
+			if err != nil {
+				// Rather than failing every request, limit this replica alone.
+				requestLog(c).Warn("shared rate limit unavailable, using the local one", "error", err)
+				allowed = limiter.Allow()
+				break
+			}
+			allowed = n <= max(int64(math.Ceil(float64(limiter.Limit()))), int64(limiter.Burst()))
+		default:
+			allowed = limiter.Allow()
+		}
+		if !allowed {
+			c.JSON(http.StatusTooManyRequests, api.ErrorResponse{Error: "rate limit exceeded"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
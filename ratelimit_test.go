@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Replicas sharing a store get the configured rate per second, even when the
+// burst is smaller.
+func TestSharedRateLimitAllowsRate(t *testing.T) {
+	srv, state := newTestServer(t, &fakeMessenger{}, func(c *Config) {
+		c.RateLimit.RequestsPerSecond = 10
+		c.RateLimit.Burst = 2
+	})
+	state.SharedRateLimit = newMemoryStore(4)
+
+	// The count restarts every second, so try again if one starts midway.
+	for range 3 {
+		second := time.Now().Unix()
+		var statuses []int
+		for range 11 {
+			statuses = append(statuses, request(t, srv, http.MethodGet, "/templates", "").StatusCode)
+		}
+		if time.Now().Unix() != second {
+			continue
+		}
+		for i, status := range statuses[:10] {
+			if status != http.StatusOK {
+				t.Fatalf("request %d: status %d, want %d", i, status, http.StatusOK)
+			}
+		}
+		if statuses[10] != http.StatusTooManyRequests {
+			t.Fatalf("request over the rate: status %d, want %d", statuses[10], http.StatusTooManyRequests)
+		}
+		return
+	}
+	t.Skip("every attempt straddled a second boundary")
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisPoolSize is the number of idle connections kept open to Redis.
+const redisPoolSize = 16
+
+// redisStore is a Store backed by Redis. It speaks just enough RESP for the
+// handful of commands the Store needs, which keeps a client library out of
+// the dependencies.
+type redisStore struct {
+	addr     string
+	username string
+	password string
+	db       int
+	tls      *tls.Config
+	timeout  time.Duration
+
+	idle chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// redisError is an error reply from the server, as opposed to a network
+// failure.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// newRedisStore parses a redis:// or rediss:// URL. Connections are made on
+// first use, so an unreachable server does not keep the relay from starting.
+func newRedisStore(rawURL string, timeout time.Duration) (*redisStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing redis URL: %w", err)
+	}
+	r := &redisStore{addr: u.Host, timeout: timeout, idle: make(chan *redisConn, redisPoolSize)}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		r.tls = &tls.Config{ServerName: u.Hostname()}
+	default:
+		return nil, fmt.Errorf("redis URL scheme must be redis or rediss, got %q", u.Scheme)
+	}
+	if u.Port() == "" {
+		r.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		r.username = u.User.Username()
+		r.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if r.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("redis URL database must be a number, got %q", db)
+		}
+	}
+	return r, nil
+}
+
+func (r *redisStore) dial(ctx context.Context) (*redisConn, error) {
+	d := net.Dialer{Timeout: r.timeout}
+	conn, err := d.DialContext(ctx, "tcp", r.addr)
+	if err != nil {
+		return nil, err
+	}
+	if r.tls != nil {
+		conn = tls.Client(conn, r.tls)
+	}
+	c := &redisConn{Conn: conn, r: bufio.NewReader(conn)}
+	var setup [][]string
+	switch {
+	case r.password != "" && r.username != "":
+		setup = append(setup, []string{"AUTH", r.username, r.password})
+	case r.password != "":
+		setup = append(setup, []string{"AUTH", r.password})
+	}
+	if r.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(r.db)})
+	}
+	for _, args := range setup {
+		if _, err := r.roundTrip(ctx, c, args); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// do runs one command on a pooled connection.
+func (r *redisStore) do(ctx context.Context, args ...string) (any, error) {
+	var c *redisConn
+	select {
+	case c = <-r.idle:
+	default:
+		var err error
+		if c, err = r.dial(ctx); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := r.roundTrip(ctx, c, args)
+	var rerr redisError
+	if err != nil && !errors.As(err, &rerr) {
+		// The connection state is unknown after a network error.
+		c.Close()
+		return nil, err
+	}
+	select {
+	case r.idle <- c:
+	default:
+		c.Close()
+	}
+	return reply, err
+}
+
+func (r *redisStore) roundTrip(ctx context.Context, c *redisConn, args []string) (any, error) {
+	deadline := time.Now().Add(r.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := c.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(c, b.String()); err != nil {
+		return nil, err
+	}
+	return readReply(c.r)
+}
+
+// readReply reads one simple string, error, integer or bulk string reply. A
+// nil bulk string is returned as nil.
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad bulk length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
+
+func (r *redisStore) Get(ctx context.Context, key string) (string, bool, error) {
+	reply, err := r.do(ctx, "GET", key)
+	if err != nil || reply == nil {
+		return "", false, err
+	}
+	v, ok := reply.(string)
+	if !ok {
+		return "", false, fmt.Errorf("redis: unexpected GET reply %v", reply)
+	}
+	return v, true, nil
+}
+
+func (r *redisStore) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	_, err := r.do(ctx, "SET", key, value, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
+
+func (r *redisStore) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	// Creating the counter with its expiry first keeps the two steps safe
+	// against other replicas: INCR leaves an existing expiry alone.
+	if _, err := r.do(ctx, "SET", key, "0", "PX", strconv.FormatInt(ttl.Milliseconds(), 10), "NX"); err != nil {
+		return 0, err
+	}
+	reply, err := r.do(ctx, "INCR", key)
+	if err != nil {
+		return 0, err
+	}
+	n, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: unexpected INCR reply %v", reply)
+	}
+	return n, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+	"github.com/baakel/go_fcm/api"
+	"github.com/charmbracelet/log"
+	"golang.org/x/oauth2"
+)
+
+// reinitClient rebuilds its messaging client when a call fails because the
+// credentials stopped working, then retries the call once. Rebuilds are at
+// least cooldown apart so that a revoked key doesn't cause a rebuild storm.
+type reinitClient struct {
+	project  string
+	build    func() (Messenger, error)
+	cooldown time.Duration
+
+	mu         sync.Mutex
+	inner      Messenger
+	lastReinit time.Time
+}
+
+func newReinitClient(project string, inner Messenger, cooldown time.Duration, build func() (Messenger, error)) *reinitClient {
+	return &reinitClient{project: project, inner: inner, cooldown: cooldown, build: build}
+}
+
+// isCredentialError reports whether err means our credentials were rejected
+// or could not be refreshed.
+func isCredentialError(err error) bool {
+	var retrieve *oauth2.RetrieveError
+	return fcmErrorCode(err) == api.ErrCodeUnauthenticated || errors.As(err, &retrieve)
+}
+
+func (r *reinitClient) current() Messenger {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.inner
+}
+
+// reinit rebuilds the client after a credential error and reports whether
+// the failed call is worth retrying.
+func (r *reinitClient) reinit(err error) bool {
+	if !isCredentialError(err) {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.lastReinit) < r.cooldown {
+		return false
+	}
+	r.lastReinit = time.Now()
+
+	inner, buildErr := r.build()
+	if buildErr != nil {
+		log.Error("error re-initialising messaging client", "project", r.project, "error", buildErr)
+		return false
+	}
+	r.inner = inner
+	log.Warn("re-initialised messaging client after a credential error", "project", r.project, "error", err)
+	return true
+}
+
+func withReinit[T any](r *reinitClient, call func(Messenger) (T, error)) (T, error) {
+	v, err := call(r.current())
+	if err != nil && r.reinit(err) {
+		return call(r.current())
+	}
+	return v, err
+}
+
+func (r *reinitClient) Send(ctx context.Context, message *messaging.Message) (string, error) {
+	return withReinit(r, func(m Messenger) (string, error) { return m.Send(ctx, message) })
+}
+
+func (r *reinitClient) SendDryRun(ctx context.Context, message *messaging.Message) (string, error) {
+	return withReinit(r, func(m Messenger) (string, error) { return m.SendDryRun(ctx, message) })
+}
+
+// SendEachForMulticast retries only when every message failed on
+// credentials, so that no device gets a message twice.
+func (r *reinitClient) SendEachForMulticast(ctx context.Context, message *messaging.MulticastMessage) (*messaging.BatchResponse, error) {
+	resp, err := withReinit(r, func(m Messenger) (*messaging.BatchResponse, error) {
+		return m.SendEachForMulticast(ctx, message)
+	})
+	if err != nil || resp.SuccessCount > 0 || len(resp.Responses) == 0 {
+		return resp, err
+	}
+	for _, res := range resp.Responses {
+		if !isCredentialError(res.Error) {
+			return resp, nil
+		}
+	}
+	if r.reinit(resp.Responses[0].Error) {
+		return r.current().SendEachForMulticast(ctx, message)
+	}
+	return resp, nil
+}
+
+func (r *reinitClient) SendEachForMulticastDryRun(ctx context.Context, message *messaging.MulticastMessage) (*messaging.BatchResponse, error) {
+	return withReinit(r, func(m Messenger) (*messaging.BatchResponse, error) {
+		return m.SendEachForMulticastDryRun(ctx, message)
+	})
+}
+
+func (r *reinitClient) SubscribeToTopic(ctx context.Context, tokens []string, topic string) (*messaging.TopicManagementResponse, error) {
+	return withReinit(r, func(m Messenger) (*messaging.TopicManagementResponse, error) {
+		return m.SubscribeToTopic(ctx, tokens, topic)
+	})
+}
+
+func (r *reinitClient) UnsubscribeFromTopic(ctx context.Context, tokens []string, topic string) (*messaging.TopicManagementResponse, error) {
+	return withReinit(r, func(m Messenger) (*messaging.TopicManagementResponse, error) {
+		return m.UnsubscribeFromTopic(ctx, tokens, topic)
+	})
+}
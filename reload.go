@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/baakel/go_fcm/api"
+	"github.com/charmbracelet/log"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+)
+
+// Settings is the subset of the configuration that can change while the
+// server is running. A Settings value is never mutated once published, a
+// reload swaps in a new one.
+type Settings struct {
+	Log            LogConfig
+	RateLimit      RateLimitConfig
+	FCMTimeout     time.Duration
+	CORSOrigins    []string
+	AllowCIDRs     []*net.IPNet
+	MaxTopicTokens int
+	APIKeys        map[string]*APIKey
+
+	limiter *rate.Limiter
+	// keyIDs maps the key IDs of APIKeys back to the keys, for HMAC auth.
+	keyIDs map[string]string
+}
+
+func newSettings(cfg *Config) (*Settings, error) {
+	cidrs, err := parseCIDRs(cfg.AllowCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	apiKeys, err := cfg.APIKeys()
+	if err != nil {
+		return nil, err
+	}
+	s := &Settings{
+		Log:            cfg.Log,
+		RateLimit:      cfg.RateLimit,
+		FCMTimeout:     cfg.Timeouts.FCM,
+		CORSOrigins:    cfg.CORS.AllowedOrigins,
+		AllowCIDRs:     cidrs,
+		MaxTopicTokens: cfg.Topics.MaxTokens,
+		APIKeys:        apiKeys,
+		keyIDs:         make(map[string]string, len(apiKeys)),
+	}
+	for k := range apiKeys {
+		s.keyIDs[keyID(k)] = k
+	}
+	if rps := cfg.RateLimit.RequestsPerSecond; rps > 0 {
+		burst := cfg.RateLimit.Burst
+		if burst == 0 {
+			burst = int(rps) + 1
+		}
+		s.limiter = rate.NewLimiter(rate.Limit(rps), burst)
+	}
+	return s, nil
+}
+
+// Reloader re-reads the config file and applies the reloadable settings.
+type Reloader struct {
+	mu         sync.Mutex
+	configFile string
+	current    *Config
+	state      *AppState
+}
+
+// ReloadResult lists the settings a reload changed and the changed settings
+// it could not apply without a restart.
+type ReloadResult struct {
+	Changed []string `json:"changed"`
+	Skipped []string `json:"skipped"`
+}
+
+func NewReloader(configFile string, cfg *Config, state *AppState) *Reloader {
+	return &Reloader{configFile: configFile, current: cfg, state: state}
+}
+
+func (r *Reloader) Reload() (*ReloadResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next, err := LoadConfig(r.configFile)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := newSettings(next)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyLogConfig(next.Log); err != nil {
+		return nil, err
+	}
+
+	prev, res := r.current, &ReloadResult{Changed: []string{}, Skipped: []string{}}
+	diff := func(name string, a, b any, reloadable bool) {
+		if reflect.DeepEqual(a, b) {
+			return
+		}
+		if !reloadable {
+			res.Skipped = append(res.Skipped, name)
+			return
+		}
+		res.Changed = append(res.Changed, fmt.Sprintf("%s: %v -> %v", name, a, b))
+	}
+	diff("log.level", prev.Log.Level, next.Log.Level, true)
+	diff("log.format", prev.Log.Format, next.Log.Format, true)
+	diff("log.payloads", prev.Log.Payloads, next.Log.Payloads, true)
+	diff("rate_limit", prev.RateLimit, next.RateLimit, true)
+	diff("timeouts.fcm", prev.Timeouts.FCM, next.Timeouts.FCM, true)
+	diff("cors.allowed_origins", prev.CORS.AllowedOrigins, next.CORS.AllowedOrigins, true)
+	diff("allow_cidrs", prev.AllowCIDRs, next.AllowCIDRs, true)
+	diff("trusted_proxies", prev.TrustedProxies, next.TrustedProxies, false)
+	diff("topics.max_tokens", prev.Topics.MaxTokens, next.Topics.MaxTokens, true)
+	diff("topics.import_rate", prev.Topics.ImportRate, next.Topics.ImportRate, false)
+	diff("topics.defaults_file", prev.Topics.DefaultsFile, next.Topics.DefaultsFile, false)
+	diff("listen_addr", prev.ListenAddr, next.ListenAddr, false)
+	diff("admin_listen_addr", prev.AdminListenAddr, next.AdminListenAddr, false)
+	diff("socket_mode", prev.SocketMode, next.SocketMode, false)
+	diff("log.file", logFileSettings(prev.Log), logFileSettings(next.Log), false)
+	diff("timeouts.read", prev.Timeouts.Read, next.Timeouts.Read, false)
+	diff("timeouts.write", prev.Timeouts.Write, next.Timeouts.Write, false)
+	diff("timeouts.idle", prev.Timeouts.Idle, next.Timeouts.Idle, false)
+	diff("timeouts.shutdown", prev.Timeouts.Shutdown, next.Timeouts.Shutdown, false)
+	diff("firebase", prev.Firebase, next.Firebase, false)
+	diff("auth.hmac", prev.Auth.HMAC, next.Auth.HMAC, false)
+	diff("auth.backend", prev.Auth.Backend, next.Auth.Backend, false)
+	diff("auth.introspection", prev.Auth.Introspection, next.Auth.Introspection, false)
+	diff("auth.jwt", prev.Auth.JWT, next.Auth.JWT, false)
+	// Key values stay out of the result, and the key file contents aren't
+	// part of the config, so compare the loaded keys.
+	if prevKeys := r.state.Settings().APIKeys; !reflect.DeepEqual(prevKeys, settings.APIKeys) {
+		res.Changed = append(res.Changed, fmt.Sprintf("auth keys: %d -> %d", len(prevKeys), len(settings.APIKeys)))
+	}
+	diff("reporting", prev.Reporting, next.Reporting, false)
+	diff("audit", prev.Audit, next.Audit, false)
+	diff("alerting", prev.Alerting, next.Alerting, false)
+	diff("defaults", prev.Defaults, next.Defaults, false)
+	diff("webhooks", prev.Webhooks, next.Webhooks, false)
+	diff("templates", prev.Templates, next.Templates, false)
+	diff("dead_letter", prev.DeadLetter, next.DeadLetter, false)
+	diff("fanout", prev.Fanout, next.Fanout, false)
+	diff("dedup", prev.Dedup, next.Dedup, false)
+	diff("device_limit", prev.DeviceLimit, next.DeviceLimit, false)
+	diff("quiet_hours", prev.QuietHours, next.QuietHours, false)
+	diff("tokens", prev.Tokens, next.Tokens, false)
+	diff("concurrency", prev.Concurrency, next.Concurrency, false)
+	diff("circuit_breaker", prev.CircuitBreaker, next.CircuitBreaker, false)
+	diff("retry", prev.Retry, next.Retry, false)
+	diff("quota_queue", prev.QuotaQueue, next.QuotaQueue, false)
+	diff("store", prev.Store, next.Store, false)
+	diff("http2", prev.HTTP2, next.HTTP2, false)
+	diff("tls", prev.TLS, next.TLS, false)
+	diff("compression", prev.Compression, next.Compression, false)
+	diff("debug", prev.Debug, next.Debug, false)
+	diff("features", prev.Features, next.Features, false)
+
+	r.state.settings.Store(settings)
+	r.current = next
+
+	log.Info("configuration reloaded", "changed", res.Changed, "skipped", res.Skipped)
+	return res, nil
+}
+
+func logFileSettings(c LogConfig) LogConfig {
+	c.Level, c.Format = "", ""
+	return c
+}
+
+// WatchSIGHUP reloads the configuration every time the process gets SIGHUP.
+func (r *Reloader) WatchSIGHUP() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			if _, err := r.Reload(); err != nil {
+				log.Error("error reloading configuration, keeping previous settings", "error", err)
+			}
+		}
+	}()
+}
+
+func (r *Reloader) Handler(c *gin.Context) {
+	res, err := r.Reload()
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, api.ErrorResponse{Error: fmt.Sprintf("error reloading configuration: %s", err)})
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+func CORSMiddleware(state *AppState) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin != "" && originAllowed(state.Settings().CORSOrigins, origin) {
+			c.Header("Access-Control-Allow-Origin", origin)
+			c.Header("Vary", "Origin")
+			c.Header("Access-Control-Expose-Headers", "ETag")
+			if c.Request.Method == http.MethodOptions {
+				c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+				c.Header("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match, If-None-Match")
+				c.AbortWithStatus(http.StatusNoContent)
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+func originAllowed(allowed []string, origin string) bool {
+	for _, o := range allowed {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+func AllowlistMiddleware(state *AppState) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cidrs := state.Settings().AllowCIDRs
+		if len(cidrs) == 0 {
+			c.Next()
+			return
+		}
+		ip := net.ParseIP(c.ClientIP())
+		for _, n := range cidrs {
+			if ip != nil && n.Contains(ip) {
+				c.Next()
+				return
+			}
+		}
+		c.JSON(http.StatusForbidden, api.ErrorResponse{Error: "Forbidden: client address not allowed"})
+		c.Abort()
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/baakel/go_fcm/api"
+	"github.com/charmbracelet/log"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	reportQueueSize = 64
+	// authErrorThreshold consecutive FCM auth failures within authErrorWindow
+	// trigger a report.
+	authErrorThreshold = 3
+	authErrorWindow    = time.Minute
+)
+
+// ErrorEvent is what gets reported. It deliberately carries no tokens or
+// payload bodies.
+type ErrorEvent struct {
+	Message   string    `json:"message"`
+	Level     string    `json:"level"`
+	Route     string    `json:"route,omitempty"`
+	Method    string    `json:"method,omitempty"`
+	Status    int       `json:"status,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	Time      time.Time `json:"time"`
+	// Trace is passed on as headers by the webhook sink and as tags by
+	// Sentry.
+	Trace traceContext `json:"-"`
+}
+
+type reportSink interface {
+	send(ev ErrorEvent) error
+}
+
+// Reporter delivers ErrorEvents to a sink from a background goroutine so that
+// reporting never adds latency to a request. A nil *Reporter is disabled.
+type Reporter struct {
+	sink   reportSink
+	events chan ErrorEvent
+
+	mu         sync.Mutex
+	authErrors int
+	firstAuth  time.Time
+}
+
+// NewReporter returns nil when no reporting destination is configured.
+func NewReporter(c ReportingConfig) (*Reporter, error) {
+	var sink reportSink
+	switch {
+	case c.SentryDSN != "":
+		s, err := newSentrySink(c.SentryDSN)
+		if err != nil {
+			return nil, err
+		}
+		sink = s
+	case c.WebhookURL != "":
+		sink = webhookSink{url: c.WebhookURL}
+	default:
+		return nil, nil
+	}
+
+	r := &Reporter{sink: sink, events: make(chan ErrorEvent, reportQueueSize)}
+	go r.run()
+	return r, nil
+}
+
+func (r *Reporter) run() {
+	for ev := range r.events {
+		if err := r.sink.send(ev); err != nil {
+			log.Warn("error reporting failed", "error", err)
+		}
+	}
+}
+
+// Report queues ev, dropping it when the queue is full.
+func (r *Reporter) Report(ev ErrorEvent) {
+	if r == nil {
+		return
+	}
+	ev.Time = time.Now().UTC()
+	select {
+	case r.events <- ev:
+	default:
+		log.Warn("error report queue full, dropping event", "message", ev.Message)
+	}
+}
+
+// observeAuthError counts FCM credential failures and reports once they
+// repeat.
+func (r *Reporter) observeAuthError(c *gin.Context) {
+	r.mu.Lock()
+	now := time.Now()
+	if now.Sub(r.firstAuth) > authErrorWindow {
+		r.authErrors, r.firstAuth = 0, now
+	}
+	r.authErrors++
+	fire := r.authErrors == authErrorThreshold
+	r.mu.Unlock()
+
+	if fire {
+		r.Report(eventFor(c, "error", fmt.Sprintf("%d FCM authentication errors within %s", authErrorThreshold, authErrorWindow)))
+	}
+}
+
+// ErrorReportingMiddleware reports panics, 5xx responses and repeated FCM
+// authentication errors. It must be registered after gin.Recovery so that the
+// re-raised panic is still turned into a 500.
+func ErrorReportingMiddleware(r *Reporter) gin.HandlerFunc {
+	if r == nil {
+		return func(c *gin.Context) { c.Next() }
+	}
+	return func(c *gin.Context) {
+		defer func() {
+			if p := recover(); p != nil {
+				r.Report(eventFor(c, "fatal", fmt.Sprintf("panic: %v", p)))
+				panic(p)
+			}
+		}()
+
+		c.Next()
+
+		for _, e := range c.Errors {
+			switch fcmErrorCode(e.Err) {
+			case api.ErrCodeThirdPartyAuth, api.ErrCodeUnauthenticated, api.ErrCodePermission, api.ErrCodeSenderMismatch:
+				r.observeAuthError(c)
+			}
+		}
+		if status := c.Writer.Status(); status >= http.StatusInternalServerError {
+			r.Report(eventFor(c, "error", fmt.Sprintf("%d %s", status, http.StatusText(status))))
+		}
+	}
+}
+
+func eventFor(c *gin.Context, level, msg string) ErrorEvent {
+	return ErrorEvent{
+		Message:   msg,
+		Level:     level,
+		Route:     c.FullPath(),
+		Method:    c.Request.Method,
+		Status:    c.Writer.Status(),
+		RequestID: c.GetString("request_id"),
+		Trace:     traceFrom(c),
+	}
+}
+
+// RequestIDMiddleware propagates X-Request-ID, generating one when absent,
+// and picks up the caller's tracing headers.
+func RequestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader("X-Request-ID")
+		if id == "" {
+			id = randomHex(16)
+		}
+		c.Set("request_id", id)
+		c.Header("X-Request-ID", id)
+		c.Set("trace", traceContext{Traceparent: c.GetHeader(TraceparentHeader), CorrelationID: c.GetHeader(CorrelationIDHeader)})
+		c.Next()
+	}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+var reportClient = &http.Client{Timeout: 10 * time.Second}
+
+type webhookSink struct {
+	url string
+}
+
+func (w webhookSink) send(ev ErrorEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	return postJSON(w.url, body, ev.Trace.headers())
+}
+
+// sentrySink posts events to Sentry's store endpoint, derived from the DSN.
+type sentrySink struct {
+	endpoint string
+	auth     string
+}
+
+func newSentrySink(dsn string) (*sentrySink, error) {
+	u, err := url.Parse(dsn)
+	if err != nil || u.User == nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid SENTRY_DSN")
+	}
+	project := strings.TrimPrefix(u.Path, "/")
+	if project == "" {
+		return nil, fmt.Errorf("invalid SENTRY_DSN: missing project ID")
+	}
+	return &sentrySink{
+		endpoint: fmt.Sprintf("%s://%s/api/%s/store/", u.Scheme, u.Host, project),
+		auth:     fmt.Sprintf("Sentry sentry_version=7, sentry_client=fcmrelay/1.0, sentry_key=%s", u.User.Username()),
+	}, nil
+}
+
+func (s *sentrySink) send(ev ErrorEvent) error {
+	tags := map[string]string{
+		"route":      ev.Route,
+		"method":     ev.Method,
+		"request_id": ev.RequestID,
+	}
+	if ev.Trace.Traceparent != "" {
+		tags["traceparent"] = ev.Trace.Traceparent
+	}
+	if ev.Trace.CorrelationID != "" {
+		tags["correlation_id"] = ev.Trace.CorrelationID
+	}
+	body, err := json.Marshal(map[string]any{
+		"event_id":  randomHex(16),
+		"timestamp": ev.Time.Format(time.RFC3339),
+		"level":     ev.Level,
+		"logger":    "fcmrelay",
+		"platform":  "go",
+		"message":   ev.Message,
+		"tags":      tags,
+		"extra":     map[string]any{"status": ev.Status},
+	})
+	if err != nil {
+		return err
+	}
+	return postJSON(s.endpoint, body, map[string]string{"X-Sentry-Auth": s.auth})
+}
+
+func postJSON(url string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := reportClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// fcmRetries holds the retry policy of each kind of FCM call.
+type fcmRetries struct {
+	send, multicast, topics RetryPolicy
+}
+
+func newFCMRetries(c RetryConfig) fcmRetries {
+	return fcmRetries{
+		send:      c.policy(c.Send),
+		multicast: c.policy(c.Multicast),
+		topics:    c.policy(c.Topics),
+	}
+}
+
+// backoff is the delay after the given failed attempt, counting from 1.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.InitialInterval
+	for i := 1; i < attempt && (p.MaxInterval <= 0 || d < p.MaxInterval); i++ {
+		d *= 2
+	}
+	if p.MaxInterval > 0 && d > p.MaxInterval {
+		d = p.MaxInterval
+	}
+	if p.Jitter > 0 {
+		d += time.Duration(float64(d) * p.Jitter * (2*rand.Float64() - 1))
+	}
+	return d
+}
+
+// allows reports whether another attempt may follow the failed attempt
+// after delay. started is when the first attempt began.
+func (p RetryPolicy) allows(attempt int, started time.Time, delay time.Duration) bool {
+	if attempt >= p.MaxAttempts {
+		return false
+	}
+	return p.MaxElapsed <= 0 || time.Since(started)+delay <= p.MaxElapsed
+}
+
+// retryAttempts has the number of attempts each retried operation used,
+// for /stats.
+var retryAttempts = newHistograms(1, 2, 3, 4, 5, 7, 10)
+
+// withRetry calls call until it succeeds, fails with an error retrying can't
+// fix, or the policy runs out. The number of attempts used is recorded, and
+// logged when more than one.
+func withRetry[T any](ctx context.Context, p RetryPolicy, op string, call func() (T, error)) (T, error) {
+	started := time.Now()
+	for attempt := 1; ; attempt++ {
+		v, err := call()
+		if err == nil || !retryable(fcmErrorCode(err)) {
+			logAttempts(op, attempt, err)
+			return v, err
+		}
+		delay := p.backoff(attempt)
+		if !p.allows(attempt, started, delay) {
+			logAttempts(op, attempt, err)
+			return v, err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			logAttempts(op, attempt, err)
+			return v, err
+		}
+	}
+}
+
+func logAttempts(op string, attempts int, err error) {
+	retryAttempts.observe(op, float64(attempts))
+	if attempts > 1 {
+		log.Info("retried FCM call", "op", op, "attempts", attempts, "ok", err == nil)
+	}
+}
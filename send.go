@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+	"github.com/baakel/go_fcm/api"
+	"github.com/gin-gonic/gin"
+)
+
+// maxMulticastTokens is the FCM limit for a single SendEachForMulticast call.
+const maxMulticastTokens = 500
+
+// multicastChunk is the outcome of one SendEachForMulticast call of a fan-out.
+type multicastChunk struct {
+	offset int
+	tokens []string
+	resp   *messaging.BatchResponse
+	err    error
+	// skipped is set when ctx was cancelled before the chunk was dispatched.
+	skipped bool
+}
+
+// multicastGroup is the tokens of a multicast that get the same message,
+// and their positions in the request.
+type multicastGroup struct {
+	message *messaging.MulticastMessage
+	tokens  []string
+	indexes []int
+	chunks  []*multicastChunk
+}
+
+func (g *multicastGroup) add(token string, index int) {
+	g.tokens, g.indexes = append(g.tokens, token), append(g.indexes, index)
+}
+
+// multicastFunc is Messenger.SendEachForMulticast or its dry run.
+type multicastFunc func(context.Context, *messaging.MulticastMessage) (*messaging.BatchResponse, error)
+
+// sendChunked sends message to tokens in chunks of the configured size,
+// running up to the configured number of chunks at once. A failed chunk does
+// not stop its siblings; only cancelling ctx does, in which case the chunks
+// not yet dispatched are skipped. Chunks are returned in token order.
+func (s *AppState) sendChunked(ctx context.Context, send multicastFunc, message *messaging.MulticastMessage, tokens []string) []*multicastChunk {
+	var chunks []*multicastChunk
+	for offset := 0; offset < len(tokens); offset += s.Fanout.ChunkSize {
+		end := min(offset+s.Fanout.ChunkSize, len(tokens))
+		chunks = append(chunks, &multicastChunk{offset: offset, tokens: tokens[offset:end]})
+	}
+
+	workers := make(chan struct{}, s.Fanout.Workers)
+	var wg sync.WaitGroup
+	for _, chunk := range chunks {
+		select {
+		case workers <- struct{}{}:
+		case <-ctx.Done():
+			chunk.err, chunk.skipped = ctx.Err(), true
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer func() { <-workers; wg.Done() }()
+			// select picks at random when a worker frees up as the client
+			// goes away, so check again before spending the send.
+			if err := ctx.Err(); err != nil {
+				chunk.err, chunk.skipped = err, true
+				return
+			}
+			m := *message
+			m.Tokens = chunk.tokens
+			fcmCtx, cancel := s.fcmContext(ctx)
+			defer cancel()
+			chunk.resp, chunk.err = send(fcmCtx, &m)
+		}()
+	}
+	wg.Wait()
+	return chunks
+}
+
+func SendUnified(c *gin.Context) {
+	var in api.SendInput
+	if !bindInput(c, &in) {
+		return
+	}
+	echoInput(c, in)
+	if in.TargetCount() != 1 {
+		c.JSON(http.StatusUnprocessableEntity, api.ErrorResponse{Error: "exactly one of token, tokens, topic or condition is required", ClientRef: in.ClientRef})
+		return
+	}
+	if in.DryRun && len(in.Tokens) > 0 {
+		c.JSON(http.StatusUnprocessableEntity, api.ErrorResponse{Error: "dry_run is not supported with tokens", ClientRef: in.ClientRef})
+		return
+	}
+	if in.AllOrNothing && len(in.Tokens) == 0 {
+		c.JSON(http.StatusUnprocessableEntity, api.ErrorResponse{Error: "all_or_nothing needs tokens", ClientRef: in.ClientRef})
+		return
+	}
+
+	appState, _ := c.Get("state")
+	state := appState.(*AppState)
+	if limit := state.Fanout.MaxTokens; len(in.Tokens) > limit {
+		respondTooMany(c, "tokens", limit, in.ClientRef)
+		return
+	}
+	in.Token = state.normalizeToken(in.Token)
+	state.normalizeTokens(in.Tokens)
+
+	notification := &messaging.Notification{Title: in.Notification.Title, Body: in.Notification.Body}
+	if state.Settings().Log.Payloads {
+		requestLog(c).Info("notification", "title", notification.Title, "body", notification.Body, "token", redactToken(in.Token), "tokens", len(in.Tokens), "client_ref", in.ClientRef)
+	}
+	platform := state.TopicDefaults.apply(c, in.Topic, in.PlatformInput)
+	android, apns, err := platformConfigs(platform, notification, state.Defaults)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, api.ErrorResponse{Error: err.Error(), ClientRef: in.ClientRef})
+		return
+	}
+
+	client := state.clientFor(c, in.Project)
+	if client == nil {
+		return
+	}
+	fcmCtx, cancel := state.fcmContext(c)
+	defer cancel()
+
+	if len(in.Tokens) > 0 {
+		message := &messaging.MulticastMessage{
+			Notification: notification,
+			Data:         in.Data,
+			Android:      android,
+			APNS:         apns,
+			Webpush:      webpushConfig(in.PlatformInput, in.Data),
+			FCMOptions:   fcmOptions(in.PlatformInput, notification),
+		}
+		// Every token is deduplicated on its own. dedupKeys is indexed like
+		// in.Tokens, and duplicates maps the index of a token already sent
+		// within the window to the original message ID.
+		dedupKeys := make([]string, len(in.Tokens))
+		duplicates := map[int]string{}
+		// indexes maps the tokens sent to their position in the request.
+		var tokens []string
+		var indexes []int
+		for i, t := range in.Tokens {
+			dedupKeys[i] = state.Dedup.key(c, "token:"+t, message)
+			if id, ok := state.Dedup.lookup(c, dedupKeys[i]); ok {
+				duplicates[i] = id
+				continue
+			}
+			tokens, indexes = append(tokens, t), append(indexes, i)
+		}
+		if len(duplicates) > 0 {
+			requestLog(c).Info("dropped duplicate messages", "duplicates", len(duplicates), "tokens", len(in.Tokens), "client_ref", in.ClientRef)
+		}
+		if len(tokens) == 0 {
+			resp := api.MulticastResponse{SuccessCount: len(duplicates), DeduplicatedCount: len(duplicates), Failures: []api.MulticastFailure{}, ClientRef: in.ClientRef}
+			if c.Query("verbose") == "1" {
+				for i := range in.Tokens {
+					resp.Responses = append(resp.Responses, api.MulticastResult{Index: i, Success: true, MessageID: duplicates[i], Deduplicated: true})
+				}
+			}
+			c.JSON(http.StatusOK, resp)
+			return
+		}
+
+		failures := []api.MulticastFailure{}
+		lim := state.DeviceLimit
+		state.applyQuietHoursMulticast(message)
+		if in.AllOrNothing {
+			// Nothing is counted against the devices before the request is
+			// sure to be sent, so a rejected one costs them no quota.
+			if lim != nil && !lim.collapse {
+				for j, t := range tokens {
+					if lim.over(c, t) {
+						failures = append(failures, api.MulticastFailure{Index: indexes[j], Code: api.ErrCodeOverDeviceLimit, Error: "too many messages to this device"})
+					}
+				}
+				if len(failures) > 0 {
+					c.JSON(http.StatusTooManyRequests, api.ErrorResponse{Error: "some devices are over their message limit, nothing was sent", Code: api.ErrCodeOverDeviceLimit, Failures: failures, ClientRef: in.ClientRef})
+					return
+				}
+			}
+			if !state.validateMulticast(c, client, message, tokens, indexes, in.ClientRef) {
+				return
+			}
+		}
+
+		// Tokens over their device limit are rejected, or in collapse mode
+		// sent apart with the collapse key, which the other devices must not
+		// get.
+		normal := &multicastGroup{message: message}
+		collapsed := &multicastGroup{}
+		for j, t := range tokens {
+			switch {
+			case lim.allow(c, t):
+				normal.add(t, indexes[j])
+			case lim.collapse:
+				collapsed.add(t, indexes[j])
+			case in.AllOrNothing:
+				// Checked before validating; it lost a race with another
+				// request since, and all or nothing still means all.
+				normal.add(t, indexes[j])
+			default:
+				failures = append(failures, api.MulticastFailure{Index: indexes[j], Code: api.ErrCodeOverDeviceLimit, Error: "too many messages to this device"})
+			}
+		}
+		var groups []*multicastGroup
+		if len(normal.tokens) > 0 {
+			groups = append(groups, normal)
+		}
+		if len(collapsed.tokens) > 0 {
+			m := *message
+			m.Android, m.APNS = collapsedConfigs(m.Android, m.APNS)
+			collapsed.message = &m
+			groups = append(groups, collapsed)
+		}
+		if len(groups) == 0 {
+			c.JSON(http.StatusTooManyRequests, api.ErrorResponse{Error: "every device is over its message limit", Code: api.ErrCodeOverDeviceLimit, ClientRef: in.ClientRef})
+			return
+		}
+
+		chunkCount, failed, skipped := 0, 0, 0
+		for _, g := range groups {
+			g.chunks = state.sendChunked(c.Request.Context(), client.SendEachForMulticast, g.message, g.tokens)
+			for _, chunk := range g.chunks {
+				chunkCount++
+				if chunk.err != nil {
+					failed++
+				}
+				if chunk.skipped {
+					skipped += len(chunk.tokens)
+				}
+			}
+		}
+		sent := len(normal.tokens) + len(collapsed.tokens)
+		if skipped > 0 {
+			requestLog(c).Warn("request cancelled, skipped undispatched chunks", "skipped", skipped, "tokens", sent, "client_ref", in.ClientRef)
+		}
+		if failed == chunkCount {
+			err := groups[0].chunks[0].err
+			state.recordSend(c, "send", fmt.Sprintf("tokens:%d", sent), notification.Title, "", err, in.ClientRef)
+			requestLog(c).Error("error sending multicast message", "error", err, "client_ref", in.ClientRef)
+			c.Error(err)
+			c.JSON(fcmErrorStatus(c, err), api.ErrorResponse{Error: fmt.Sprintf("error found while sending message: %s", err), SkippedCount: skipped, ClientRef: in.ClientRef})
+			return
+		}
+
+		var results []api.MulticastResult
+		if c.Query("verbose") == "1" {
+			results = make([]api.MulticastResult, len(in.Tokens))
+			for i := range results {
+				results[i].Index = i
+			}
+			for i, id := range duplicates {
+				results[i].Success, results[i].MessageID, results[i].Deduplicated = true, id, true
+			}
+		}
+		successes := len(duplicates)
+		for _, g := range groups {
+			for _, chunk := range g.chunks {
+				if chunk.skipped {
+					for j := 0; results != nil && j < len(chunk.tokens); j++ {
+						results[g.indexes[chunk.offset+j]].Skipped = true
+					}
+					continue
+				}
+				for j, token := range chunk.tokens {
+					index := g.indexes[chunk.offset+j]
+					err := chunk.err
+					messageID := ""
+					if err == nil {
+						r := chunk.resp.Responses[j]
+						err, messageID = r.Error, r.MessageID
+					}
+					state.recordSend(c, "send", "token:"+token, notification.Title, messageID, err, in.ClientRef)
+					if err == nil {
+						successes++
+						state.Dedup.remember(c, dedupKeys[index], messageID)
+						if results != nil {
+							results[index].Success, results[index].MessageID = true, messageID
+						}
+						continue
+					}
+					failures = append(failures, api.MulticastFailure{
+						Index:   index,
+						Code:    fcmErrorCode(err),
+						Error:   err.Error(),
+						Details: fcmFieldViolations(err),
+					})
+				}
+			}
+		}
+		// Over-limit tokens were rejected before sending and collapsed ones
+		// sent apart, so put every failure back in request order.
+		slices.SortFunc(failures, func(a, b api.MulticastFailure) int { return a.Index - b.Index })
+		if results != nil {
+			for _, f := range failures {
+				results[f.Index] = api.MulticastResult{Index: f.Index, Code: f.Code, Error: f.Error, Details: f.Details}
+			}
+		}
+		label := analyticsLabel(message.FCMOptions)
+		requestLog(c).Info("Successfully sent multicast message", "success", successes, "failure", len(failures), "chunks", chunkCount, "client_ref", in.ClientRef, "analytics_label", label)
+		c.JSON(http.StatusAccepted, api.MulticastResponse{
+			AnalyticsLabel:    label,
+			SuccessCount:      successes,
+			DeduplicatedCount: len(duplicates),
+			FailureCount:      len(failures),
+			Failures:          failures,
+			SkippedCount:      skipped,
+			ClientRef:         in.ClientRef,
+			Responses:         results,
+		})
+		return
+	}
+
+	message := singleMessage(&in, platform, notification, android, apns)
+	state.applyQuietHours(message)
+	if !explain(c, in.PlatformInput, message) {
+		return
+	}
+	if in.DryRun {
+		response, err := client.SendDryRun(fcmCtx, message)
+		if err != nil {
+			c.Error(err)
+			c.JSON(fcmErrorStatus(c, err), withDebug(c, sendError(err, in.ClientRef)))
+			return
+		}
+		c.JSON(http.StatusOK, sendResponse(c, 0, api.SendResponse{MessageID: response, DryRun: true, ClientRef: in.ClientRef}))
+		return
+	}
+
+	dedupKey := state.Dedup.key(c, in.Target(), message)
+	if id, ok := state.Dedup.lookup(c, dedupKey); ok {
+		requestLog(c).Info("dropped duplicate message", "original", id, "client_ref", in.ClientRef)
+		c.JSON(http.StatusOK, sendResponse(c, 0, api.SendResponse{Deduplicated: true, MessageID: id, ClientRef: in.ClientRef}))
+		return
+	}
+	if !state.limitDevice(c, message, in.ClientRef) {
+		return
+	}
+	start := time.Now()
+	response, err := client.Send(withBoost(withQuotaQueue(fcmCtx, !in.Sync), in.BoostOnFailure), message)
+	latency := time.Since(start)
+	if respondQueued(c, err, in.ClientRef) {
+		return
+	}
+	state.recordSend(c, "send", in.Target(), notification.Title, response, err, in.ClientRef)
+	if err != nil {
+		requestLog(c).Error("error sending message", "error", err, "client_ref", in.ClientRef)
+		c.Error(err)
+		c.JSON(fcmErrorStatus(c, err), withDebug(c, sendError(err, in.ClientRef)))
+		return
+	}
+	state.Dedup.remember(c, dedupKey, response)
+	requestLog(c).Info("Successfully sent message", "resp", response, "client_ref", in.ClientRef, "analytics_label", c.GetString("analytics_label"))
+	c.JSON(http.StatusAccepted, sendResponse(c, latency, api.SendResponse{MessageID: response, ClientRef: in.ClientRef}))
+}
+
+// singleMessage maps a single-target /send input onto the FCM message. p is
+// the input's platform settings after topic defaults.
+func singleMessage(in *api.SendInput, p api.PlatformInput, notification *messaging.Notification, android *messaging.AndroidConfig, apns *messaging.APNSConfig) *messaging.Message {
+	return &messaging.Message{
+		Token:        in.Token,
+		Topic:        in.Topic,
+		Condition:    in.Condition,
+		Notification: notification,
+		Data:         in.Data,
+		Android:      android,
+		APNS:         apns,
+		Webpush:      webpushConfig(p, in.Data),
+		FCMOptions:   fcmOptions(p, notification),
+	}
+}
+
+// validateMulticast has FCM validate message for every token before an
+// all_or_nothing send. When FCM rejects any of them it answers 400 with
+// the rejections, or the FCM error status when validation itself failed,
+// and returns false: nothing may be sent then.
+func (s *AppState) validateMulticast(c *gin.Context, client Messenger, message *messaging.MulticastMessage, tokens []string, indexes []int, clientRef string) bool {
+	chunks := s.sendChunked(c.Request.Context(), client.SendEachForMulticastDryRun, message, tokens)
+	failures := []api.MulticastFailure{}
+	for _, chunk := range chunks {
+		if err := chunk.err; err != nil {
+			requestLog(c).Error("error validating multicast message", "error", err, "client_ref", clientRef)
+			c.Error(err)
+			c.JSON(fcmErrorStatus(c, err), api.ErrorResponse{Error: fmt.Sprintf("error validating message, nothing was sent: %s", err), ClientRef: clientRef})
+			return false
+		}
+		for j, r := range chunk.resp.Responses {
+			if r.Error != nil {
+				failures = append(failures, api.MulticastFailure{
+					Index:   indexes[chunk.offset+j],
+					Code:    fcmErrorCode(r.Error),
+					Error:   r.Error.Error(),
+					Details: fcmFieldViolations(r.Error),
+				})
+			}
+		}
+	}
+	if len(failures) == 0 {
+		return true
+	}
+	requestLog(c).Info("rejected all_or_nothing multicast", "invalid", len(failures), "tokens", len(tokens), "client_ref", clientRef)
+	c.JSON(http.StatusBadRequest, api.ErrorResponse{
+		Error:     fmt.Sprintf("%d of %d tokens failed validation, nothing was sent", len(failures), len(tokens)),
+		Failures:  failures,
+		ClientRef: clientRef,
+	})
+	return false
+}
+
+// sendError is the response body for a failed single message send, with
+// FCM's field level details when it gave any.
+func sendError(err error, clientRef string) api.ErrorResponse {
+	return api.ErrorResponse{
+		Error:     fmt.Sprintf("error found while sending message: %s", err),
+		Code:      fcmErrorCode(err),
+		ClientRef: clientRef,
+		Details:   fcmFieldViolations(err),
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+	"github.com/baakel/go_fcm/api"
+)
+
+// BenchmarkSendChunked shows what more workers buy for a large multicast
+// when each FCM call takes a fixed 5ms.
+func BenchmarkSendChunked(b *testing.B) {
+	tokens := make([]string, 3200)
+	for i := range tokens {
+		tokens[i] = testToken(i)
+	}
+	message := &messaging.MulticastMessage{Notification: &messaging.Notification{Title: "T"}}
+
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			fake := &fakeMessenger{latency: 5 * time.Millisecond}
+			_, state := newTestState(b, fake, func(c *Config) {
+				c.Fanout.Workers = workers
+				c.Fanout.ChunkSize = 100
+			})
+			b.ResetTimer()
+			for range b.N {
+				state.sendChunked(context.Background(), fake.SendEachForMulticast, message, tokens)
+			}
+			b.ReportMetric(float64(b.N*len(tokens))/b.Elapsed().Seconds(), "tokens/s")
+		})
+	}
+}
+
+// TestMulticastIndexStability sends randomly sized multicasts, chunked and
+// run in parallel at random, with tokens rejected over their device limit
+// before sending and others failed by FCM. Whatever the mix, every result
+// sits at its token's position and carries its index, and the failures are
+// listed in request order.
+func TestMulticastIndexStability(t *testing.T) {
+	for seed := range uint64(50) {
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			rnd := rand.New(rand.NewPCG(seed, seed))
+			n := 1 + rnd.IntN(300)
+			allOrNothing := rnd.IntN(4) == 0
+			fake := &fakeMessenger{failTokens: map[string]error{}}
+			srv, state := newTestServer(t, fake, func(c *Config) {
+				c.Fanout.ChunkSize = 1 + rnd.IntN(50)
+				c.Fanout.Workers = 1 + rnd.IntN(8)
+			})
+			state.DeviceLimit = newDeviceLimiter(DeviceLimitConfig{Messages: 1, Window: time.Hour, Mode: "reject", CacheSize: 1000}, &Stores{})
+
+			tokens := make([]string, n)
+			var overLimit, failing []int
+			for i := range tokens {
+				tokens[i] = testToken(i)
+				switch rnd.IntN(8) {
+				case 0:
+					state.DeviceLimit.allow(context.Background(), tokens[i])
+					overLimit = append(overLimit, i)
+				case 1:
+					fake.failTokens[tokens[i]] = fmt.Errorf("token %d rejected", i)
+					failing = append(failing, i)
+				}
+			}
+			body, _ := json.Marshal(map[string]any{"tokens": tokens, "notification": map[string]string{"title": "T"}, "all_or_nothing": allOrNothing})
+			resp := post(t, srv, "/send?verbose=1", string(body))
+			var out api.MulticastResponse
+			if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+				t.Fatal(err)
+			}
+
+			// All or nothing stops at the first check tokens fail, and
+			// sending stops when every token is over its limit.
+			switch {
+			case allOrNothing && len(overLimit) > 0:
+				checkFailureIndexes(t, resp, http.StatusTooManyRequests, out.Failures, overLimit)
+				return
+			case allOrNothing && len(failing) > 0:
+				checkFailureIndexes(t, resp, http.StatusBadRequest, out.Failures, failing)
+				return
+			case len(overLimit) == n:
+				if resp.StatusCode != http.StatusTooManyRequests {
+					t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+				}
+				return
+			}
+			failed := slices.Sorted(slices.Values(append(slices.Clone(overLimit), failing...)))
+			checkFailureIndexes(t, resp, http.StatusAccepted, out.Failures, failed)
+
+			if out.SuccessCount != n-len(failed) || out.FailureCount != len(failed) {
+				t.Errorf("%d sent and %d failed, want %d and %d", out.SuccessCount, out.FailureCount, n-len(failed), len(failed))
+			}
+			if len(out.Responses) != n {
+				t.Fatalf("%d results for %d tokens", len(out.Responses), n)
+			}
+			for i, r := range out.Responses {
+				want := api.MulticastResult{Index: i, Success: true}
+				switch {
+				case slices.Contains(overLimit, i):
+					want = api.MulticastResult{Index: i, Code: api.ErrCodeOverDeviceLimit, Error: "too many messages to this device"}
+				case slices.Contains(failing, i):
+					want = api.MulticastResult{Index: i, Code: api.ErrCodeUnknown, Error: fmt.Sprintf("token %d rejected", i)}
+				default:
+					want.MessageID = r.MessageID
+				}
+				if !reflect.DeepEqual(r, want) {
+					t.Errorf("result %d is %+v, want %+v", i, r, want)
+				}
+			}
+
+			var sent []string
+			for _, m := range fake.messages() {
+				sent = append(sent, m.Token)
+			}
+			slices.Sort(sent)
+			if allOrNothing {
+				// FCM validated every token before they were sent.
+				sent = slices.Compact(sent)
+			}
+			var want []string
+			for i, token := range tokens {
+				if !slices.Contains(overLimit, i) {
+					want = append(want, token)
+				}
+			}
+			if !slices.Equal(sent, want) {
+				t.Errorf("FCM got %d tokens, want each of the %d within their limit once", len(sent), len(want))
+			}
+		})
+	}
+}
+
+// checkFailureIndexes checks the status and that failures are exactly the
+// tokens at want, in request order.
+func checkFailureIndexes(t *testing.T, resp *http.Response, status int, failures []api.MulticastFailure, want []int) {
+	t.Helper()
+	if resp.StatusCode != status {
+		t.Fatalf("status %d, want %d", resp.StatusCode, status)
+	}
+	got := make([]int, len(failures))
+	for i, f := range failures {
+		got[i] = f.Index
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("failures at %v, want %v", got, want)
+	}
+}
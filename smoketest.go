@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/baakel/go_fcm/api"
+	"github.com/baakel/go_fcm/client"
+)
+
+// smokeStep is one check of the smoketest command.
+type smokeStep struct {
+	name string
+	// real steps deliver to the device and are left out by --skip-real-send.
+	real bool
+	run  func(ctx context.Context) (string, error)
+}
+
+// runSmoketest exercises a running relay the way a deploy check would and
+// prints a pass/fail table.
+func runSmoketest(args []string) int {
+	fs := flag.NewFlagSet("smoketest", flag.ContinueOnError)
+	baseURL := fs.String("base-url", "", "relay base URL, e.g. https://push.example.com")
+	apiKey := fs.String("api-key", os.Getenv("FCMRELAY_API_KEY"), "API key (env FCMRELAY_API_KEY)")
+	token := fs.String("token", "", "registration token of a test device")
+	timeout := fs.Duration("timeout", 10*time.Second, "timeout of each step")
+	skipRealSend := fs.Bool("skip-real-send", false, "skip the steps that deliver to the test device")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if *baseURL == "" || *token == "" {
+		fmt.Fprintln(os.Stderr, "--base-url and --token are required")
+		return exitUsage
+	}
+
+	c := client.New(*baseURL, *apiKey)
+	topic := "smoketest-" + randomHex(4)
+	notification := api.Notification{Title: "fcmrelay smoketest", Body: "Sent " + time.Now().UTC().Format(time.RFC3339)}
+	steps := []smokeStep{
+		{name: "readyz", run: func(ctx context.Context) (string, error) {
+			return "", c.Ready(ctx)
+		}},
+		{name: "dry-run send", run: func(ctx context.Context) (string, error) {
+			resp, err := c.Send(ctx, api.SendInput{Token: *token, Notification: notification, DryRun: true})
+			if err != nil {
+				return "", err
+			}
+			return resp.MessageID, nil
+		}},
+		{name: "publish", real: true, run: func(ctx context.Context) (string, error) {
+			resp, err := c.PublishToken(ctx, api.PublishInput{Token: *token, Notification: notification, Sync: true})
+			if err != nil {
+				return "", err
+			}
+			return resp.MessageID, nil
+		}},
+		{name: "subscribe", run: func(ctx context.Context) (string, error) {
+			resp, err := c.Subscribe(ctx, api.SubscribeInput{Tokens: []string{*token}, Topic: topic})
+			if err != nil {
+				return "", err
+			}
+			return resp.Topic, nil
+		}},
+		{name: "unsubscribe", run: func(ctx context.Context) (string, error) {
+			resp, err := c.Unsubscribe(ctx, api.SubscribeInput{Tokens: []string{*token}, Topic: topic})
+			if err != nil {
+				return "", err
+			}
+			return resp.Topic, nil
+		}},
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STEP\tRESULT\tTIME\tDETAIL")
+	failed := 0
+	for _, step := range steps {
+		if step.real && *skipRealSend {
+			fmt.Fprintf(w, "%s\tSKIP\t-\t--skip-real-send\n", step.name)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		start := time.Now()
+		detail, err := step.run(ctx)
+		elapsed := time.Since(start).Round(time.Millisecond)
+		cancel()
+		result := "PASS"
+		if err != nil {
+			result, detail = "FAIL", err.Error()
+			failed++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", step.name, result, elapsed, detail)
+	}
+	w.Flush()
+
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d steps failed\n", failed, len(steps))
+		return exitFailure
+	}
+	return exitOK
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+)
+
+// histogram counts observations into buckets by upper bound, for /stats. It
+// is safe for concurrent use.
+type histogram struct {
+	bounds []float64
+
+	mu     sync.Mutex
+	counts []int64 // one per bound, then one for everything above the last
+	count  int64
+	sum    float64
+}
+
+// newHistogram returns a histogram with the given ascending bucket bounds.
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]int64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.count++
+	h.sum += v
+}
+
+// histogramBucket is the number of observations at or below LE, which is
+// "+Inf" for the last bucket.
+type histogramBucket struct {
+	LE    string `json:"le"`
+	Count int64  `json:"count"`
+}
+
+type histogramSnapshot struct {
+	Count   int64             `json:"count"`
+	Sum     float64           `json:"sum"`
+	Buckets []histogramBucket `json:"buckets"`
+}
+
+// snapshot returns the histogram with cumulative bucket counts, as
+// Prometheus has them.
+func (h *histogram) snapshot() histogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := histogramSnapshot{Count: h.count, Sum: h.sum, Buckets: make([]histogramBucket, 0, len(h.counts))}
+	var cumulative int64
+	for i, n := range h.counts {
+		cumulative += n
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = strconv.FormatFloat(h.bounds[i], 'g', -1, 64)
+		}
+		s.Buckets = append(s.Buckets, histogramBucket{LE: le, Count: cumulative})
+	}
+	return s
+}
+
+// histograms is a set of histograms with the same bounds, one per name,
+// created on first use.
+type histograms struct {
+	bounds []float64
+
+	mu  sync.Mutex
+	set map[string]*histogram
+}
+
+func newHistograms(bounds ...float64) *histograms {
+	return &histograms{bounds: bounds, set: map[string]*histogram{}}
+}
+
+func (h *histograms) observe(name string, v float64) {
+	h.mu.Lock()
+	hist, ok := h.set[name]
+	if !ok {
+		hist = newHistogram(h.bounds...)
+		h.set[name] = hist
+	}
+	h.mu.Unlock()
+	hist.observe(v)
+}
+
+func (h *histograms) snapshot() map[string]histogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := make(map[string]histogramSnapshot, len(h.set))
+	for name, hist := range h.set {
+		s[name] = hist.snapshot()
+	}
+	return s
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHistogramSnapshot(t *testing.T) {
+	h := newHistogram(1, 5)
+	for _, v := range []float64{0, 1, 3, 7} {
+		h.observe(v)
+	}
+	want := histogramSnapshot{
+		Count: 4,
+		Sum:   11,
+		Buckets: []histogramBucket{
+			{LE: "1", Count: 2},
+			{LE: "5", Count: 3},
+			{LE: "+Inf", Count: 4},
+		},
+	}
+	if got := h.snapshot(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// Store is the key-value state the dedup window, the device limit and the
+// rate limit keep. The in-memory store is private to one replica; the Redis
+// store is shared by all of them.
+type Store interface {
+	// Get returns the value of key, and false when it is missing or expired.
+	Get(ctx context.Context, key string) (string, bool, error)
+	// Set stores value under key for ttl.
+	Set(ctx context.Context, key, value string, ttl time.Duration) error
+	// Incr adds one to the counter at key and returns the new count. A new
+	// counter expires ttl after it was created; incrementing does not extend
+	// it.
+	Incr(ctx context.Context, key string, ttl time.Duration) (int64, error)
+}
+
+// Stores hands out a Store per consumer, all backed by the same Redis
+// connection pool when one is configured.
+type Stores struct {
+	redis    *redisStore
+	failOpen bool
+}
+
+func newStores(c StoreConfig) (*Stores, error) {
+	s := &Stores{failOpen: c.OnError == "open"}
+	if c.RedisURL == "" {
+		return s, nil
+	}
+	redis, err := newRedisStore(c.RedisURL, c.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	s.redis = redis
+	return s, nil
+}
+
+// Shared reports whether the stores are shared between replicas.
+func (s *Stores) Shared() bool {
+	return s.redis != nil
+}
+
+// open returns the store for one consumer. Its keys are namespaced by
+// prefix in Redis; in memory it holds at most size keys, forgetting the least
+// recently used first.
+func (s *Stores) open(prefix string, size int) Store {
+	memory := newMemoryStore(size)
+	if s.redis == nil {
+		return memory
+	}
+	return &degradingStore{
+		name:     prefix,
+		primary:  &prefixedStore{prefix: prefix + ":", inner: s.redis},
+		fallback: memory,
+		failOpen: s.failOpen,
+	}
+}
+
+// memoryStore is an LRU of expiring values.
+type memoryStore struct {
+	size int
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type memoryEntry struct {
+	key     string
+	value   string
+	expires time.Time
+}
+
+// newMemoryStore keeps at most size keys, evicting the least recently used.
+// A size below 1 is taken as 1, since put always makes room for one.
+func newMemoryStore(size int) *memoryStore {
+	return &memoryStore{size: max(size, 1), order: list.New(), entries: map[string]*list.Element{}}
+}
+
+// entry returns the live entry of key, dropping it when expired. It must be
+// called with m.mu held.
+func (m *memoryStore) entry(key string) *memoryEntry {
+	e, ok := m.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := e.Value.(*memoryEntry)
+	if !time.Now().Before(entry.expires) {
+		m.order.Remove(e)
+		delete(m.entries, key)
+		return nil
+	}
+	m.order.MoveToBack(e)
+	return entry
+}
+
+// put must be called with m.mu held.
+func (m *memoryStore) put(key, value string, ttl time.Duration) {
+	if e, ok := m.entries[key]; ok {
+		m.order.Remove(e)
+	}
+	for m.order.Len() >= m.size {
+		oldest := m.order.Front()
+		delete(m.entries, oldest.Value.(*memoryEntry).key)
+		m.order.Remove(oldest)
+	}
+	m.entries[key] = m.order.PushBack(&memoryEntry{key: key, value: value, expires: time.Now().Add(ttl)})
+}
+
+func (m *memoryStore) Get(_ context.Context, key string) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if entry := m.entry(key); entry != nil {
+		return entry.value, true, nil
+	}
+	return "", false, nil
+}
+
+func (m *memoryStore) Set(_ context.Context, key, value string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.put(key, value, ttl)
+	return nil
+}
+
+func (m *memoryStore) Incr(_ context.Context, key string, ttl time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry := m.entry(key)
+	if entry == nil {
+		m.put(key, "1", ttl)
+		return 1, nil
+	}
+	n, err := strconv.ParseInt(entry.value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a counter", key)
+	}
+	entry.value = strconv.FormatInt(n+1, 10)
+	return n + 1, nil
+}
+
+type prefixedStore struct {
+	prefix string
+	inner  Store
+}
+
+func (p *prefixedStore) Get(ctx context.Context, key string) (string, bool, error) {
+	return p.inner.Get(ctx, p.prefix+key)
+}
+
+func (p *prefixedStore) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	return p.inner.Set(ctx, p.prefix+key, value, ttl)
+}
+
+func (p *prefixedStore) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	return p.inner.Incr(ctx, p.prefix+key, ttl)
+}
+
+// degradingStore keeps a feature working while Redis is unreachable. Each
+// failed call is logged and answered by the replica's own memory, or in fail
+// open mode as if the key were missing, so that no send fails because of it.
+type degradingStore struct {
+	name     string
+	primary  Store
+	fallback Store
+	failOpen bool
+}
+
+func (d *degradingStore) degraded(op string, err error) {
+	mode := "memory"
+	if d.failOpen {
+		mode = "open"
+	}
+	log.Warn("shared store unavailable, degrading", "store", d.name, "op", op, "fallback", mode, "error", err)
+}
+
+func (d *degradingStore) Get(ctx context.Context, key string) (string, bool, error) {
+	v, ok, err := d.primary.Get(ctx, key)
+	if err == nil {
+		return v, ok, nil
+	}
+	d.degraded("get", err)
+	if d.failOpen {
+		return "", false, nil
+	}
+	return d.fallback.Get(ctx, key)
+}
+
+func (d *degradingStore) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	err := d.primary.Set(ctx, key, value, ttl)
+	if err == nil {
+		return nil
+	}
+	d.degraded("set", err)
+	if d.failOpen {
+		return nil
+	}
+	return d.fallback.Set(ctx, key, value, ttl)
+}
+
+func (d *degradingStore) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	n, err := d.primary.Incr(ctx, key, ttl)
+	if err == nil {
+		return n, nil
+	}
+	d.degraded("incr", err)
+	if d.failOpen {
+		// Nothing counted means every limit allows the request.
+		return 0, nil
+	}
+	return d.fallback.Incr(ctx, key, ttl)
+}
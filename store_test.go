@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// A store configured with no room still keeps the latest key instead of
+// evicting from an empty list.
+func TestMemoryStoreZeroSize(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		s := newMemoryStore(size)
+		ctx := context.Background()
+		for _, key := range []string{"a", "b"} {
+			if n, err := s.Incr(ctx, key, time.Minute); err != nil || n != 1 {
+				t.Fatalf("size %d: Incr(%s) = %d, %v, want 1", size, key, n, err)
+			}
+		}
+		if _, ok, _ := s.Get(ctx, "a"); ok {
+			t.Errorf("size %d: a survived b being added", size)
+		}
+		if v, ok, _ := s.Get(ctx, "b"); !ok || v != "1" {
+			t.Errorf("size %d: b = %q, %v, want 1", size, v, ok)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+	"github.com/baakel/go_fcm/api"
+	"github.com/charmbracelet/log"
+	"github.com/gin-gonic/gin"
+)
+
+// Template is a named notification whose title, body and data values may
+// use text/template placeholders such as {{.name}}.
+type Template struct {
+	Name      string            `json:"name"`
+	Title     string            `json:"title"`
+	Body      string            `json:"body"`
+	Data      map[string]string `json:"data,omitempty"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+// fields lists the template texts by the name used in errors.
+func (t *Template) fields() map[string]string {
+	fields := map[string]string{"title": t.Title, "body": t.Body}
+	for k, v := range t.Data {
+		fields["data."+k] = v
+	}
+	return fields
+}
+
+// validate checks that every text parses.
+func (t *Template) validate() error {
+	for field, text := range t.fields() {
+		if _, err := template.New(field).Parse(text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// render fills the placeholders from vars. A placeholder without a variable
+// is an error rather than "<no value>" in someone's notification.
+func (t *Template) render(vars map[string]string) (title, body string, data map[string]string, err error) {
+	out := map[string]string{}
+	for field, text := range t.fields() {
+		tmpl, err := template.New(field).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return "", "", nil, err
+		}
+		var sb strings.Builder
+		if err := tmpl.Execute(&sb, vars); err != nil {
+			return "", "", nil, err
+		}
+		out[field] = sb.String()
+	}
+	if len(t.Data) > 0 {
+		data = make(map[string]string, len(t.Data))
+		for k := range t.Data {
+			data[k] = out["data."+k]
+		}
+	}
+	return out["title"], out["body"], data, nil
+}
+
+// TemplateStore keeps the named templates, persisted to a JSON file when
+// one is configured.
+type TemplateStore struct {
+	mu        sync.Mutex
+	templates map[string]*Template
+	file      string
+}
+
+func NewTemplateStore(file string) (*TemplateStore, error) {
+	s := &TemplateStore{templates: map[string]*Template{}, file: file}
+	if file == "" {
+		return s, nil
+	}
+	raw, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading templates file: %w", err)
+	}
+	var templates []*Template
+	if err := json.Unmarshal(raw, &templates); err != nil {
+		return nil, fmt.Errorf("parsing templates file: %w", err)
+	}
+	for _, t := range templates {
+		s.templates[t.Name] = t
+	}
+	return s, nil
+}
+
+// save must be called with s.mu held.
+func (s *TemplateStore) save() {
+	if s.file == "" {
+		return
+	}
+	templates := make([]*Template, 0, len(s.templates))
+	for _, t := range s.templates {
+		templates = append(templates, t)
+	}
+	raw, err := json.MarshalIndent(templates, "", "  ")
+	if err == nil {
+		tmp := s.file + ".tmp"
+		if err = os.WriteFile(tmp, raw, 0o600); err == nil {
+			err = os.Rename(tmp, s.file)
+		}
+	}
+	if err != nil {
+		log.Error("error saving templates", "error", err)
+	}
+}
+
+func (s *TemplateStore) get(name string) (*Template, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.templates[name]
+	return t, ok
+}
+
+type templateInput struct {
+	Title string            `json:"title" binding:"max=256"`
+	Body  string            `json:"body" binding:"max=4096"`
+	Data  map[string]string `json:"data" binding:"max=100"`
+}
+
+// Put creates or replaces the template named in the path.
+func (s *TemplateStore) Put(c *gin.Context) {
+	var in templateInput
+	if !bindInput(c, &in) {
+		return
+	}
+	t := &Template{Name: c.Param("name"), Title: in.Title, Body: in.Body, Data: in.Data, UpdatedAt: time.Now().UTC()}
+	// Parse errors belong to whoever saves the template, not to whoever
+	// later sends it.
+	if err := t.validate(); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, api.ErrorResponse{Error: fmt.Sprintf("invalid template: %s", err)})
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current := ""
+	if old, ok := s.templates[t.Name]; ok {
+		current = contentETag(old)
+	}
+	if !writeAllowed(c, current) {
+		return
+	}
+	s.templates[t.Name] = t
+	s.save()
+	c.Header("ETag", contentETag(t))
+	c.JSON(http.StatusOK, t)
+}
+
+func (s *TemplateStore) List(c *gin.Context) {
+	s.mu.Lock()
+	templates := make([]*Template, 0, len(s.templates))
+	for _, t := range s.templates {
+		templates = append(templates, t)
+	}
+	s.mu.Unlock()
+	slices.SortFunc(templates, func(a, b *Template) int { return strings.Compare(a.Name, b.Name) })
+	c.JSON(http.StatusOK, gin.H{"templates": templates})
+}
+
+func (s *TemplateStore) Get(c *gin.Context) {
+	t, ok := s.get(c.Param("name"))
+	if !ok {
+		c.JSON(http.StatusNotFound, api.ErrorResponse{Error: "template not found"})
+		return
+	}
+	if notModified(c, contentETag(t)) {
+		return
+	}
+	c.JSON(http.StatusOK, t)
+}
+
+func (s *TemplateStore) Delete(c *gin.Context) {
+	s.mu.Lock()
+	_, ok := s.templates[c.Param("name")]
+	delete(s.templates, c.Param("name"))
+	s.save()
+	s.mu.Unlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, api.ErrorResponse{Error: "template not found"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+type PublishNamedInput struct {
+	Token     string            `json:"to" binding:"required,fcmtoken"`
+	Template  string            `json:"template" binding:"required"`
+	Variables map[string]string `json:"variables"`
+	ClientRef string            `json:"client_ref,omitempty"`
+	Project   string            `json:"project,omitempty"`
+	api.PlatformInput
+}
+
+// PublishNamed renders a stored template with the request's variables and
+// sends it to a single device.
+func PublishNamed(c *gin.Context) {
+	var p PublishNamedInput
+	if !bindInput(c, &p) {
+		return
+	}
+	echoInput(c, p)
+	appState, _ := c.Get("state")
+	state := appState.(*AppState)
+
+	t, ok := state.Templates.get(p.Template)
+	if !ok {
+		c.JSON(http.StatusNotFound, api.ErrorResponse{Error: fmt.Sprintf("unknown template %q", p.Template), ClientRef: p.ClientRef})
+		return
+	}
+	title, body, data, err := t.render(p.Variables)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, api.ErrorResponse{Error: fmt.Sprintf("rendering template %q: %s", p.Template, err), ClientRef: p.ClientRef})
+		return
+	}
+	notification := messaging.Notification{Title: title, Body: body}
+	token := state.normalizeToken(p.Token)
+	android, apns, err := platformConfigs(p.PlatformInput, &notification, state.Defaults)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, api.ErrorResponse{Error: err.Error(), ClientRef: p.ClientRef})
+		return
+	}
+	message := &messaging.Message{
+		Notification: &notification,
+		Data:         data,
+		Token:        token,
+		Android:      android,
+		APNS:         apns,
+		Webpush:      webpushConfig(p.PlatformInput, data),
+		FCMOptions:   fcmOptions(p.PlatformInput, &notification),
+	}
+
+	client := state.clientFor(c, p.Project)
+	if client == nil {
+		return
+	}
+	if !state.limitDevice(c, message, p.ClientRef) {
+		return
+	}
+	state.applyQuietHours(message)
+	if !explain(c, p.PlatformInput, message) {
+		return
+	}
+
+	sendCtx, cancel := state.fcmContext(c)
+	defer cancel()
+	response, err := client.Send(sendCtx, message)
+	state.recordSend(c, "publish_named", "token:"+token, title, response, err, p.ClientRef)
+	if err != nil {
+		requestLog(c).Error("error sending templated message", "error", err, "template", p.Template, "token", redactToken(token), "client_ref", p.ClientRef)
+		c.Error(err)
+		c.JSON(fcmErrorStatus(c, err), withDebug(c, sendError(err, p.ClientRef)))
+		return
+	}
+	requestLog(c).Info("Successfully sent templated message", "resp", response, "template", p.Template, "client_ref", p.ClientRef, "analytics_label", c.GetString("analytics_label"))
+	c.JSON(http.StatusAccepted, sendResponse(c, 0, api.SendResponse{MessageID: response, ClientRef: p.ClientRef}))
+}
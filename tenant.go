@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+
+	"github.com/baakel/go_fcm/api"
+	"github.com/gin-gonic/gin"
+)
+
+// ProjectHeader selects the Firebase project for a request when the body has
+// no project field.
+const ProjectHeader = "X-Firebase-Project"
+
+// APIKey is an accepted credential and the tenant it belongs to.
+type APIKey struct {
+	Tenant string `yaml:"tenant"`
+	Key    string `yaml:"key"`
+	// KeyEnv names an environment variable holding the key, so the config
+	// file itself can stay free of secrets.
+	KeyEnv string `yaml:"key_env"`
+	// Projects lists the Firebase projects the key may target. An empty list
+	// allows every configured project.
+	Projects []string `yaml:"projects"`
+	// Project is where the tenant's requests go when they name no project.
+	// Without it a key allowing a single project defaults to that one, and
+	// any other key to the relay's default project.
+	Project string `yaml:"project"`
+	// Debug is the debug scope: the key may ask for the constructed message
+	// in responses.
+	Debug bool `yaml:"debug"`
+}
+
+func (k *APIKey) value() string {
+	if k.KeyEnv != "" {
+		return os.Getenv(k.KeyEnv)
+	}
+	return k.Key
+}
+
+// allows reports whether the key may target project.
+func (k *APIKey) allows(project string) bool {
+	return len(k.Projects) == 0 || slices.Contains(k.Projects, project)
+}
+
+func requestKey(c *gin.Context) *APIKey {
+	if v, ok := c.Get("api_key"); ok {
+		return v.(*APIKey)
+	}
+	return nil
+}
+
+func requestTenant(c *gin.Context) string {
+	return c.GetString("tenant")
+}
+
+// clientFor resolves the messaging client for the project requested in the
+// body (or the X-Firebase-Project header), enforcing the key's allowed
+// projects. On failure it writes the error response and returns nil.
+func (s *AppState) clientFor(c *gin.Context, project string) Messenger {
+	if project == "" {
+		project = c.GetHeader(ProjectHeader)
+	}
+	key := requestKey(c)
+
+	if project == "" {
+		switch {
+		case key != nil && key.Project != "":
+			project = key.Project
+		case key != nil && len(key.Projects) == 1:
+			project = key.Projects[0]
+		case key != nil && len(key.Projects) > 1:
+			c.JSON(http.StatusBadRequest, api.ErrorResponse{Error: fmt.Sprintf("project is required, this key may target %v", key.Projects)})
+			return nil
+		default:
+			c.Set("project", s.DefaultProject)
+			return s.MsgClient
+		}
+	}
+
+	if key != nil && !key.allows(project) {
+		c.JSON(http.StatusForbidden, api.ErrorResponse{Error: fmt.Sprintf("Forbidden: key may not target project %q", project)})
+		return nil
+	}
+	client, ok := s.Projects[project]
+	if !ok {
+		c.JSON(http.StatusBadRequest, api.ErrorResponse{Error: fmt.Sprintf("unknown project %q", project)})
+		return nil
+	}
+	c.Set("project", project)
+	return client
+}
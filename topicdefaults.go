@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/baakel/go_fcm/api"
+	"github.com/charmbracelet/log"
+	"github.com/gin-gonic/gin"
+)
+
+// TopicDefaults are the notification settings a topic's messages get when
+// the request doesn't set them. They take precedence over the configured
+// defaults.
+type TopicDefaults struct {
+	Topic   string                `json:"topic"`
+	Android *TopicAndroidDefaults `json:"android,omitempty"`
+	APNS    *TopicAPNSDefaults    `json:"apns,omitempty"`
+	// AnalyticsLabelPrefix is prepended to the request's analytics label, or
+	// is the label when the request has none.
+	AnalyticsLabelPrefix string    `json:"analytics_label_prefix,omitempty"`
+	UpdatedAt            time.Time `json:"updated_at"`
+}
+
+type TopicAndroidDefaults struct {
+	ChannelID string `json:"channel_id,omitempty" binding:"max=256"`
+	Sound     string `json:"sound,omitempty" binding:"max=256"`
+	Icon      string `json:"icon,omitempty" binding:"max=256"`
+	// Color is the notification icon color as #rrggbb.
+	Color string `json:"color,omitempty"`
+}
+
+type TopicAPNSDefaults struct {
+	Sound string `json:"sound,omitempty" binding:"max=256"`
+}
+
+// apply returns a copy of p with the unset fields filled from d, and the
+// names of the fields it filled. p itself is left alone so the request's own
+// values stay distinguishable.
+func (d *TopicDefaults) apply(p api.PlatformInput) (api.PlatformInput, []string) {
+	var filled []string
+	fill := func(field string, value *string, fallback string) {
+		if *value == "" && fallback != "" {
+			*value = fallback
+			filled = append(filled, field)
+		}
+	}
+	if a := d.Android; a != nil {
+		android := api.AndroidInput{}
+		if p.Android != nil {
+			android = *p.Android
+		}
+		fill("android.channel_id", &android.ChannelID, a.ChannelID)
+		fill("android.icon", &android.Icon, a.Icon)
+		fill("android.color", &android.Color, a.Color)
+		// The shared sound is the request's choice for both platforms.
+		if p.Sound == "" {
+			fill("android.sound", &android.Sound, a.Sound)
+		}
+		p.Android = &android
+	}
+	if a := d.APNS; a != nil && p.Sound == "" {
+		apns := api.APNSInput{}
+		if p.APNS != nil {
+			apns = *p.APNS
+		}
+		fill("apns.sound", &apns.Sound, a.Sound)
+		p.APNS = &apns
+	}
+	if prefix := d.AnalyticsLabelPrefix; prefix != "" {
+		o := api.FCMOptionsInput{}
+		if p.FCMOptions != nil {
+			o = *p.FCMOptions
+		}
+		if !strings.HasPrefix(o.AnalyticsLabel, prefix) {
+			o.AnalyticsLabel = prefix + o.AnalyticsLabel
+			filled = append(filled, "fcm_options.analytics_label")
+		}
+		p.FCMOptions = &o
+	}
+	return p, filled
+}
+
+// TopicDefaultsStore keeps the per-topic defaults, persisted to a JSON file
+// when one is configured.
+type TopicDefaultsStore struct {
+	mu       sync.Mutex
+	defaults map[string]*TopicDefaults
+	file     string
+}
+
+func NewTopicDefaultsStore(file string) (*TopicDefaultsStore, error) {
+	s := &TopicDefaultsStore{defaults: map[string]*TopicDefaults{}, file: file}
+	if file == "" {
+		return s, nil
+	}
+	raw, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading topic defaults file: %w", err)
+	}
+	var defaults []*TopicDefaults
+	if err := json.Unmarshal(raw, &defaults); err != nil {
+		return nil, fmt.Errorf("parsing topic defaults file: %w", err)
+	}
+	for _, d := range defaults {
+		s.defaults[d.Topic] = d
+	}
+	return s, nil
+}
+
+// save must be called with s.mu held.
+func (s *TopicDefaultsStore) save() {
+	if s.file == "" {
+		return
+	}
+	defaults := make([]*TopicDefaults, 0, len(s.defaults))
+	for _, d := range s.defaults {
+		defaults = append(defaults, d)
+	}
+	raw, err := json.MarshalIndent(defaults, "", "  ")
+	if err == nil {
+		tmp := s.file + ".tmp"
+		if err = os.WriteFile(tmp, raw, 0o600); err == nil {
+			err = os.Rename(tmp, s.file)
+		}
+	}
+	if err != nil {
+		log.Error("error saving topic defaults", "error", err)
+	}
+}
+
+func (s *TopicDefaultsStore) get(topic string) (*TopicDefaults, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.defaults[canonicalTopic(topic)]
+	return d, ok
+}
+
+// apply fills p from the defaults of topic, if it has any, and records the
+// filled fields for the debug output. Requests without a topic get p back.
+func (s *TopicDefaultsStore) apply(c *gin.Context, topic string, p api.PlatformInput) api.PlatformInput {
+	if topic == "" {
+		return p
+	}
+	d, ok := s.get(topic)
+	if !ok {
+		return p
+	}
+	p, filled := d.apply(p)
+	if len(filled) > 0 {
+		c.Set("topic_defaults", filled)
+	}
+	return p
+}
+
+type topicDefaultsInput struct {
+	Android              *TopicAndroidDefaults `json:"android"`
+	APNS                 *TopicAPNSDefaults    `json:"apns"`
+	AnalyticsLabelPrefix string                `json:"analytics_label_prefix" binding:"max=50"`
+}
+
+// Put creates or replaces the defaults of the topic named in the path.
+func (s *TopicDefaultsStore) Put(c *gin.Context) {
+	var in topicDefaultsInput
+	if !bindInput(c, &in) {
+		return
+	}
+	if in.Android != nil {
+		if err := validateColor(in.Android.Color); err != nil {
+			c.JSON(http.StatusUnprocessableEntity, api.ErrorResponse{Error: fmt.Sprintf("android.%s", err)})
+			return
+		}
+	}
+	topic := canonicalTopic(c.Param("topic"))
+	if !topicPattern.MatchString(topic) {
+		c.JSON(http.StatusUnprocessableEntity, api.ErrorResponse{Error: fmt.Sprintf("invalid topic %q", topic)})
+		return
+	}
+	d := &TopicDefaults{Topic: topic, Android: in.Android, APNS: in.APNS, AnalyticsLabelPrefix: in.AnalyticsLabelPrefix, UpdatedAt: time.Now().UTC()}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current := ""
+	if old, ok := s.defaults[topic]; ok {
+		current = contentETag(old)
+	}
+	if !writeAllowed(c, current) {
+		return
+	}
+	s.defaults[topic] = d
+	s.save()
+	c.Header("ETag", contentETag(d))
+	c.JSON(http.StatusOK, d)
+}
+
+func (s *TopicDefaultsStore) Get(c *gin.Context) {
+	d, ok := s.get(c.Param("topic"))
+	if !ok {
+		c.JSON(http.StatusNotFound, api.ErrorResponse{Error: "topic has no defaults"})
+		return
+	}
+	if notModified(c, contentETag(d)) {
+		return
+	}
+	c.JSON(http.StatusOK, d)
+}
+
+func (s *TopicDefaultsStore) Delete(c *gin.Context) {
+	topic := canonicalTopic(c.Param("topic"))
+	s.mu.Lock()
+	_, ok := s.defaults[topic]
+	delete(s.defaults, topic)
+	s.save()
+	s.mu.Unlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, api.ErrorResponse{Error: "topic has no defaults"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"github.com/charmbracelet/log"
+	"github.com/gin-gonic/gin"
+)
+
+// Tracing headers passed through from a request to its logs, error reports
+// and webhook deliveries.
+const (
+	TraceparentHeader   = "traceparent"
+	CorrelationIDHeader = "X-Correlation-ID"
+)
+
+// traceContext holds the caller's tracing headers. Absent headers stay
+// empty and are left out everywhere; none are ever generated here.
+type traceContext struct {
+	Traceparent   string
+	CorrelationID string
+}
+
+func traceFrom(c *gin.Context) traceContext {
+	if v, ok := c.Get("trace"); ok {
+		return v.(traceContext)
+	}
+	return traceContext{}
+}
+
+// fields returns the set values as log key-value pairs.
+func (t traceContext) fields() []any {
+	var kv []any
+	if t.Traceparent != "" {
+		kv = append(kv, "traceparent", t.Traceparent)
+	}
+	if t.CorrelationID != "" {
+		kv = append(kv, "correlation_id", t.CorrelationID)
+	}
+	return kv
+}
+
+// headers returns the set values as outgoing request headers.
+func (t traceContext) headers() map[string]string {
+	h := map[string]string{}
+	if t.Traceparent != "" {
+		h[TraceparentHeader] = t.Traceparent
+	}
+	if t.CorrelationID != "" {
+		h[CorrelationIDHeader] = t.CorrelationID
+	}
+	return h
+}
+
+// requestLog returns a logger carrying the request ID and tracing headers of
+// c.
+func requestLog(c *gin.Context) *log.Logger {
+	return log.With(append([]any{"request_id", c.GetString("request_id")}, traceFrom(c).fields()...)...)
+}
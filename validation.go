@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/baakel/go_fcm/api"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// maxTokenLength bounds registration tokens. Go's regexp caps repeat counts
+// at 1000, so the pattern can't.
+const maxTokenLength = 4096
+
+var (
+	// tokenPattern is deliberately loose: FCM documents neither the length
+	// nor the alphabet of registration tokens, this only catches values that
+	// are plainly something else.
+	tokenPattern = regexp.MustCompile(`^[A-Za-z0-9_:.\-]{20,}$`)
+	// topicPattern is FCM's topic name syntax, optionally with the /topics/
+	// prefix the SDK strips.
+	topicPattern = regexp.MustCompile(`^(/topics/)?[a-zA-Z0-9\-_.~%]{1,900}$`)
+)
+
+// validToken reports whether s looks like an FCM registration token.
+func validToken(s string) bool {
+	return len(s) <= maxTokenLength && tokenPattern.MatchString(s)
+}
+
+// canonicalTopic is topic without the optional /topics/ prefix, the name
+// FCM actually uses.
+func canonicalTopic(topic string) string {
+	return strings.TrimPrefix(topic, "/topics/")
+}
+
+// registerValidators adds our rules to gin's validator and makes it report
+// fields by their JSON names.
+func registerValidators() error {
+	v, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		return errors.New("unexpected gin validator engine")
+	}
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	rules := map[string]validator.Func{
+		"fcmtoken": func(fl validator.FieldLevel) bool { return validToken(fl.Field().String()) },
+		"fcmtopic": func(fl validator.FieldLevel) bool { return topicPattern.MatchString(fl.Field().String()) },
+		"httpsurl": func(fl validator.FieldLevel) bool {
+			u, err := url.Parse(fl.Field().String())
+			return err == nil && u.Scheme == "https" && u.Host != ""
+		},
+	}
+	for tag, fn := range rules {
+		if err := v.RegisterValidation(tag, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bindInput decodes the JSON body into obj and validates it. Malformed JSON
+// is answered with 400, a well-formed body failing validation with 422 and
+// one entry per failed field. It reports whether the handler may go on.
+func bindInput(c *gin.Context, obj any) bool {
+	err := c.ShouldBindJSON(obj)
+	if err == nil {
+		return true
+	}
+	var verrs validator.ValidationErrors
+	if !errors.As(err, &verrs) {
+		c.JSON(http.StatusBadRequest, api.ErrorResponse{Error: fmt.Sprintf("malformed JSON body: %s", err)})
+		return false
+	}
+	fields := make([]api.FieldError, 0, len(verrs))
+	for _, fe := range verrs {
+		field := fieldPath(obj, fe)
+		fields = append(fields, api.FieldError{Field: field, Rule: fe.Tag(), Message: fieldMessage(field, fe)})
+	}
+	c.JSON(http.StatusUnprocessableEntity, api.ErrorResponse{Error: "validation failed", Fields: fields})
+	return false
+}
+
+// fieldPath turns the validator namespace of a field of root, the validated
+// value, into the dotted JSON path of the field. The first segment is root's
+// type and embedded structs are flattened into their parent in the JSON, so
+// neither is part of the path.
+func fieldPath(root any, fe validator.FieldError) string {
+	segs := strings.Split(fe.Namespace(), ".")[1:]
+	goSegs := strings.Split(fe.StructNamespace(), ".")[1:]
+	t := reflect.TypeOf(root)
+	var path []string
+	for i, seg := range segs {
+		for t != nil && (t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice || t.Kind() == reflect.Array || t.Kind() == reflect.Map) {
+			t = t.Elem()
+		}
+		if t != nil && t.Kind() == reflect.Struct && i < len(goSegs) {
+			name, _, _ := strings.Cut(goSegs[i], "[")
+			if f, ok := t.FieldByName(name); ok {
+				t = f.Type
+				if f.Anonymous {
+					continue
+				}
+			}
+		}
+		path = append(path, seg)
+	}
+	return strings.Join(path, ".")
+}
+
+// respondTooMany answers 422 as a failed max rule on field would, for limits
+// that come from the configuration rather than a binding tag.
+func respondTooMany(c *gin.Context, field string, limit int, clientRef string) {
+	c.JSON(http.StatusUnprocessableEntity, api.ErrorResponse{
+		Error:     "validation failed",
+		ClientRef: clientRef,
+		Fields:    []api.FieldError{{Field: field, Rule: "max", Message: fmt.Sprintf("%s must have at most %d entries", field, limit)}},
+	})
+}
+
+// fieldMessage describes the failed rule of field, fe's JSON path.
+func fieldMessage(field string, fe validator.FieldError) string {
+	kind := fe.Kind()
+	switch fe.Tag() {
+	case "required":
+		return fmt.Sprintf("%s is required", field)
+	case "max":
+		if kind == reflect.String {
+			return fmt.Sprintf("%s must be at most %s characters long", field, fe.Param())
+		}
+		return fmt.Sprintf("%s must have at most %s entries", field, fe.Param())
+	case "min":
+		switch kind {
+		case reflect.String:
+			return fmt.Sprintf("%s must be at least %s characters long", field, fe.Param())
+		case reflect.Int, reflect.Int64, reflect.Float64:
+			return fmt.Sprintf("%s must be at least %s", field, fe.Param())
+		}
+		return fmt.Sprintf("%s must have at least %s entries", field, fe.Param())
+	case "fcmtoken":
+		return fmt.Sprintf("%s must be an FCM registration token", field)
+	case "fcmtopic":
+		return fmt.Sprintf("%s must be a topic name made of letters, digits and -_.~%%", field)
+	case "httpsurl":
+		return fmt.Sprintf("%s must be an absolute https URL", field)
+	}
+	return fmt.Sprintf("%s failed the %s rule", field, fe.Tag())
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/baakel/go_fcm/api"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// minInput exercises the min rule, which no request body uses on strings or
+// lists yet.
+type minInput struct {
+	Name string   `json:"name" binding:"min=3"`
+	Tags []string `json:"tags" binding:"min=2"`
+}
+
+// The messages are shown to users by clients, so each rule's is pinned.
+func TestFieldMessages(t *testing.T) {
+	if err := registerValidatorsOnce(); err != nil {
+		t.Fatal(err)
+	}
+	token := testToken(1)
+	count := -1
+	data := map[string]string{}
+	for i := range 101 {
+		data[fmt.Sprint(i)] = "v"
+	}
+
+	tests := []struct {
+		name                 string
+		in                   any
+		field, rule, message string
+	}{
+		{"required", &api.PublishInput{}, "to", "required", "to is required"},
+		{"required list", &api.SubscribeInput{Topic: "news"}, "tokens", "required", "tokens is required"},
+		{"fcmtoken", &api.PublishInput{Token: "short"}, "to", "fcmtoken", "to must be an FCM registration token"},
+		{"fcmtoken in list", &api.SubscribeInput{Tokens: []string{token, "short"}, Topic: "news"}, "tokens[1]", "fcmtoken", "tokens[1] must be an FCM registration token"},
+		{"fcmtopic", &api.BroadCastInput{Topic: "no spaces"}, "topic", "fcmtopic", "topic must be a topic name made of letters, digits and -_.~%"},
+		{"max string", &api.PublishInput{Token: token, Notification: api.Notification{Title: strings.Repeat("x", 257)}}, "notification.title", "max", "notification.title must be at most 256 characters long"},
+		{"max map", &api.SendInput{Topic: "news", Data: data}, "data", "max", "data must have at most 100 entries"},
+		{"max list", &api.PublishInput{Token: token, PlatformInput: api.PlatformInput{Webpush: &api.WebpushInput{Actions: make([]api.WebpushAction, 11)}}}, "webpush.actions", "max", "webpush.actions must have at most 10 entries"},
+		{"min string", &minInput{Name: "ab", Tags: []string{"a", "b"}}, "name", "min", "name must be at least 3 characters long"},
+		{"min list", &minInput{Name: "abc", Tags: []string{"a"}}, "tags", "min", "tags must have at least 2 entries"},
+		{"min number", &api.PublishInput{Token: token, PlatformInput: api.PlatformInput{Android: &api.AndroidInput{NotificationCount: &count}}}, "android.notification_count", "min", "android.notification_count must be at least 0"},
+		{"min in list", &api.PublishInput{Token: token, PlatformInput: api.PlatformInput{Webpush: &api.WebpushInput{Vibrate: []int{100, -1}}}}, "webpush.vibrate[1]", "min", "webpush.vibrate[1] must be at least 0"},
+		{"httpsurl", &api.PublishInput{Token: token, PlatformInput: api.PlatformInput{FCMOptions: &api.FCMOptionsInput{Image: "http://example.com/a.png"}}}, "fcm_options.image", "httpsurl", "fcm_options.image must be an absolute https URL"},
+		{"nested required", &api.PublishInput{Token: token, PlatformInput: api.PlatformInput{APNS: &api.APNSInput{Rich: &api.RichInput{ImageURL: "https://example.com/a.png"}}}}, "apns.rich.category", "required", "apns.rich.category is required"},
+		{"other rule", &api.PublishInput{Token: token, PlatformInput: api.PlatformInput{APNS: &api.APNSInput{Priority: 7}}}, "apns.priority", "oneof", "apns.priority failed the oneof rule"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := binding.Validator.ValidateStruct(tt.in)
+			var verrs validator.ValidationErrors
+			if !errors.As(err, &verrs) || len(verrs) != 1 {
+				t.Fatalf("got %v, want exactly one failed rule", err)
+			}
+			fe := verrs[0]
+			field := fieldPath(tt.in, fe)
+			if field != tt.field {
+				t.Errorf("field %q, want %q", field, tt.field)
+			}
+			if fe.Tag() != tt.rule {
+				t.Errorf("rule %q, want %q", fe.Tag(), tt.rule)
+			}
+			if got := fieldMessage(field, fe); got != tt.message {
+				t.Errorf("message %q, want %q", got, tt.message)
+			}
+		})
+	}
+}
+
+// The configured token cap answers like a failed max rule on tokens.
+func TestTokenCapEnvelope(t *testing.T) {
+	srv, _ := newTestServer(t, &fakeMessenger{}, func(c *Config) { c.Topics.MaxTokens = 2 })
+
+	body := fmt.Sprintf(`{"tokens":[%q,%q,%q],"topic":"news"}`, testToken(1), testToken(2), testToken(3))
+	resp := post(t, srv, "/subscribe", body)
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusUnprocessableEntity)
+	}
+	var e api.ErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&e); err != nil {
+		t.Fatal(err)
+	}
+	want := api.FieldError{Field: "tokens", Rule: "max", Message: "tokens must have at most 2 entries"}
+	if e.Error != "validation failed" || len(e.Fields) != 1 || e.Fields[0] != want {
+		t.Fatalf("got %+v, want the field envelope with %+v", e, want)
+	}
+}
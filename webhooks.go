@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/baakel/go_fcm/api"
+	"github.com/charmbracelet/log"
+	"github.com/gin-gonic/gin"
+)
+
+// Webhook event types.
+const (
+	EventSent              = "sent"
+	EventFailed            = "failed"
+	EventScheduledFired    = "scheduled_fired"
+	EventTokenUnregistered = "token_unregistered"
+)
+
+var webhookEvents = []string{EventSent, EventFailed, EventScheduledFired, EventTokenUnregistered}
+
+const (
+	webhookDeliveryLog   = 50
+	webhookQueueSize     = 1024
+	webhookWorkers       = 4
+	webhookClientTimeout = 10 * time.Second
+)
+
+type Webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Disabled  bool      `json:"disabled"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// failingSince is when the current run of failed deliveries started.
+	failingSince time.Time
+	deliveries   []Delivery
+}
+
+// Delivery is one attempt to deliver an event to a webhook.
+type Delivery struct {
+	EventID  string        `json:"event_id"`
+	Event    string        `json:"event"`
+	Attempt  int           `json:"attempt"`
+	Time     time.Time     `json:"time"`
+	Status   int           `json:"status,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+// WebhookEvent is the JSON body posted to webhooks.
+type WebhookEvent struct {
+	ID   string         `json:"id"`
+	Type string         `json:"type"`
+	Time time.Time      `json:"time"`
+	Data map[string]any `json:"data"`
+}
+
+type webhookJob struct {
+	hook    *Webhook
+	event   WebhookEvent
+	trace   traceContext
+	body    []byte
+	attempt int
+	first   time.Time
+}
+
+// WebhookRegistry stores webhook subscriptions and delivers matching events
+// with retries and exponential backoff. Subscriptions are persisted to a JSON
+// file when one is configured.
+type WebhookRegistry struct {
+	mu           sync.Mutex
+	hooks        map[string]*Webhook
+	file         string
+	disableAfter time.Duration
+	retry        RetryPolicy
+	audit        *AuditLog
+
+	queue  chan webhookJob
+	client *http.Client
+}
+
+func NewWebhookRegistry(c WebhooksConfig, retry RetryPolicy, audit *AuditLog) (*WebhookRegistry, error) {
+	r := &WebhookRegistry{
+		hooks:        map[string]*Webhook{},
+		file:         c.File,
+		disableAfter: c.DisableAfter,
+		retry:        retry,
+		audit:        audit,
+		queue:        make(chan webhookJob, webhookQueueSize),
+		client:       &http.Client{Timeout: webhookClientTimeout},
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	for range webhookWorkers {
+		go r.worker()
+	}
+	return r, nil
+}
+
+func (r *WebhookRegistry) load() error {
+	if r.file == "" {
+		return nil
+	}
+	raw, err := os.ReadFile(r.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading webhooks file: %w", err)
+	}
+	var hooks []*Webhook
+	if err := json.Unmarshal(raw, &hooks); err != nil {
+		return fmt.Errorf("parsing webhooks file: %w", err)
+	}
+	for _, h := range hooks {
+		r.hooks[h.ID] = h
+	}
+	return nil
+}
+
+// save must be called with r.mu held.
+func (r *WebhookRegistry) save() {
+	if r.file == "" {
+		return
+	}
+	hooks := make([]*Webhook, 0, len(r.hooks))
+	for _, h := range r.hooks {
+		hooks = append(hooks, h)
+	}
+	raw, err := json.MarshalIndent(hooks, "", "  ")
+	if err == nil {
+		tmp := r.file + ".tmp"
+		if err = os.WriteFile(tmp, raw, 0o600); err == nil {
+			err = os.Rename(tmp, r.file)
+		}
+	}
+	if err != nil {
+		log.Error("error saving webhooks", "error", err)
+	}
+}
+
+// Emit queues an event for every enabled webhook subscribed to its type.
+func (r *WebhookRegistry) Emit(eventType string, data map[string]any) {
+	r.emit(traceContext{}, eventType, data)
+}
+
+// emit is Emit for an event caused by a request, whose tracing headers go
+// along with the deliveries.
+func (r *WebhookRegistry) emit(trace traceContext, eventType string, data map[string]any) {
+	if r == nil {
+		return
+	}
+	ev := WebhookEvent{ID: randomHex(16), Type: eventType, Time: time.Now().UTC(), Data: data}
+	body, err := json.Marshal(ev)
+	if err != nil {
+		log.Error("error encoding webhook event", "error", err)
+		return
+	}
+
+	r.mu.Lock()
+	var targets []*Webhook
+	for _, h := range r.hooks {
+		if !h.Disabled && slices.Contains(h.Events, eventType) {
+			targets = append(targets, h)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, h := range targets {
+		r.enqueue(webhookJob{hook: h, event: ev, trace: trace, body: body, attempt: 1, first: time.Now()})
+	}
+}
+
+// emitSend emits sent or failed for a send outcome, plus token_unregistered
+// when FCM reports the target token as no longer valid.
+func (r *WebhookRegistry) emitSend(c *gin.Context, action, target, messageID string, err error, clientRef string) {
+	if r == nil {
+		return
+	}
+	data := map[string]any{
+		"action":     action,
+		"target":     target,
+		"project":    c.GetString("project"),
+		"tenant":     requestTenant(c),
+		"request_id": c.GetString("request_id"),
+	}
+	if clientRef != "" {
+		data["client_ref"] = clientRef
+	}
+	trace := traceFrom(c)
+	if err == nil {
+		data["message_id"] = messageID
+		r.emit(trace, EventSent, data)
+		return
+	}
+	data["code"] = fcmErrorCode(err)
+	data["error"] = err.Error()
+	r.emit(trace, EventFailed, data)
+	if data["code"] == api.ErrCodeUnregistered {
+		r.emit(trace, EventTokenUnregistered, data)
+	}
+}
+
+func (r *WebhookRegistry) enqueue(job webhookJob) {
+	select {
+	case r.queue <- job:
+	default:
+		log.Warn("webhook queue full, dropping delivery", "webhook", job.hook.ID, "event", job.event.ID)
+	}
+}
+
+func (r *WebhookRegistry) worker() {
+	for job := range r.queue {
+		r.deliver(job)
+	}
+}
+
+func (r *WebhookRegistry) deliver(job webhookJob) {
+	r.mu.Lock()
+	secret, target, disabled := job.hook.Secret, job.hook.URL, job.hook.Disabled
+	r.mu.Unlock()
+	if disabled {
+		return
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(job.body)
+
+	d := Delivery{EventID: job.event.ID, Event: job.event.Type, Attempt: job.attempt, Time: time.Now().UTC()}
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(job.body))
+	if err == nil {
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Webhook-ID", job.hook.ID)
+		req.Header.Set("X-Webhook-Event", job.event.Type)
+		req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		for k, v := range job.trace.headers() {
+			req.Header.Set(k, v)
+		}
+		var resp *http.Response
+		resp, err = r.client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			d.Status = resp.StatusCode
+			if resp.StatusCode >= 300 {
+				err = fmt.Errorf("unexpected status %s", resp.Status)
+			}
+		}
+	}
+	d.Duration = time.Since(d.Time)
+	if err != nil {
+		d.Error = err.Error()
+	}
+	r.record(job.hook, d, err == nil)
+
+	if err == nil {
+		retryAttempts.observe("webhook", float64(job.attempt))
+		return
+	}
+	if delay := r.retry.backoff(job.attempt); r.retry.allows(job.attempt, job.first, delay) {
+		job.attempt++
+		time.AfterFunc(delay, func() { r.enqueue(job) })
+		return
+	}
+	retryAttempts.observe("webhook", float64(job.attempt))
+}
+
+// record stores a delivery attempt and disables the webhook once it has been
+// failing for longer than disableAfter.
+func (r *WebhookRegistry) record(h *Webhook, d Delivery, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	h.deliveries = append(h.deliveries, d)
+	if len(h.deliveries) > webhookDeliveryLog {
+		h.deliveries = h.deliveries[len(h.deliveries)-webhookDeliveryLog:]
+	}
+
+	if ok {
+		h.failingSince = time.Time{}
+		return
+	}
+	if h.failingSince.IsZero() {
+		h.failingSince = d.Time
+	}
+	if r.disableAfter > 0 && d.Time.Sub(h.failingSince) >= r.disableAfter && !h.Disabled {
+		h.Disabled = true
+		r.save()
+		log.Warn("disabled failing webhook", "webhook", h.ID, "failing_since", h.failingSince)
+		r.audit.Record(AuditEntry{
+			Action: "webhook_disabled",
+			Target: "webhook:" + h.ID,
+			Tenant: h.Tenant,
+			Error:  fmt.Sprintf("failing since %s", h.failingSince.Format(time.RFC3339)),
+		})
+	}
+}
+
+type webhookInput struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret"`
+}
+
+func (r *WebhookRegistry) Create(c *gin.Context) {
+	var in webhookInput
+	if err := c.Bind(&in); err != nil {
+		return
+	}
+	u, err := url.Parse(in.URL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		c.JSON(http.StatusBadRequest, api.ErrorResponse{Error: "url must be an absolute http(s) URL"})
+		return
+	}
+	if len(in.Events) == 0 {
+		c.JSON(http.StatusBadRequest, api.ErrorResponse{Error: fmt.Sprintf("events must list at least one of %v", webhookEvents)})
+		return
+	}
+	for _, e := range in.Events {
+		if !slices.Contains(webhookEvents, e) {
+			c.JSON(http.StatusBadRequest, api.ErrorResponse{Error: fmt.Sprintf("unknown event %q, expected one of %v", e, webhookEvents)})
+			return
+		}
+	}
+	if in.Secret == "" {
+		in.Secret = randomHex(32)
+	}
+
+	h := &Webhook{
+		ID:        randomHex(8),
+		URL:       in.URL,
+		Events:    in.Events,
+		Secret:    in.Secret,
+		Tenant:    requestTenant(c),
+		CreatedAt: time.Now().UTC(),
+	}
+	r.mu.Lock()
+	r.hooks[h.ID] = h
+	r.save()
+	r.mu.Unlock()
+
+	// The secret is only ever returned here.
+	c.JSON(http.StatusCreated, h)
+}
+
+func (r *WebhookRegistry) List(c *gin.Context) {
+	r.mu.Lock()
+	hooks := make([]Webhook, 0, len(r.hooks))
+	for _, h := range r.hooks {
+		out := *h
+		out.Secret = ""
+		hooks = append(hooks, out)
+	}
+	r.mu.Unlock()
+	slices.SortFunc(hooks, func(a, b Webhook) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	c.JSON(http.StatusOK, gin.H{"webhooks": hooks})
+}
+
+func (r *WebhookRegistry) Delete(c *gin.Context) {
+	r.mu.Lock()
+	_, ok := r.hooks[c.Param("id")]
+	delete(r.hooks, c.Param("id"))
+	r.save()
+	r.mu.Unlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, api.ErrorResponse{Error: "webhook not found"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (r *WebhookRegistry) Deliveries(c *gin.Context) {
+	r.mu.Lock()
+	h, ok := r.hooks[c.Param("id")]
+	var deliveries []Delivery
+	if ok {
+		deliveries = slices.Clone(h.deliveries)
+	}
+	r.mu.Unlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, api.ErrorResponse{Error: "webhook not found"})
+		return
+	}
+	slices.Reverse(deliveries)
+	c.JSON(http.StatusOK, gin.H{"deliveries": deliveries})
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baakel/go_fcm/api"
+)
+
+// These tests pin the JSON of the api package, which clients other than the
+// Go one depend on.
+
+func TestWireRequests(t *testing.T) {
+	ttl := int64(60)
+	tests := []struct {
+		name string
+		body string
+		into any
+		want any
+	}{
+		{
+			name: "publish",
+			body: `{"to":"tok","notification":{"title":"T","body":"B"},"client_ref":"r","project":"p","sync":true,"ttl":60,"sound":"ding","android":{"channel_id":"c"},"apns":{"push_type":"alert"}}`,
+			into: &api.PublishInput{},
+			want: &api.PublishInput{
+				Token:        "tok",
+				Notification: api.Notification{Title: "T", Body: "B"},
+				ClientRef:    "r",
+				Project:      "p",
+				Sync:         true,
+				PlatformInput: api.PlatformInput{
+					TTL:     &ttl,
+					Sound:   "ding",
+					Android: &api.AndroidInput{ChannelID: "c"},
+					APNS:    &api.APNSInput{PushType: "alert"},
+				},
+			},
+		},
+		{
+			name: "broadcast",
+			body: `{"topic":"news","notification":{"title":"T"},"project":"p"}`,
+			into: &api.BroadCastInput{},
+			want: &api.BroadCastInput{Topic: "news", Notification: api.Notification{Title: "T"}, Project: "p"},
+		},
+		{
+			name: "subscribe",
+			body: `{"tokens":["a","b"],"topic":"news","project":"p"}`,
+			into: &api.SubscribeInput{},
+			want: &api.SubscribeInput{Tokens: []string{"a", "b"}, Topic: "news", Project: "p"},
+		},
+		{
+			name: "send",
+			body: `{"tokens":["a"],"data":{"k":"v"},"dry_run":true,"all_or_nothing":true,"fcm_options":{"analytics_label":"l"}}`,
+			into: &api.SendInput{},
+			want: &api.SendInput{
+				Tokens:        []string{"a"},
+				Data:          map[string]string{"k": "v"},
+				DryRun:        true,
+				AllOrNothing:  true,
+				PlatformInput: api.PlatformInput{FCMOptions: &api.FCMOptionsInput{AnalyticsLabel: "l"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := json.Unmarshal([]byte(tt.body), tt.into); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tt.into, tt.want) {
+				t.Fatalf("decoded %+v, want %+v", tt.into, tt.want)
+			}
+		})
+	}
+}
+
+func TestWireResponses(t *testing.T) {
+	sendAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name string
+		body any
+		want string
+	}{
+		{
+			name: "sent",
+			body: api.SendResponse{MessageID: "m", ClientRef: "r"},
+			want: `{"message_id":"m","client_ref":"r"}`,
+		},
+		{
+			name: "queued",
+			body: api.SendResponse{ClientRef: "r", Queued: true, Handle: "h", SendAt: &sendAt},
+			want: `{"client_ref":"r","queued":true,"handle":"h","send_at":"2024-01-02T03:04:05Z"}`,
+		},
+		{
+			name: "deduplicated",
+			body: api.SendResponse{MessageID: "m", Deduplicated: true},
+			want: `{"message_id":"m","deduplicated":true}`,
+		},
+		{
+			name: "multicast",
+			body: api.MulticastResponse{SuccessCount: 1, FailureCount: 1, Failures: []api.MulticastFailure{{Index: 1, Code: api.ErrCodeUnregistered, Error: "gone"}}, ClientRef: "r"},
+			want: `{"success_count":1,"failure_count":1,"failures":[{"index":1,"code":"unregistered","error":"gone"}],"skipped_count":0,"client_ref":"r"}`,
+		},
+		{
+			name: "subscribe",
+			body: api.SubscribeResponse{Topic: "news", DuplicatesRemoved: 1, SuccessCount: 1, FailureCount: 1, Failures: []api.TopicFailure{{Index: 1, Reason: "INVALID_ARGUMENT"}}},
+			want: `{"topic":"news","duplicates_removed":1,"success_count":1,"failure_count":1,"failures":[{"index":1,"reason":"INVALID_ARGUMENT"}]}`,
+		},
+		{
+			name: "error",
+			body: api.ErrorResponse{Error: "validation failed", Fields: []api.FieldError{{Field: "to", Rule: "required", Message: "to is required"}}},
+			want: `{"error":"validation failed","fields":[{"field":"to","rule":"required","message":"to is required"}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := json.Marshal(tt.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// A topic call FCM refuses for every token fails with the error envelope.
+func TestTopicAllFailedWire(t *testing.T) {
+	fake := &fakeMessenger{topicFailures: map[string]string{
+		testToken(1): "INVALID_ARGUMENT",
+		testToken(2): "NOT_FOUND",
+	}}
+	srv, _ := newTestServer(t, fake)
+
+	for _, path := range []string{"/subscribe", "/unsubscribe"} {
+		t.Run(path, func(t *testing.T) {
+			body := `{"tokens":["` + testToken(1) + `","` + testToken(2) + `"],"topic":"news"}`
+			resp := post(t, srv, path, body)
+			if resp.StatusCode != http.StatusBadGateway {
+				t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusBadGateway)
+			}
+
+			var raw map[string]json.RawMessage
+			if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+				t.Fatal(err)
+			}
+			if len(raw) != 1 || raw["error"] == nil {
+				t.Fatalf("body has keys %v, want only error", reflect.ValueOf(raw).MapKeys())
+			}
+			var msg string
+			if err := json.Unmarshal(raw["error"], &msg); err != nil {
+				t.Fatalf("error is not a string: %s", raw["error"])
+			}
+			if !strings.Contains(msg, "token 0: INVALID_ARGUMENT") || !strings.Contains(msg, "token 1: NOT_FOUND") {
+				t.Fatalf("error %q lacks the per-token reasons", msg)
+			}
+		})
+	}
+}
+
+// Every failure answers with the ErrorResponse envelope and nothing else.
+func TestErrorEnvelope(t *testing.T) {
+	fake := &fakeMessenger{failTokens: map[string]error{testToken(2): errors.New("gone")}}
+	srv, _ := newTestServer(t, fake)
+
+	tests := []struct {
+		name, method, path, body string
+		status                   int
+	}{
+		{"send without target", http.MethodPost, "/send", `{"notification":{"title":"T"}}`, http.StatusUnprocessableEntity},
+		{"send dry run with tokens", http.MethodPost, "/send", `{"tokens":["` + testToken(1) + `"],"dry_run":true}`, http.StatusUnprocessableEntity},
+		{"send failed", http.MethodPost, "/send", `{"token":"` + testToken(2) + `","notification":{"title":"T"}}`, http.StatusBadGateway},
+		{"publish failed", http.MethodPost, "/publish", publishBody(testToken(2)), http.StatusBadGateway},
+		{"all or nothing rejected", http.MethodPost, "/send", `{"tokens":["` + testToken(1) + `","` + testToken(2) + `"],"all_or_nothing":true}`, http.StatusBadRequest},
+		{"preview with two targets", http.MethodPost, "/preview", `{"to":"` + testToken(1) + `","topic":"news"}`, http.StatusUnprocessableEntity},
+		{"debug without scope", http.MethodPost, "/send", `{"token":"` + testToken(1) + `","debug":true}`, http.StatusForbidden},
+		{"test without token", http.MethodPost, "/test", "", http.StatusBadRequest},
+		{"unknown template", http.MethodGet, "/templates/nope", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := request(t, srv, tt.method, tt.path, tt.body)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			dec := json.NewDecoder(resp.Body)
+			dec.DisallowUnknownFields()
+			var e api.ErrorResponse
+			if err := dec.Decode(&e); err != nil {
+				t.Fatalf("body is not an ErrorResponse: %v", err)
+			}
+			if e.Error == "" {
+				t.Fatal("error is empty")
+			}
+		})
+	}
+}